@@ -0,0 +1,85 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/driver"
+)
+
+const auditCommand = "audit"
+
+// runAudit reports the buckets and users leaked between COSI and RGW, and removes the RGW ones with --fix
+func runAudit(ctx context.Context, driverName string, args []string) error {
+	flags := flag.NewFlagSet(auditCommand, flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "remove orphaned RGW buckets, users and subusers, buckets holding objects are kept; requires --cluster-id")
+	output := flags.String("output", "table", "output format, table or json")
+	minAge := flags.Duration("min-age", time.Hour, "RGW buckets created more recently are not reported, they may still be in provisioning")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unsupported output %q", *output)
+	}
+
+	report, auditErr := driver.Audit(ctx, driverName, driver.AuditOptions{
+		Fix:        *fix,
+		MinAge:     *minAge,
+		ClusterID:  *clusterID,
+		Connection: connectionOptions(),
+	})
+	if report == nil {
+		return auditErr
+	}
+	var err error
+	if *output == "json" {
+		err = json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		err = printAuditReport(os.Stdout, report)
+	}
+	if err != nil {
+		return err
+	}
+	return auditErr
+}
+
+func printAuditReport(out io.Writer, report *driver.AuditReport) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tBACKEND\tNAME\tOBJECT\tSTATUS")
+	for _, o := range report.Orphans {
+		status := "orphaned"
+		if o.Fixed {
+			status = "removed"
+		} else if o.Error != "" {
+			status = "error: " + o.Error
+		}
+		object := o.Object
+		if object == "" {
+			object = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", o.Kind, o.Backend, o.Name, object, status)
+	}
+	return w.Flush()
+}
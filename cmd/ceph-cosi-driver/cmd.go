@@ -20,8 +20,12 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"time"
 
 	"github.com/ceph/cosi-driver-ceph/pkg/driver"
+	"github.com/ceph/cosi-driver-ceph/pkg/metrics"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/breaker"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
 
 	"k8s.io/klog/v2"
 
@@ -33,6 +37,38 @@ const provisionerName = "ceph.objectstorage.k8s.io"
 var (
 	driverAddress = flag.String("driver-address", "unix:///var/lib/cosi/cosi.sock", "driver address for socket")
 	driverPrefix  = flag.String("driver-prefix", "", "prefix for cosi driver, e.g. <prefix>.ceph.objectstorage.k8s.io")
+
+	kubeconfig    = flag.String("kubeconfig", "", "path of a kubeconfig file to run outside the cluster (in-cluster config if empty)")
+	kubeContext   = flag.String("kube-context", "", "kubeconfig context to use instead of the current context")
+	backendConfig = flag.String("backend-config", "", "path of a file with the credentials of the backends, used instead of the object store user secrets")
+
+	s3Debug              = flag.Bool("s3-debug", false, "log the requests and responses of the S3 SDK, with credentials redacted")
+	s3Timeout            = flag.Duration("s3-timeout", s3client.HttpTimeOut, "timeout of each S3 request")
+	s3MaxRetries         = flag.Int("s3-max-retries", s3client.DefaultMaxRetries, "retries of a failed S3 request, with jittered exponential backoff")
+	s3VirtualHostedStyle = flag.Bool("s3-virtual-hosted-style", false, "address buckets as <bucket>.<endpoint host> instead of <endpoint>/<bucket>")
+	s3Region             = flag.String("s3-region", "us-east-1", "region the S3 requests are signed for")
+	s3UserAgent          = flag.String("s3-user-agent", "", "appended to the User-Agent of the S3 requests")
+
+	backendFailureThreshold = flag.Int("backend-failure-threshold", 5, "consecutive failed requests opening the circuit of a backend, requests then fail fast (disabled if 0)")
+	backendOpenTimeout      = flag.Duration("backend-open-timeout", 30*time.Second, "how long the circuit of a failing backend stays open before a request probes it")
+	backendMaxInFlight      = flag.Int("backend-max-in-flight", 32, "maximum concurrent requests to a backend (unlimited if 0)")
+
+	metricsAddress      = flag.String("metrics-address", "", "address to expose prometheus metrics on, e.g. :8080 (disabled if empty)")
+	keyMaxAge           = flag.Duration("key-max-age", 0, "maximum age of an access key before it is rotated (disabled if 0)")
+	keyRotationOverlap  = flag.Duration("key-rotation-overlap", 24*time.Hour, "how long a rotated access key stays valid")
+	keyRotationInterval = flag.Duration("key-rotation-interval", 5*time.Minute, "how often bucket accesses are checked for key rotation (disabled if 0)")
+
+	clusterID             = flag.String("cluster-id", "", "cluster ID marking the created buckets and users, required by audit --fix")
+	tagReconcileInterval  = flag.Duration("tag-reconcile-interval", 10*time.Minute, "how often bucket tags are reconciled with the bucket classes (disabled if 0)")
+	userReconcileInterval = flag.Duration("user-reconcile-interval", 0, "how often the restrictions of the users are reconciled with the bucket access classes (disabled if 0)")
+	syncStatusInterval    = flag.Duration("sync-status-interval", 5*time.Minute, "how often the sync status of buckets with a sync policy is reported (disabled if 0)")
+
+	policyReconcileInterval = flag.Duration("policy-reconcile-interval", 10*time.Minute, "how often bucket policies are checked for drift from the granted accesses (disabled if 0)")
+	restorePolicies         = flag.Bool("restore-policies", false, "restore bucket policy statements of granted accesses which were removed or modified")
+	usageInterval           = flag.Duration("usage-interval", 5*time.Minute, "how often the usage of the buckets is published on the Buckets and as metrics (disabled if 0)")
+	bucketNameInterval      = flag.Duration("bucket-name-interval", time.Minute, "how often the RGW bucket names of templated buckets are published in the credentials secrets (disabled if 0)")
+
+	dryRun = flag.Bool("dry-run", false, "validate the requests and log the changes they would make on RGW without applying them")
 )
 
 func init() {
@@ -43,19 +79,72 @@ func init() {
 	flag.Parse()
 }
 
+func connectionOptions() driver.ConnectionOptions {
+	return driver.ConnectionOptions{
+		KubeConfig:    *kubeconfig,
+		KubeContext:   *kubeContext,
+		BackendConfig: *backendConfig,
+		S3: s3client.Options{
+			Debug:              *s3Debug,
+			Timeout:            *s3Timeout,
+			MaxRetries:         s3MaxRetries,
+			VirtualHostedStyle: *s3VirtualHostedStyle,
+			Region:             *s3Region,
+			UserAgent:          *s3UserAgent,
+		},
+		Breaker: breaker.Options{
+			FailureThreshold: *backendFailureThreshold,
+			OpenTimeout:      *backendOpenTimeout,
+			MaxInFlight:      *backendMaxInFlight,
+		},
+	}
+}
+
 func run(ctx context.Context) error {
 	if *driverPrefix == "" {
 		return errors.New("driver prefix is missing for ceph cosi driver deployment")
 	}
+	if *s3MaxRetries < 0 {
+		return errors.New("s3-max-retries must not be negative")
+	}
 	driverName := *driverPrefix + "." + provisionerName
-	identityServer, bucketProvisioner, err := driver.NewDriver(ctx, driverName)
+	if flag.Arg(0) == auditCommand {
+		return runAudit(ctx, driverName, flag.Args()[1:])
+	}
+	if *metricsAddress != "" {
+		go func() {
+			if err := metrics.Serve(ctx, *metricsAddress); err != nil {
+				klog.ErrorS(err, "failed to serve metrics")
+			}
+		}()
+	}
+	identityServer, bucketProvisioner, err := driver.NewDriver(ctx, driverName, driver.Options{
+		KeyRotation: driver.KeyRotationOptions{
+			MaxKeyAge: *keyMaxAge,
+			Overlap:   *keyRotationOverlap,
+			Interval:  *keyRotationInterval,
+		},
+		ClusterID:             *clusterID,
+		TagReconcileInterval:  *tagReconcileInterval,
+		UserReconcileInterval: *userReconcileInterval,
+		SyncStatusInterval:    *syncStatusInterval,
+		PolicyReconcile: driver.PolicyReconcileOptions{
+			Interval: *policyReconcileInterval,
+			Restore:  *restorePolicies,
+		},
+		UsageInterval:      *usageInterval,
+		BucketNameInterval: *bucketNameInterval,
+		Connection:         connectionOptions(),
+		DryRun:             *dryRun,
+	})
 	if err != nil {
 		return err
 	}
 
-	server, err := provisioner.NewDefaultCOSIProvisionerServer(*driverAddress,
+	server, err := provisioner.NewCOSIProvisionerServer(*driverAddress,
 		identityServer,
-		bucketProvisioner)
+		bucketProvisioner,
+		driver.ServerOptions())
 	if err != nil {
 		return err
 	}
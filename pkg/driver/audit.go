@@ -0,0 +1,384 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	"github.com/aws/aws-sdk-go/aws"
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/consts"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+)
+
+const (
+	// OrphanRGWBucket is an RGW bucket of the driver without a COSI Bucket
+	OrphanRGWBucket = "rgw-bucket"
+	// OrphanRGWUser is an RGW user of the driver without a BucketAccess
+	OrphanRGWUser = "rgw-user"
+	// OrphanRGWSubuser is an RGW subuser of the driver without a BucketAccess
+	OrphanRGWSubuser = "rgw-subuser"
+	// OrphanBucket is a COSI Bucket whose RGW bucket is missing
+	OrphanBucket = "bucket"
+	// OrphanBucketAccess is a BucketAccess whose RGW user or subuser is missing
+	OrphanBucketAccess = "bucketaccess"
+)
+
+// Orphan is a bucket or account which exists only in RGW or only in Kubernetes
+type Orphan struct {
+	Kind string `json:"kind"`
+	// Backend is the object store user secret of the RGW, <namespace>/<name>
+	Backend string `json:"backend"`
+	// Name is the RGW bucket name or account ID
+	Name string `json:"name"`
+	// Object is the COSI object expecting the bucket or account, empty for RGW orphans
+	Object string `json:"object,omitempty"`
+	// Fixed is set when the orphan was removed from RGW
+	Fixed bool   `json:"fixed,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditReport lists the orphans found by Audit
+type AuditReport struct {
+	Orphans []Orphan `json:"orphans"`
+}
+
+// AuditOptions holds the settings of an audit
+type AuditOptions struct {
+	// Fix removes the orphaned RGW buckets, users and subusers. Buckets holding objects are kept,
+	// orphaned COSI objects are only reported. It requires a ClusterID.
+	Fix bool
+	// MinAge skips RGW buckets created more recently, they may still be in provisioning
+	MinAge time.Duration
+	// ClusterID limits the RGW orphans to the buckets and users carrying the ownership marker of the driver
+	// and cluster, see ownershipMarker. Without it every bucket of the object store user and every user
+	// named like a COSI account is reported.
+	ClusterID string
+	// Connection configures how Kubernetes and the backends are reached
+	Connection ConnectionOptions
+}
+
+// backendInventory holds the buckets and accounts the COSI objects expect on a backend
+type backendInventory struct {
+	// buckets maps the RGW bucket names to the COSI Buckets
+	buckets map[string]string
+	// accounts maps the RGW account IDs to the BucketAccesses, <namespace>/<name>
+	accounts map[string]string
+	// protected holds the buckets and accounts of COSI objects which may live on the backend, e.g. of a
+	// BucketAccess whose class is gone. They are never reported as RGW orphans.
+	protected map[string]bool
+}
+
+// Audit compares the COSI Buckets and BucketAccesses of the driver with the buckets and users of their RGWs
+// and reports orphans in both directions
+func Audit(ctx context.Context, driverName string, options AuditOptions) (*AuditReport, error) {
+	s, err := newProvisionerServer(driverName, options.Connection)
+	if err != nil {
+		return nil, err
+	}
+	if s.BucketClientset == nil {
+		return nil, errors.New("the audit requires Kubernetes access")
+	}
+	s.ClusterID = options.ClusterID
+	return s.audit(ctx, options)
+}
+
+// audit returns the orphans of all backends referenced by the COSI objects and classes of the driver.
+// A backend failing the audit does not stop the others, the report is returned along with the errors.
+func (s *provisionerServer) audit(ctx context.Context, options AuditOptions) (*AuditReport, error) {
+	// without a cluster ID nothing tells the buckets and users of the driver from others sharing the RGW
+	if options.Fix && ownershipMarker(s.Provisioner, s.ClusterID) == "" {
+		return nil, errors.New("fixing orphans requires a cluster ID")
+	}
+	backends, err := s.inventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the objects whose backend is unknown may live on any backend
+	unresolved := backends[backendRef{}]
+	delete(backends, backendRef{})
+	report := &AuditReport{}
+	var errs []error
+	for _, backend := range slices.SortedFunc(maps.Keys(backends), func(a, b backendRef) int {
+		return strings.Compare(a.namespace+backendSeparator+a.secretName, b.namespace+backendSeparator+b.secretName)
+	}) {
+		inventory := backends[backend]
+		if unresolved != nil {
+			maps.Copy(inventory.protected, unresolved.protected)
+		}
+		orphans, err := s.auditBackend(ctx, backend, inventory, options)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to audit backend %s/%s: %w", backend.namespace, backend.secretName, err))
+			continue
+		}
+		report.Orphans = append(report.Orphans, orphans...)
+	}
+	return report, errors.Join(errs...)
+}
+
+// inventory collects the buckets and accounts expected by the COSI objects of the driver, by backend.
+// Backends of the classes of the driver are included even if no object uses them. The objects whose
+// backend cannot be found are protected under the zero backendRef.
+func (s *provisionerServer) inventory(ctx context.Context) (map[backendRef]*backendInventory, error) {
+	backends := map[backendRef]*backendInventory{}
+	inventory := func(backend backendRef) *backendInventory {
+		if _, ok := backends[backend]; !ok {
+			backends[backend] = &backendInventory{buckets: map[string]string{}, accounts: map[string]string{}, protected: map[string]bool{}}
+		}
+		return backends[backend]
+	}
+	client := s.BucketClientset.ObjectstorageV1alpha1()
+
+	bucketClasses, err := client.BucketClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bucket classes: %w", err)
+	}
+	for _, bc := range bucketClasses.Items {
+		if !strings.EqualFold(bc.DriverName, s.Provisioner) {
+			continue
+		}
+		if backend, err := backendFromParameters(bc.Parameters); err == nil {
+			inventory(backend)
+		}
+	}
+
+	buckets, err := client.Buckets().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list buckets: %w", err)
+	}
+	for _, bucket := range buckets.Items {
+		if !strings.EqualFold(bucket.Spec.DriverName, s.Provisioner) || bucket.Status.BucketID == "" {
+			continue
+		}
+		backend, bucketName, ok := decodeID(bucket.Status.BucketID)
+		if !ok {
+			if backend, err = backendFromParameters(bucket.Spec.Parameters); err != nil {
+				klog.ErrorS(err, "failed to find backend of bucket", "bucket", bucket.Name)
+				inventory(backendRef{}).protected[bucketName] = true
+				continue
+			}
+		}
+		inventory(backend).buckets[bucketName] = bucket.Name
+	}
+
+	accessClasses, err := client.BucketAccessClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bucket access classes: %w", err)
+	}
+	classes := map[string]v1alpha1.BucketAccessClass{}
+	for _, bac := range accessClasses.Items {
+		if !strings.EqualFold(bac.DriverName, s.Provisioner) {
+			continue
+		}
+		classes[bac.Name] = bac
+		if backend, err := backendFromParameters(bac.Parameters); err == nil {
+			inventory(backend)
+		}
+	}
+
+	bucketAccesses, err := client.BucketAccesses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bucket accesses: %w", err)
+	}
+	for _, ba := range bucketAccesses.Items {
+		if ba.Status.AccountID == "" {
+			continue
+		}
+		backend, accountID, decoded := decodeID(ba.Status.AccountID)
+		bac, ok := classes[ba.Spec.BucketAccessClassName]
+		if !ok {
+			// the driver of a BucketAccess whose class is gone is unknown, its account is kept but not expected
+			if !decoded {
+				backend = backendRef{}
+			}
+			inventory(backend).protected[accountID] = true
+			continue
+		}
+		if !decoded {
+			if backend, err = backendFromParameters(bac.Parameters); err != nil {
+				klog.ErrorS(err, "failed to find backend of bucket access", "namespace", ba.Namespace, "name", ba.Name)
+				inventory(backendRef{}).protected[accountID] = true
+				continue
+			}
+		}
+		inventory(backend).accounts[accountID] = ba.Namespace + "/" + ba.Name
+	}
+	return backends, nil
+}
+
+// auditBackend compares the buckets owned by the driver user and the users named by the driver with the inventory.
+// Users are recognized by the prefix of the COSI account names and of the owner users of subusers. With a cluster ID
+// only the buckets and users carrying the ownership marker are considered.
+func (s *provisionerServer) auditBackend(ctx context.Context, backend backendRef, inventory *backendInventory, options AuditOptions) ([]Orphan, error) {
+	s3Client, rgwAdminClient, err := s.Backends.initializeClients(ctx, s.Clientset, backend.parameters())
+	if err != nil {
+		return nil, err
+	}
+	backendName := backend.namespace + "/" + backend.secretName
+	var orphans []Orphan
+
+	buckets, err := s3Client.ListBuckets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list buckets: %w", err)
+	}
+	found := map[string]bool{}
+	for _, b := range buckets {
+		bucketName := aws.StringValue(b.Name)
+		found[bucketName] = true
+		if _, ok := inventory.buckets[bucketName]; ok || inventory.protected[bucketName] {
+			continue
+		}
+		if b.CreationDate != nil && time.Since(*b.CreationDate) < options.MinAge {
+			continue
+		}
+		if !s.ownsBucket(s3Client, bucketName) {
+			continue
+		}
+		orphan := Orphan{Kind: OrphanRGWBucket, Backend: backendName, Name: bucketName}
+		if options.Fix {
+			orphan.fixed(removeOrphanedBucket(s3Client, bucketName))
+		}
+		orphans = append(orphans, orphan)
+	}
+	for _, bucketName := range slices.Sorted(maps.Keys(inventory.buckets)) {
+		if !found[bucketName] {
+			orphans = append(orphans, Orphan{Kind: OrphanBucket, Backend: backendName, Name: bucketName, Object: inventory.buckets[bucketName]})
+		}
+	}
+
+	uids, err := rgwAdminClient.GetUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	marker := ownershipMarker(s.Provisioner, s.ClusterID)
+	accounts := map[string]bool{}
+	for _, uid := range slices.Sorted(slices.Values(*uids)) {
+		switch {
+		case strings.HasPrefix(uid, consts.AccountNamePrefix):
+			accounts[uid] = true
+			if _, ok := inventory.accounts[uid]; ok || inventory.protected[uid] {
+				continue
+			}
+			if owned, err := ownsUser(ctx, rgwAdminClient, uid, marker); err != nil || !owned {
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			orphan := Orphan{Kind: OrphanRGWUser, Backend: backendName, Name: uid}
+			if options.Fix {
+				orphan.fixed(rgwAdminClient.RemoveUser(ctx, rgwadmin.User{ID: uid}))
+			}
+			orphans = append(orphans, orphan)
+		case strings.HasPrefix(uid, ownerUserPrefix):
+			owner, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: uid})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get owner user %q: %w", uid, err)
+			}
+			// users sharing the prefix, e.g. the driver user cosi-admin, are not owner users
+			if len(owner.Caps) > 0 {
+				continue
+			}
+			owned := marker == "" || hasOwnershipMarker(owner, marker)
+			for _, su := range owner.Subusers {
+				if !strings.HasPrefix(su.Name, uid+subuserSeparator) {
+					continue
+				}
+				accounts[su.Name] = true
+				if _, ok := inventory.accounts[su.Name]; ok || inventory.protected[su.Name] || !owned {
+					continue
+				}
+				orphan := Orphan{Kind: OrphanRGWSubuser, Backend: backendName, Name: su.Name}
+				if options.Fix {
+					purgeKeys := true
+					orphan.fixed(rgwAdminClient.RemoveSubuser(ctx, rgwadmin.User{ID: uid}, rgwadmin.SubuserSpec{Name: su.Name, PurgeKeys: &purgeKeys}))
+				}
+				orphans = append(orphans, orphan)
+			}
+		}
+	}
+	for _, accountID := range slices.Sorted(maps.Keys(inventory.accounts)) {
+		if !accounts[accountID] {
+			orphans = append(orphans, Orphan{Kind: OrphanBucketAccess, Backend: backendName, Name: accountID, Object: inventory.accounts[accountID]})
+		}
+	}
+	return orphans, nil
+}
+
+// ownsBucket tells if a bucket of the driver user carries the ownership marker of the driver and cluster.
+// Without a cluster ID every bucket of the driver user is considered.
+func (s *provisionerServer) ownsBucket(s3Client *s3client.S3Agent, bucketName string) bool {
+	marker := ownershipMarker(s.Provisioner, s.ClusterID)
+	if marker == "" {
+		return true
+	}
+	tags, err := s3Client.GetBucketTagging(bucketName)
+	if err != nil {
+		klog.ErrorS(err, "failed to get bucket tags", "bucketName", bucketName)
+		return false
+	}
+	return tags[ManagedByTag] == marker
+}
+
+// ownsUser tells if the user carries the ownership marker, every user is considered without a marker
+func ownsUser(ctx context.Context, rgwAdminClient *rgwadmin.API, uid, marker string) (bool, error) {
+	if marker == "" {
+		return true, nil
+	}
+	user, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: uid})
+	if rgwerr.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get user %q: %w", uid, err)
+	}
+	return hasOwnershipMarker(user, marker), nil
+}
+
+// removeOrphanedBucket deletes an empty orphaned bucket along with its notification topics
+func removeOrphanedBucket(s3Client *s3client.S3Agent, bucketName string) error {
+	topics, err := driverTopics(s3Client, bucketName)
+	if err != nil && !rgwerr.HasCode(err, rgwerr.NoSuchBucket) {
+		return err
+	}
+	if _, err := s3Client.DeleteBucket(bucketName); err != nil && !rgwerr.HasCode(err, rgwerr.NoSuchBucket) {
+		return err
+	}
+	forgetBucketSync(bucketName)
+	return deleteTopics(s3Client, bucketName, topics)
+}
+
+// fixed records the outcome of removing the orphan
+func (o *Orphan) fixed(err error) {
+	if err != nil {
+		klog.ErrorS(err, "failed to remove orphan", "kind", o.Kind, "name", o.Name)
+		o.Error = err.Error()
+		return
+	}
+	klog.InfoS("Removed orphan", "kind", o.Kind, "backend", o.Backend, "name", o.Name)
+	o.Fixed = true
+}
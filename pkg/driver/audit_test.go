@@ -0,0 +1,185 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/fakergw"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_provisionerServer_audit_FakeRGW(t *testing.T) {
+	backend := backendRef{namespace: "test-namespace", secretName: "test-user-secret"}
+	srv, s := newFakeRGWServer(t,
+		&v1alpha1.BucketClass{ObjectMeta: metav1.ObjectMeta{Name: "test-class"}, DriverName: "ceph.objectstorage.k8s.io", Parameters: createParameters()},
+		&v1alpha1.Bucket{
+			ObjectMeta: metav1.ObjectMeta{Name: "kept"},
+			Spec:       v1alpha1.BucketSpec{DriverName: "ceph.objectstorage.k8s.io"},
+			Status:     v1alpha1.BucketStatus{BucketReady: true, BucketID: backend.encode("kept-bucket")},
+		},
+		&v1alpha1.Bucket{
+			ObjectMeta: metav1.ObjectMeta{Name: "missing"},
+			Spec:       v1alpha1.BucketSpec{DriverName: "ceph.objectstorage.k8s.io"},
+			Status:     v1alpha1.BucketStatus{BucketReady: true, BucketID: backend.encode("missing-bucket")},
+		},
+		&v1alpha1.Bucket{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-driver"},
+			Spec:       v1alpha1.BucketSpec{DriverName: "other.objectstorage.k8s.io"},
+			Status:     v1alpha1.BucketStatus{BucketReady: true, BucketID: backend.encode("other-bucket")},
+		},
+		&v1alpha1.BucketAccessClass{ObjectMeta: metav1.ObjectMeta{Name: "test-access-class"}, DriverName: "ceph.objectstorage.k8s.io", Parameters: createParameters()},
+		&v1alpha1.BucketAccess{
+			ObjectMeta: metav1.ObjectMeta{Name: "kept", Namespace: "apps"},
+			Spec:       v1alpha1.BucketAccessSpec{BucketAccessClassName: "test-access-class"},
+			Status:     v1alpha1.BucketAccessStatus{AccessGranted: true, AccountID: backend.encode("ba-kept")},
+		},
+		&v1alpha1.BucketAccess{
+			ObjectMeta: metav1.ObjectMeta{Name: "missing", Namespace: "apps"},
+			Spec:       v1alpha1.BucketAccessSpec{BucketAccessClassName: "test-access-class"},
+			Status:     v1alpha1.BucketAccessStatus{AccessGranted: true, AccountID: backend.encode("ba-missing")},
+		},
+		&v1alpha1.BucketAccess{
+			ObjectMeta: metav1.ObjectMeta{Name: "classless", Namespace: "apps"},
+			Spec:       v1alpha1.BucketAccessSpec{BucketAccessClassName: "deleted-class"},
+			Status:     v1alpha1.BucketAccessStatus{AccessGranted: true, AccountID: backend.encode("ba-classless")},
+		},
+		// the BucketAccess of the leaked subuser, only its UID is needed to create the subuser
+		&v1alpha1.BucketAccess{
+			ObjectMeta: metav1.ObjectMeta{Name: "leaked", Namespace: "apps", UID: "5555"},
+			Spec:       v1alpha1.BucketAccessSpec{BucketAccessClassName: "test-access-class"},
+		},
+	)
+	ctx := context.Background()
+	s.ClusterID = "cluster-1"
+
+	for _, name := range []string{"kept-bucket", "leaked-bucket", "full-bucket"} {
+		if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: name, Parameters: createParameters()}); err != nil {
+			t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+		}
+	}
+	if err := srv.PutObject("full-bucket", "key", []byte("data")); err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+	for _, name := range []string{"ba-kept", "ba-leaked", "ba-classless"} {
+		if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("kept-bucket"), Name: name, Parameters: createParameters()}); err != nil {
+			t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+		}
+	}
+	subuserParameters := createParameters()
+	subuserParameters[accessModeParameter] = accessModeSubuser
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("kept-bucket"), Name: "ba-5555", Parameters: subuserParameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+
+	// buckets and users of another cluster sharing the RGW, and of the object store user itself
+	s.ClusterID = "cluster-2"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "foreign-bucket", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("foreign-bucket"), Name: "ba-foreign", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+	s.ClusterID = "cluster-1"
+	s3Client, rgwAdminClient, err := s.Backends.initializeClients(ctx, s.Clientset, createParameters())
+	if err != nil {
+		t.Fatalf("failed to initialize clients: %v", err)
+	}
+	if err := s3Client.CreateBucket("manual-bucket"); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	if err := rgwAdminClient.CreateSubuser(ctx, rgwadmin.User{ID: fakergw.AdminUser}, rgwadmin.SubuserSpec{Name: "tool"}); err != nil {
+		t.Fatalf("failed to create subuser: %v", err)
+	}
+
+	report, err := s.audit(ctx, AuditOptions{})
+	if err != nil {
+		t.Fatalf("provisionerServer.audit() error = %v", err)
+	}
+	backendName := "test-namespace/test-user-secret"
+	want := []Orphan{
+		{Kind: OrphanRGWBucket, Backend: backendName, Name: "full-bucket"},
+		{Kind: OrphanRGWBucket, Backend: backendName, Name: "leaked-bucket"},
+		{Kind: OrphanBucket, Backend: backendName, Name: "missing-bucket", Object: "missing"},
+		{Kind: OrphanRGWUser, Backend: backendName, Name: "ba-leaked"},
+		{Kind: OrphanRGWSubuser, Backend: backendName, Name: "cosi-apps:ba-5555"},
+		{Kind: OrphanBucketAccess, Backend: backendName, Name: "ba-missing", Object: "apps/missing"},
+	}
+	if !reflect.DeepEqual(report.Orphans, want) {
+		t.Errorf("provisionerServer.audit() = %+v, want %+v", report.Orphans, want)
+	}
+	if _, ok := srv.Bucket("leaked-bucket"); !ok {
+		t.Errorf("leaked-bucket removed without fix")
+	}
+
+	// without a cluster ID the orphans are only reported
+	s.ClusterID = ""
+	if _, err := s.audit(ctx, AuditOptions{Fix: true}); err == nil {
+		t.Fatalf("provisionerServer.audit() with fix and no cluster ID error = nil, want an error")
+	}
+	report, err = s.audit(ctx, AuditOptions{})
+	if err != nil {
+		t.Fatalf("provisionerServer.audit() error = %v", err)
+	}
+	reported := map[string]bool{}
+	for _, o := range report.Orphans {
+		reported[o.Name] = true
+	}
+	if !reported["foreign-bucket"] || !reported["manual-bucket"] || !reported["ba-foreign"] || reported["ba-classless"] || reported["cosi-admin:tool"] {
+		t.Errorf("provisionerServer.audit() without cluster ID = %+v, want unmarked buckets and users but no classless or admin accounts", report.Orphans)
+	}
+
+	s.ClusterID = "cluster-1"
+	report, err = s.audit(ctx, AuditOptions{Fix: true})
+	if err != nil {
+		t.Fatalf("provisionerServer.audit() with fix error = %v", err)
+	}
+	fixed := map[string]bool{}
+	for _, o := range report.Orphans {
+		fixed[o.Name] = o.Fixed
+	}
+	if !fixed["leaked-bucket"] || !fixed["ba-leaked"] || !fixed["cosi-apps:ba-5555"] || fixed["full-bucket"] || fixed["missing-bucket"] {
+		t.Errorf("provisionerServer.audit() with fix = %+v, want leaked bucket, user and subuser fixed", report.Orphans)
+	}
+	for _, name := range []string{"kept-bucket", "full-bucket", "foreign-bucket", "manual-bucket"} {
+		if _, ok := srv.Bucket(name); !ok {
+			t.Errorf("%s removed", name)
+		}
+	}
+	if _, ok := srv.Bucket("leaked-bucket"); ok {
+		t.Errorf("leaked-bucket not removed")
+	}
+	for _, uid := range []string{"ba-kept", "ba-classless", "ba-foreign"} {
+		if _, ok := srv.User(uid); !ok {
+			t.Errorf("%s removed", uid)
+		}
+	}
+	if _, ok := srv.User("ba-leaked"); ok {
+		t.Errorf("ba-leaked not removed")
+	}
+	if owner, _ := srv.User("cosi-apps"); len(owner.Subusers) != 0 {
+		t.Errorf("subusers of cosi-apps = %+v, want none", owner.Subusers)
+	}
+	if admin, _ := srv.User(fakergw.AdminUser); len(admin.Subusers) != 1 {
+		t.Errorf("subusers of %s = %+v, want the tool subuser kept", fakergw.AdminUser, admin.Subusers)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	objectStoreUserSecretNameParameter      = "objectStoreUserSecretName"
+	objectStoreUserSecretNamespaceParameter = "objectStoreUserSecretNamespace"
+
+	// backendSeparator separates the backend from the RGW ID in bucket and account IDs,
+	// neither namespaces, secret names, bucket names nor user IDs contain it
+	backendSeparator = "/"
+)
+
+// backendRef identifies the RGW a bucket or account lives on by its object store user secret
+type backendRef struct {
+	namespace  string
+	secretName string
+}
+
+// backendFromParameters reads the backend from the BucketClass or BucketAccessClass parameters
+func backendFromParameters(parameters map[string]string) (backendRef, error) {
+	secretName, namespace, err := fetchSecretNameAndNamespace(parameters)
+	if err != nil {
+		return backendRef{}, err
+	}
+	return backendRef{namespace: namespace, secretName: secretName}, nil
+}
+
+// parameters returns the parameters selecting the backend, as expected by InitializeClients
+func (b backendRef) parameters() map[string]string {
+	return map[string]string{
+		objectStoreUserSecretNameParameter:      b.secretName,
+		objectStoreUserSecretNamespaceParameter: b.namespace,
+	}
+}
+
+// encode prefixes an RGW ID with the backend, in the form <namespace>/<secret name>/<id>
+func (b backendRef) encode(id string) string {
+	return strings.Join([]string{b.namespace, b.secretName, id}, backendSeparator)
+}
+
+// decodeID splits a bucket or account ID returned to the sidecar into the backend and the RGW ID.
+// IDs returned by older driver versions carry no backend, they are returned unchanged with ok set to false.
+func decodeID(id string) (backendRef, string, bool) {
+	parts := strings.SplitN(id, backendSeparator, 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return backendRef{}, id, false
+	}
+	return backendRef{namespace: parts[0], secretName: parts[1]}, parts[2], true
+}
+
+// resolveBucket returns the backend parameters and the RGW bucket name of a bucket ID.
+// Bucket IDs without a backend fall back to the parameters of the Bucket object named like the ID.
+func (s *provisionerServer) resolveBucket(ctx context.Context, bucketID string) (map[string]string, string, error) {
+	if backend, bucketName, ok := decodeID(bucketID); ok {
+		return backend.parameters(), bucketName, nil
+	}
+	if s.BucketClientset == nil {
+		return nil, "", kubernetesRequired(fmt.Sprintf("bucket id %q without a backend", bucketID))
+	}
+	bucket, err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Get(ctx, bucketID, metav1.GetOptions{})
+	if err != nil {
+		klog.ErrorS(err, "failed to get bucket", "bucketName", bucketID)
+		return nil, "", status.Error(codes.Internal, "failed to get bucket")
+	}
+	return bucket.Spec.Parameters, bucketID, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	cosiapi "sigs.k8s.io/container-object-storage-interface/client/apis"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+)
+
+// bucketNamePublisher periodically publishes the RGW bucket name in the credentials secrets of the BucketAccesses.
+// The sidecar writes the name of the COSI Bucket into the BucketInfo of the secret, which is not the name of the RGW
+// bucket when the BucketClass has a bucketNameTemplate.
+type bucketNamePublisher struct {
+	server   *provisionerServer
+	interval time.Duration
+}
+
+func newBucketNamePublisher(server *provisionerServer, interval time.Duration) *bucketNamePublisher {
+	return &bucketNamePublisher{server: server, interval: interval}
+}
+
+// Run publishes the bucket names every interval until the context is cancelled
+func (p *bucketNamePublisher) Run(ctx context.Context) {
+	klog.InfoS("Starting bucket name publishing", "interval", p.interval)
+	wait.UntilWithContext(ctx, p.publishAll, p.interval)
+}
+
+func (p *bucketNamePublisher) publishAll(ctx context.Context) {
+	bucketAccesses, err := p.server.BucketClientset.ObjectstorageV1alpha1().BucketAccesses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.ErrorS(err, "failed to list bucket accesses")
+		return
+	}
+	for i := range bucketAccesses.Items {
+		ba := &bucketAccesses.Items[i]
+		if err := p.publish(ctx, ba); err != nil {
+			klog.ErrorS(err, "failed to publish bucket name", "namespace", ba.Namespace, "bucketAccess", ba.Name)
+		}
+	}
+}
+
+// publish sets the name of the RGW bucket in the BucketInfo of the credentials secret of the BucketAccess
+func (p *bucketNamePublisher) publish(ctx context.Context, ba *v1alpha1.BucketAccess) error {
+	if !ba.Status.AccessGranted || ba.Spec.CredentialsSecretName == "" || !ba.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	client := p.server.BucketClientset.ObjectstorageV1alpha1()
+	bac, err := client.BucketAccessClasses().Get(ctx, ba.Spec.BucketAccessClassName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get bucket access class: %w", err)
+	}
+	if !strings.EqualFold(bac.DriverName, p.server.Provisioner) {
+		return nil
+	}
+	claim, err := client.BucketClaims(ba.Namespace).Get(ctx, ba.Spec.BucketClaimName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get bucket claim: %w", err)
+	}
+	bucket, err := client.Buckets().Get(ctx, claim.Status.BucketName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get bucket: %w", err)
+	}
+	_, bucketName, _ := decodeID(bucket.Status.BucketID)
+	if bucketName == "" || bucketName == bucket.Name {
+		return nil
+	}
+
+	secret, err := p.server.Clientset.CoreV1().Secrets(ba.Namespace).Get(ctx, ba.Spec.CredentialsSecretName, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		// the sidecar creates the secret after the access was granted
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get credentials secret: %w", err)
+	}
+	bucketInfo := cosiapi.BucketInfo{}
+	if err := json.Unmarshal(secret.Data[bucketInfoSecretKey], &bucketInfo); err != nil {
+		return fmt.Errorf("failed to parse bucket info from credentials secret: %w", err)
+	}
+	if bucketInfo.Spec.BucketName == bucketName {
+		return nil
+	}
+	bucketInfo.Spec.BucketName = bucketName
+	data, err := json.Marshal(bucketInfo)
+	if err != nil {
+		return fmt.Errorf("failed to serialize bucket info: %w", err)
+	}
+	secret.Data[bucketInfoSecretKey] = data
+	if _, err := p.server.Clientset.CoreV1().Secrets(ba.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update credentials secret: %w", err)
+	}
+	klog.InfoS("Published bucket name", "namespace", ba.Namespace, "bucketAccess", ba.Name, "bucket", bucket.Name, "bucketName", bucketName)
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	s3cli "github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	cosiapi "sigs.k8s.io/container-object-storage-interface/client/apis"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	fakebucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned/fake"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_bucketNamePublisher_FakeRGW(t *testing.T) {
+	bucket := &v1alpha1.Bucket{
+		ObjectMeta: metav1.ObjectMeta{Name: "bucketclass-0a1b2c3d"},
+		Spec: v1alpha1.BucketSpec{
+			DriverName:  "ceph.objectstorage.k8s.io",
+			BucketClaim: &corev1.ObjectReference{Namespace: "apps", Name: "claim"},
+		},
+	}
+	ba := &v1alpha1.BucketAccess{
+		ObjectMeta: metav1.ObjectMeta{Name: "access", Namespace: "apps", UID: "1234"},
+		Spec: v1alpha1.BucketAccessSpec{
+			BucketAccessClassName: "test-access-class",
+			BucketClaimName:       "claim",
+			CredentialsSecretName: "credentials",
+		},
+	}
+	srv, s := newFakeRGWServer(t,
+		&v1alpha1.BucketAccessClass{ObjectMeta: metav1.ObjectMeta{Name: "test-access-class"}, DriverName: "ceph.objectstorage.k8s.io", Parameters: createParameters()},
+		&v1alpha1.BucketClaim{ObjectMeta: metav1.ObjectMeta{Name: "claim", Namespace: "apps"}, Status: v1alpha1.BucketClaimStatus{BucketName: bucket.Name, BucketReady: true}},
+		bucket,
+	)
+	ctx := context.Background()
+	parameters := createParameters()
+	parameters[bucketNameTemplateParameter] = "{{.Namespace}}-{{.ClaimName}}-{{.Hash}}"
+	created, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: bucket.Name, Parameters: parameters})
+	if err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	granted, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: created.BucketId, Name: "ba-1234", Parameters: createParameters()})
+	if err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+
+	// the sidecar records the bucket ID and publishes the credentials under the name of the Bucket object
+	bucket.Status = v1alpha1.BucketStatus{BucketReady: true, BucketID: created.BucketId}
+	if _, err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Update(ctx, bucket, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update bucket: %v", err)
+	}
+	ba.Status = v1alpha1.BucketAccessStatus{AccessGranted: true, AccountID: granted.AccountId}
+	if _, err := s.BucketClientset.ObjectstorageV1alpha1().BucketAccesses("apps").Create(ctx, ba, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create bucket access: %v", err)
+	}
+	credentials := granted.Credentials["s3"].Secrets
+	bucketInfo, err := json.Marshal(cosiapi.BucketInfo{Spec: cosiapi.BucketInfoSpec{
+		BucketName: bucket.Name,
+		S3: &cosiapi.SecretS3{
+			Endpoint:        credentials["endpoint"],
+			AccessKeyID:     credentials["accessKeyID"],
+			AccessSecretKey: credentials["accessSecretKey"],
+		},
+	}})
+	if err != nil {
+		t.Fatalf("failed to marshal bucket info: %v", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "apps"},
+		Data:       map[string][]byte{bucketInfoSecretKey: bucketInfo},
+	}
+	if _, err := s.Clientset.CoreV1().Secrets("apps").Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create credentials secret: %v", err)
+	}
+
+	newBucketNamePublisher(s, 0).publishAll(ctx)
+
+	// a workload reading the credentials secret reaches the bucket
+	got, err := s.Clientset.CoreV1().Secrets("apps").Get(ctx, "credentials", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get credentials secret: %v", err)
+	}
+	info := cosiapi.BucketInfo{}
+	if err := json.Unmarshal(got.Data[bucketInfoSecretKey], &info); err != nil {
+		t.Fatalf("failed to unmarshal bucket info: %v", err)
+	}
+	want := "apps-claim-" + bucketNameHash(bucket.Name)
+	if info.Spec.BucketName != want {
+		t.Fatalf("published bucket name = %q, want %q", info.Spec.BucketName, want)
+	}
+	workload, err := s3cli.NewS3Agent(info.Spec.S3.AccessKeyID, info.Spec.S3.AccessSecretKey, info.Spec.S3.Endpoint, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create s3 client: %v", err)
+	}
+	if _, err := workload.PutObjectInBucket(info.Spec.BucketName, "data", "key", "text/plain"); err != nil {
+		t.Errorf("workload failed to write to the published bucket: %v", err)
+	}
+	if _, ok := srv.Bucket(want); !ok {
+		t.Errorf("bucket %q not found", want)
+	}
+	expectAllowedByRBAC(t, s.Clientset.(*fakekubeclientset.Clientset).Actions(), s.BucketClientset.(*fakebucketclientset.Clientset).Actions())
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// bucketMaxSizeParameter limits the size of the bucket's data, e.g. "10Gi"
+	bucketMaxSizeParameter = "bucketMaxSize"
+	// bucketMaxObjectsParameter limits the number of objects in the bucket
+	bucketMaxObjectsParameter = "bucketMaxObjects"
+	// bucketNameTemplateParameter is a text/template rendering the RGW bucket name, see bucketNameData
+	bucketNameTemplateParameter = "bucketNameTemplate"
+	// bucketIndexShardsParameter selects the index sharding of the bucket, only dynamic resharding is supported
+	bucketIndexShardsParameter = "bucketIndexShards"
+	// dynamicIndexShards leaves the shard count of the bucket index to the dynamic resharding of RGW
+	dynamicIndexShards = "dynamic"
+	// maxBucketIndexShards is the largest shard count RGW accepts
+	maxBucketIndexShards = 65521
+
+	// maxBucketNameLength and minBucketNameLength are the S3 limits of bucket names
+	maxBucketNameLength = 63
+	minBucketNameLength = 3
+	// bucketNameHashLength is the number of hex digits of the hash in generated bucket names
+	bucketNameHashLength = 8
+)
+
+var (
+	invalidBucketNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+	repeatedSeparators     = regexp.MustCompile(`-{2,}|\.{2,}|-\.|\.-`)
+)
+
+// bucketNameData are the fields available in the bucket name template
+type bucketNameData struct {
+	// Name is the name of the Bucket object generated by COSI
+	Name string
+	// Namespace is the namespace of the BucketClaim
+	Namespace string
+	// ClaimName is the name of the BucketClaim
+	ClaimName string
+	// Hash is a short hash of the Bucket object name, unique per bucket
+	Hash string
+}
+
+// bucketConfig is the configuration of a bucket requested by the BucketClass parameters
+type bucketConfig struct {
+	quota     *rgwadmin.QuotaSpec
+	rateLimit *adminops.RateLimit
+}
+
+// parseBucketConfig reads the bucket configuration from the BucketClass parameters
+func parseBucketConfig(parameters map[string]string) (bucketConfig, error) {
+	config := bucketConfig{}
+	maxSize, hasMaxSize := parameters[bucketMaxSizeParameter]
+	maxObjects, hasMaxObjects := parameters[bucketMaxObjectsParameter]
+	if hasMaxSize || hasMaxObjects {
+		enabled := true
+		unlimited := int64(-1)
+		quota := &rgwadmin.QuotaSpec{Enabled: &enabled, MaxSize: &unlimited, MaxObjects: &unlimited}
+		if hasMaxSize {
+			q, err := resource.ParseQuantity(maxSize)
+			if err != nil || q.Sign() < 0 {
+				return bucketConfig{}, status.Errorf(codes.InvalidArgument, "invalid %s %q", bucketMaxSizeParameter, maxSize)
+			}
+			size := q.Value()
+			quota.MaxSize = &size
+		}
+		if hasMaxObjects {
+			objects, err := strconv.ParseInt(maxObjects, 10, 64)
+			if err != nil || objects < 0 {
+				return bucketConfig{}, status.Errorf(codes.InvalidArgument, "invalid %s %q", bucketMaxObjectsParameter, maxObjects)
+			}
+			quota.MaxObjects = &objects
+		}
+		config.quota = quota
+	}
+	rateLimit, err := parseRateLimit(parameters, bucketRateLimitParameters)
+	if err != nil {
+		return bucketConfig{}, err
+	}
+	config.rateLimit = rateLimit
+	if err := validateIndexShards(parameters); err != nil {
+		return bucketConfig{}, err
+	}
+	return config, nil
+}
+
+// validateIndexShards rejects the index shard counts the driver cannot apply. Neither the S3 nor the admin ops API
+// set the shard count of a bucket or reshard it, so only the dynamic resharding RGW does by default is accepted,
+// instead of ignoring the requested count.
+func validateIndexShards(parameters map[string]string) error {
+	shards, ok := parameters[bucketIndexShardsParameter]
+	if !ok || shards == dynamicIndexShards {
+		return nil
+	}
+	count, err := strconv.Atoi(shards)
+	if err != nil || count < 1 || count > maxBucketIndexShards {
+		return status.Errorf(codes.InvalidArgument, "invalid %s %q, expected %q or a shard count between 1 and %d",
+			bucketIndexShardsParameter, shards, dynamicIndexShards, maxBucketIndexShards)
+	}
+	return status.Errorf(codes.InvalidArgument, "unsupported %s %d, RGW does not set the shard count of a bucket through "+
+		"its APIs, set rgw_override_bucket_index_max_shards instead or use %q", bucketIndexShardsParameter, count, dynamicIndexShards)
+}
+
+// applyBucketConfig sets the configuration on a bucket created by the driver
+func applyBucketConfig(ctx context.Context, rgwAdminClient *rgwadmin.API, bucketName string, config bucketConfig) error {
+	if config.quota != nil {
+		info, err := rgwAdminClient.GetBucketInfo(ctx, rgwadmin.Bucket{Bucket: bucketName})
+		if err != nil {
+			return fmt.Errorf("failed to get bucket info of %q: %w", bucketName, err)
+		}
+		quota := *config.quota
+		quota.UID = info.Owner
+		quota.Bucket = bucketName
+		if err := rgwAdminClient.SetIndividualBucketQuota(ctx, quota); err != nil {
+			return fmt.Errorf("failed to set quota of bucket %q: %w", bucketName, err)
+		}
+	}
+	if config.rateLimit != nil {
+		if err := adminops.SetBucketRateLimit(ctx, rgwAdminClient, bucketName, *config.rateLimit); err != nil {
+			return fmt.Errorf("failed to set rate limit of bucket %q: %w", bucketName, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the existing bucket has the requested configuration
+func (c bucketConfig) matches(info rgwadmin.Bucket) bool {
+	if c.quota == nil {
+		return info.BucketQuota.Enabled == nil || !*info.BucketQuota.Enabled
+	}
+	return quotaEqual(info.BucketQuota, *c.quota)
+}
+
+// bucketQuotaConfig and bucketRateLimitConfig name the settings returned by bucketConfigChanges
+const (
+	bucketQuotaConfig     = "bucketQuota"
+	bucketRateLimitConfig = "bucketRateLimit"
+)
+
+// checkExistingBucket decides whether a create request for an existing bucket succeeds.
+// The bucket is only reused if the driver's user owns it, otherwise codes.AlreadyExists is returned.
+func checkExistingBucket(ctx context.Context, rgwAdminClient *rgwadmin.API, bucketName string) (rgwadmin.Bucket, error) {
+	info, err := rgwAdminClient.GetBucketInfo(ctx, rgwadmin.Bucket{Bucket: bucketName})
+	if err != nil {
+		return rgwadmin.Bucket{}, rgwerr.Status(err, "failed to get bucket info")
+	}
+	driverUser, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{Keys: []rgwadmin.UserKeySpec{{AccessKey: rgwAdminClient.AccessKey}}})
+	if err != nil {
+		return rgwadmin.Bucket{}, rgwerr.Status(err, "failed to get driver user")
+	}
+	if info.Owner != driverUser.ID {
+		return rgwadmin.Bucket{}, status.Errorf(codes.AlreadyExists, "bucket %q is owned by another user", bucketName)
+	}
+	return info, nil
+}
+
+// adoptExistingBucket decides whether the create request of the Bucket object name may configure the existing bucket
+// of the driver. Only a bucket tagged with the same Bucket name, e.g. left half-created by an earlier attempt of the
+// request, is reconfigured. A bucket of another Bucket fails with codes.AlreadyExists, as does an untagged bucket whose
+// configuration differs from the request.
+func adoptExistingBucket(ctx context.Context, s3Client *s3client.S3Agent, rgwAdminClient *rgwadmin.API, info rgwadmin.Bucket,
+	name string, config bucketConfig) error {
+	tags, err := s3Client.GetBucketTagging(info.Bucket)
+	if err != nil {
+		return rgwerr.Status(err, "failed to get bucket tags")
+	}
+	switch owner := tags[BucketTag]; {
+	case owner == name:
+		return nil
+	case owner != "":
+		return status.Errorf(codes.AlreadyExists, "bucket %q was created for bucket %q", info.Bucket, owner)
+	}
+	changes, err := bucketConfigChanges(ctx, rgwAdminClient, info, config)
+	if err != nil {
+		return rgwerr.Status(err, "failed to compare bucket configuration")
+	}
+	if len(changes) > 0 {
+		return status.Errorf(codes.AlreadyExists, "bucket %q already exists with different parameters %v", info.Bucket, changes)
+	}
+	return nil
+}
+
+// bucketConfigChanges returns the settings of the existing bucket which differ from the configuration
+func bucketConfigChanges(ctx context.Context, rgwAdminClient *rgwadmin.API, info rgwadmin.Bucket, config bucketConfig) ([]string, error) {
+	var changes []string
+	if !config.matches(info) {
+		changes = append(changes, bucketQuotaConfig)
+	}
+	// the rate limit is only compared if requested, RGW versions without rate limits reject the request
+	if config.rateLimit != nil {
+		rateLimit, err := adminops.GetBucketRateLimit(ctx, rgwAdminClient, info.Bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get rate limit of bucket %q: %w", info.Bucket, err)
+		}
+		if rateLimit != *config.rateLimit {
+			changes = append(changes, bucketRateLimitConfig)
+		}
+	}
+	return changes, nil
+}
+
+// reconcileBucketConfig applies the configuration to an existing bucket of the driver, when a create request is
+// retried after configuring the new bucket failed, see adoptExistingBucket. Only changed settings are written.
+func reconcileBucketConfig(ctx context.Context, rgwAdminClient *rgwadmin.API, info rgwadmin.Bucket, config bucketConfig) error {
+	changes, err := bucketConfigChanges(ctx, rgwAdminClient, info, config)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		switch change {
+		case bucketQuotaConfig:
+			disabled := false
+			quota := rgwadmin.QuotaSpec{Enabled: &disabled}
+			if config.quota != nil {
+				quota = *config.quota
+			}
+			quota.UID = info.Owner
+			quota.Bucket = info.Bucket
+			if err := rgwAdminClient.SetIndividualBucketQuota(ctx, quota); err != nil {
+				return fmt.Errorf("failed to set quota of bucket %q: %w", info.Bucket, err)
+			}
+		case bucketRateLimitConfig:
+			if err := adminops.SetBucketRateLimit(ctx, rgwAdminClient, info.Bucket, *config.rateLimit); err != nil {
+				return fmt.Errorf("failed to set rate limit of bucket %q: %w", info.Bucket, err)
+			}
+		}
+	}
+	return nil
+}
+
+// backendBucketName returns the name of the RGW bucket for the Bucket object.
+// Without a template the name generated by COSI is used as is.
+func (s *provisionerServer) backendBucketName(ctx context.Context, name string, parameters map[string]string) (string, error) {
+	tmplText, ok := parameters[bucketNameTemplateParameter]
+	if !ok {
+		return name, nil
+	}
+	tmpl, err := template.New("bucketName").Option("missingkey=error").Parse(tmplText)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid %s: %v", bucketNameTemplateParameter, err)
+	}
+
+	if s.BucketClientset == nil {
+		return "", kubernetesRequired(bucketNameTemplateParameter)
+	}
+	data := bucketNameData{Name: name, Hash: bucketNameHash(name)}
+	bucket, err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to get bucket %q: %v", name, err)
+	}
+	if claim := bucket.Spec.BucketClaim; claim != nil {
+		data.Namespace = claim.Namespace
+		data.ClaimName = claim.Name
+	}
+
+	rendered := &bytes.Buffer{}
+	if err := tmpl.Execute(rendered, data); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid %s: %v", bucketNameTemplateParameter, err)
+	}
+	// the name must differ between Buckets, otherwise two Buckets of a claim recreated with the same name or of
+	// claims with the same name in the same namespace would share the RGW bucket
+	other := data
+	other.Name, other.Hash = name+"-other", bucketNameHash(name+"-other")
+	probe := &bytes.Buffer{}
+	if err := tmpl.Execute(probe, other); err != nil || probe.String() == rendered.String() {
+		return "", status.Errorf(codes.InvalidArgument, "%s must contain {{.Hash}} or {{.Name}}, so that every Bucket gets its own bucket name", bucketNameTemplateParameter)
+	}
+	bucketName := sanitizeBucketName(rendered.String(), data.Hash)
+	if err := validateBucketName(bucketName); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "%s renders invalid bucket name %q: %v", bucketNameTemplateParameter, bucketName, err)
+	}
+	return bucketName, nil
+}
+
+// bucketNameHash returns a short hash of the Bucket object name, which COSI makes unique with a UID
+func bucketNameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:bucketNameHashLength]
+}
+
+// sanitizeBucketName turns a rendered name into a DNS compatible bucket name.
+// Names exceeding the length limit are truncated and suffixed with the hash to stay unique.
+func sanitizeBucketName(name, hash string) string {
+	name = strings.ToLower(name)
+	name = invalidBucketNameChars.ReplaceAllString(name, "-")
+	for repeatedSeparators.MatchString(name) {
+		name = repeatedSeparators.ReplaceAllString(name, "-")
+	}
+	name = strings.Trim(name, ".-")
+	if len(name) > maxBucketNameLength {
+		name = strings.TrimRight(name[:maxBucketNameLength-len(hash)-1], ".-") + "-" + hash
+	}
+	return name
+}
+
+// validateBucketName checks the S3 bucket naming rules for DNS compatible names
+func validateBucketName(name string) error {
+	switch {
+	case len(name) < minBucketNameLength || len(name) > maxBucketNameLength:
+		return fmt.Errorf("length must be between %d and %d", minBucketNameLength, maxBucketNameLength)
+	case invalidBucketNameChars.MatchString(name):
+		return fmt.Errorf("only lowercase letters, digits, dots and hyphens are allowed")
+	case strings.Trim(name, ".-") != name:
+		return fmt.Errorf("must start and end with a letter or digit")
+	case repeatedSeparators.MatchString(name):
+		return fmt.Errorf("must not contain adjacent dots or hyphens next to dots")
+	case net.ParseIP(name) != nil:
+		return fmt.Errorf("must not be formatted as an IP address")
+	case strings.HasPrefix(name, "xn--") || strings.HasSuffix(name, "-s3alias"):
+		return fmt.Errorf("reserved prefix or suffix")
+	}
+	return nil
+}
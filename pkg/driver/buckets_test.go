@@ -0,0 +1,213 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	fakebucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned/fake"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_provisionerServer_backendBucketName(t *testing.T) {
+	const name = "bucketclass-0a1b2c3d-4e5f"
+	hash := bucketNameHash(name)
+	bucket := &v1alpha1.Bucket{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1alpha1.BucketSpec{
+			BucketClaim: &corev1.ObjectReference{Namespace: "Team_A", Name: "my.claim"},
+		},
+	}
+	s := &provisionerServer{BucketClientset: fakebucketclientset.NewSimpleClientset(bucket)}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{"No template", "", name, false},
+		{"Prefix, namespace, claim and hash", "prod-{{.Namespace}}-{{.ClaimName}}-{{.Hash}}", "prod-team-a-my.claim-" + hash, false},
+		{"Name", "prod-{{.Name}}", "prod-" + name, false},
+		{"Truncated", strings.Repeat("a", 70) + "{{.Hash}}", strings.Repeat("a", 54) + "-" + hash, false},
+		{"Separators collapsed", "a.-.b--c-{{.Hash}}", "a-b-c-" + hash, false},
+		{"Without hash or name", "prod-{{.Namespace}}-{{.ClaimName}}", "", true},
+		{"Static", "data", "", true},
+		{"Reserved suffix", "{{.Hash}}-s3alias", "", true},
+		{"Unknown field", "{{.Cluster}}", "", true},
+		{"Invalid template", "{{", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parameters := map[string]string{}
+			if tt.template != "" {
+				parameters[bucketNameTemplateParameter] = tt.template
+			}
+			got, err := s.backendBucketName(context.Background(), name, parameters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("provisionerServer.backendBucketName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("provisionerServer.backendBucketName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateBucketName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"my-bucket.data", false},
+		{"ab", true},
+		{strings.Repeat("a", 64), true},
+		{"My_Bucket", true},
+		{"-bucket", true},
+		{"bucket..data", true},
+		{"10.0.0.1", true},
+		{"bucket-s3alias", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateBucketName(tt.name); (err != nil) != tt.wantErr {
+				t.Errorf("validateBucketName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_DriverCreateBucket_RetryConfig_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	ctx := context.Background()
+	parameters := createParameters()
+	parameters[bucketMaxObjectsParameter] = "10"
+
+	// the bucket is created, but setting its quota fails
+	srv.FailRequests(func(r *http.Request) bool {
+		return r.Method == http.MethodPut && r.URL.Path == "/admin/bucket" && r.URL.Query().Has("quota")
+	}, 1, http.StatusServiceUnavailable, "ServiceUnavailable")
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "retried-bucket", Parameters: parameters}); err == nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() with failing quota succeeded")
+	}
+	if b, ok := srv.Bucket("retried-bucket"); !ok || b.Quota.MaxObjects != nil {
+		t.Fatalf("bucket = %+v, found %v, want created without quota", b, ok)
+	}
+
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "retried-bucket", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() retry error = %v", err)
+	}
+	if b, _ := srv.Bucket("retried-bucket"); b.Quota.MaxObjects == nil || *b.Quota.MaxObjects != 10 {
+		t.Errorf("bucket quota = %+v, want max objects 10 applied by the retry", b.Quota)
+	}
+}
+
+func Test_provisionerServer_DriverCreateBucket_ExistingBucket_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	ctx := context.Background()
+	parameters := createParameters()
+	s3Client, _, err := s.Backends.initializeClients(ctx, s.Clientset, parameters)
+	if err != nil {
+		t.Fatalf("failed to initialize clients: %v", err)
+	}
+	for _, bucketName := range []string{"untagged-bucket", "other-bucket"} {
+		if err := s3Client.CreateBucket(bucketName); err != nil {
+			t.Fatalf("failed to create bucket: %v", err)
+		}
+	}
+	if err := s3Client.PutBucketTagging("other-bucket", map[string]string{BucketTag: "bucket-1"}); err != nil {
+		t.Fatalf("failed to tag bucket: %v", err)
+	}
+
+	quotaParameters := createParameters()
+	quotaParameters[bucketMaxObjectsParameter] = "10"
+	tests := []struct {
+		name       string
+		bucketName string
+		parameters map[string]string
+		wantCode   codes.Code
+	}{
+		{"Untagged bucket with different parameters", "untagged-bucket", quotaParameters, codes.AlreadyExists},
+		{"Untagged bucket with the same parameters", "untagged-bucket", parameters, codes.OK},
+		{"Bucket of another Bucket", "other-bucket", parameters, codes.AlreadyExists},
+	}
+	// the cases run in order, the untagged bucket is adopted by the request with the same parameters
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: tt.bucketName, Parameters: tt.parameters})
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("provisionerServer.DriverCreateBucket() error = %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+	if b, _ := srv.Bucket("untagged-bucket"); b.Quota.MaxObjects != nil || b.Tags[BucketTag] != "untagged-bucket" {
+		t.Errorf("bucket = %+v, want the quota unchanged and tagged with its Bucket", b)
+	}
+}
+
+func Test_validateIndexShards(t *testing.T) {
+	tests := []struct {
+		name    string
+		shards  string
+		wantErr string
+	}{
+		{"Not set", "", ""},
+		{"Dynamic", "dynamic", ""},
+		{"Shard count", "101", "unsupported"},
+		{"Zero", "0", "invalid"},
+		{"Too many", "65522", "invalid"},
+		{"Not a number", "many", "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parameters := map[string]string{}
+			if tt.shards != "" {
+				parameters[bucketIndexShardsParameter] = tt.shards
+			}
+			err := validateIndexShards(parameters)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateIndexShards() error = %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.InvalidArgument || !strings.HasPrefix(status.Convert(err).Message(), tt.wantErr) {
+				t.Errorf("validateIndexShards() error = %v, want %v %s", err, codes.InvalidArgument, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_DriverCreateBucket_IndexShards_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	parameters := createParameters()
+	parameters[bucketIndexShardsParameter] = "101"
+	_, err := s.DriverCreateBucket(context.Background(), &cosispec.DriverCreateBucketRequest{Name: "sharded-bucket", Parameters: parameters})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("provisionerServer.DriverCreateBucket() error = %v, want %v", err, codes.InvalidArgument)
+	}
+	if _, ok := srv.Bucket("sharded-bucket"); ok {
+		t.Errorf("bucket created with an unsupported shard count")
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conformance
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/driver"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/fakergw"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	fakebucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned/fake"
+)
+
+const (
+	// endpointEnv selects a real RGW to run the suite against instead of the fake,
+	// the admin credentials are read from accessKeyEnv and secretKeyEnv
+	endpointEnv  = "COSI_CONFORMANCE_ENDPOINT"
+	accessKeyEnv = "COSI_CONFORMANCE_ACCESS_KEY"
+	secretKeyEnv = "COSI_CONFORMANCE_SECRET_KEY"
+
+	provisioner = "ceph.objectstorage.k8s.io"
+	namespace   = "ceph-cosi-driver"
+	secretName  = "cosi-conformance"
+)
+
+// knownDeviations lists the steps in which the driver does not conform to the spec yet
+var knownDeviations = map[string]string{}
+
+func TestConformance(t *testing.T) {
+	secretData, bucketName := fakeBackend(t)
+	if endpoint := os.Getenv(endpointEnv); endpoint != "" {
+		t.Logf("running against %s", endpoint)
+		secretData = map[string][]byte{
+			"Endpoint":  []byte(endpoint),
+			"AccessKey": []byte(os.Getenv(accessKeyEnv)),
+			"SecretKey": []byte(os.Getenv(secretKeyEnv)),
+		}
+		bucketName = fmt.Sprintf("cosi-conformance-%d", time.Now().Unix())
+	}
+
+	parameters := map[string]string{
+		"objectStoreUserSecretName":      secretName,
+		"objectStoreUserSecretNamespace": namespace,
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: namespace},
+		Data:       secretData,
+	}
+	server := driver.NewProvisionerServerWithClients(provisioner,
+		fakekubeclientset.NewSimpleClientset(secret),
+		fakebucketclientset.NewSimpleClientset())
+
+	Run(t, server, Config{
+		BucketName:       bucketName,
+		BucketParameters: parameters,
+		AccessParameters: parameters,
+		AccountNames:     []string{"ba-conformance-1", "ba-conformance-2"},
+		KnownDeviations:  knownDeviations,
+	})
+}
+
+// fakeBackend starts a fake RGW for the test and returns its admin secret data and a bucket name
+func fakeBackend(t *testing.T) (map[string][]byte, string) {
+	if os.Getenv(endpointEnv) != "" {
+		return nil, ""
+	}
+	srv := fakergw.New()
+	t.Cleanup(srv.Close)
+	return srv.SecretData(), "cosi-conformance"
+}
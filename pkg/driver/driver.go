@@ -18,21 +18,99 @@ package driver
 
 import (
 	"context"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
 
 	"k8s.io/klog/v2"
 	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
 )
 
-func NewDriver(ctx context.Context, driverName string) (cosispec.IdentityServer, cosispec.ProvisionerServer, error) {
-	provisionerServer, err := NewProvisionerServer(driverName)
+// Options holds the driver wide settings
+type Options struct {
+	KeyRotation KeyRotationOptions
+	// ClusterID is tagged on the buckets created by the driver
+	ClusterID string
+	// TagReconcileInterval is how often bucket tags are reconciled, zero disables the reconciliation
+	TagReconcileInterval time.Duration
+	// UserReconcileInterval is how often the restrictions of the users are reconciled, zero disables the reconciliation
+	UserReconcileInterval time.Duration
+	// SyncStatusInterval is how often the sync status of buckets with a sync policy is reported, zero disables it
+	SyncStatusInterval time.Duration
+	// PolicyReconcile configures the detection of bucket policy drift
+	PolicyReconcile PolicyReconcileOptions
+	// UsageInterval is how often the usage of the buckets is published, zero disables it
+	UsageInterval time.Duration
+	// BucketNameInterval is how often the RGW bucket names are published in the credentials secrets, zero disables it
+	BucketNameInterval time.Duration
+	// Connection configures how Kubernetes and the backends are reached
+	Connection ConnectionOptions
+	// DryRun computes and reports the changes of the requests without applying them.
+	// Key rotation, tag and user reconciliation and the restore of drifted policies are disabled, as they write to RGW.
+	DryRun bool
+}
+
+func NewDriver(ctx context.Context, driverName string, options Options) (cosispec.IdentityServer, cosispec.ProvisionerServer, error) {
+	provisionerServer, err := newProvisionerServer(driverName, options.Connection)
 	if err != nil {
 		klog.Fatal(err, "failed to create provisioner server")
 		return nil, nil, err
 	}
+	provisionerServer.ClusterID = options.ClusterID
+	provisionerServer.DryRun = options.DryRun
+	if options.DryRun {
+		klog.InfoS("Dry run, requests are planned without applying changes, key rotation, tag and user reconciliation and policy restore are disabled")
+		options.KeyRotation.Interval = 0
+		options.TagReconcileInterval = 0
+		options.UserReconcileInterval = 0
+		options.PolicyReconcile.Restore = false
+	}
 	identityServer, err := NewIdentityServer(driverName)
 	if err != nil {
 		klog.Fatal(err, "failed to create provisioner server")
 		return nil, nil, err
 	}
+	if provisionerServer.BucketClientset == nil {
+		// the periodic reconcilers all work on the COSI objects
+		klog.InfoS("Key rotation, tag, user and policy reconciliation, sync status, usage reporting and bucket name publishing are disabled without Kubernetes access")
+		return identityServer, provisionerServer, nil
+	}
+	provisionerServer.Objects, err = newObjectIndex(ctx, provisionerServer.BucketClientset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if options.KeyRotation.Interval > 0 {
+		rotator := newKeyRotator(driverName, provisionerServer.Clientset, provisionerServer.BucketClientset, options.KeyRotation)
+		rotator.backends = provisionerServer.Backends
+		go rotator.Run(ctx)
+	}
+	if options.TagReconcileInterval > 0 {
+		go newTagReconciler(provisionerServer, options.TagReconcileInterval).Run(ctx)
+	}
+	if options.UserReconcileInterval > 0 {
+		go newRestrictionReconciler(provisionerServer, options.UserReconcileInterval).Run(ctx)
+	}
+	if options.SyncStatusInterval > 0 {
+		go newSyncStatusReporter(provisionerServer, options.SyncStatusInterval).Run(ctx)
+	}
+	if options.PolicyReconcile.Interval > 0 {
+		go newPolicyReconciler(provisionerServer, options.PolicyReconcile).Run(ctx)
+	}
+	if options.UsageInterval > 0 {
+		go newUsageCollector(provisionerServer, options.UsageInterval).Run(ctx)
+	}
+	if options.BucketNameInterval > 0 {
+		go newBucketNamePublisher(provisionerServer, options.BucketNameInterval).Run(ctx)
+	}
 	return identityServer, provisionerServer, nil
 }
+
+// logReconcileError logs a failure of a periodic reconciler. Retryable errors, e.g. of an unreachable or overloaded
+// RGW, are logged as info since the next pass retries them, the others as errors which need attention.
+func logReconcileError(err error, msg string, keysAndValues ...any) {
+	if rgwerr.IsRetryable(err) {
+		klog.InfoS(msg+", retrying in the next pass", append(keysAndValues, "err", err)...)
+		return
+	}
+	klog.ErrorS(err, msg, keysAndValues...)
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+// DryRunReason is the reason of the Event recording the planned changes of a request in dry-run mode
+const DryRunReason = "DryRun"
+
+// plan lists the changes a request would make on RGW. In dry-run mode the requests are validated and the backend
+// is read to compute the plan, but nothing is written.
+type plan struct {
+	changes []string
+}
+
+func (p *plan) add(format string, args ...any) {
+	p.changes = append(p.changes, fmt.Sprintf(format, args...))
+}
+
+func (p *plan) String() string {
+	if len(p.changes) == 0 {
+		return "no changes"
+	}
+	return strings.Join(p.changes, "; ")
+}
+
+// dryRunError is returned instead of the response in dry-run mode. It carries codes.FailedPrecondition, as the
+// request cannot succeed while the driver runs in dry-run mode, and nothing is recorded as provisioned. The sidecar
+// still retries the object with backoff, so it is provisioned once the driver runs without dry-run mode.
+type dryRunError struct {
+	plan *plan
+	// repeated is set when the request planned the same changes before, the plan is then not logged or recorded again
+	repeated bool
+}
+
+func (e *dryRunError) Error() string {
+	return "dry run: " + e.plan.String()
+}
+
+// GRPCStatus makes the error a gRPC status
+func (e *dryRunError) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, e.Error())
+}
+
+// isDryRun reports whether the error carries the plan of a request in dry-run mode
+func isDryRun(err error) bool {
+	var dryRun *dryRunError
+	return errors.As(err, &dryRun)
+}
+
+// isRepeatedDryRun reports whether the error carries a plan the request already reported
+func isRepeatedDryRun(err error) bool {
+	var dryRun *dryRunError
+	return errors.As(err, &dryRun) && dryRun.repeated
+}
+
+// plannedRequests remembers the last plan of each request, so that the retries of the sidecar do not log and record
+// the same plan over and over
+type plannedRequests struct {
+	plans sync.Map
+}
+
+// dryRun logs the plan of the request identified by key and returns it as the error of the RPC.
+// A plan which did not change since the last attempt of the request is only logged at -v=4.
+func (s *provisionerServer) dryRun(ctx context.Context, key string, p *plan) error {
+	previous, loaded := s.planned.plans.Swap(key, p.String())
+	repeated := loaded && previous == p.String()
+	logger := klog.FromContext(ctx)
+	if repeated {
+		logger = logger.V(4)
+	}
+	logger.Info("Dry run, not applying changes", "changes", p.changes)
+	return &dryRunError{plan: p, repeated: repeated}
+}
+
+// describeQuota formats a quota for the plan, negative limits are unlimited
+func describeQuota(quota rgwadmin.QuotaSpec) string {
+	maxSize, maxObjects := "unlimited", "unlimited"
+	if quota.MaxSize != nil && *quota.MaxSize >= 0 {
+		maxSize = resource.NewQuantity(*quota.MaxSize, resource.BinarySI).String()
+	}
+	if quota.MaxObjects != nil && *quota.MaxObjects >= 0 {
+		maxObjects = strconv.FormatInt(*quota.MaxObjects, 10)
+	}
+	return fmt.Sprintf("max size %s, max objects %s", maxSize, maxObjects)
+}
+
+// planCreateBucket computes the changes DriverCreateBucket would make for the Bucket object name. An existing bucket
+// is checked like a real request checks it, so a bucket of another owner fails with codes.AlreadyExists the same way.
+func planCreateBucket(ctx context.Context, s3Client *s3client.S3Agent, rgwAdminClient *rgwadmin.API, name, bucketName string,
+	config bucketConfig, tags map[string]string, notifications []notificationSpec, sync *bucketSync) (*plan, error) {
+	p := &plan{}
+	_, err := rgwAdminClient.GetBucketInfo(ctx, rgwadmin.Bucket{Bucket: bucketName})
+	if err != nil && !rgwerr.IsNotFound(err) {
+		return nil, rgwerr.Status(err, "failed to get bucket info")
+	}
+	if err == nil {
+		info, err := checkExistingBucket(ctx, rgwAdminClient, bucketName)
+		if err != nil {
+			return nil, err
+		}
+		if err := adoptExistingBucket(ctx, s3Client, rgwAdminClient, info, name, config); err != nil {
+			return nil, err
+		}
+		changes, err := bucketConfigChanges(ctx, rgwAdminClient, info, config)
+		if err != nil {
+			return nil, rgwerr.Status(err, "failed to compare bucket configuration")
+		}
+		for _, change := range changes {
+			switch {
+			case change == bucketQuotaConfig && config.quota == nil:
+				p.add("disable quota %s of bucket %q", describeQuota(info.BucketQuota), bucketName)
+			case change == bucketQuotaConfig:
+				p.add("set quota of bucket %q from %s to %s", bucketName, describeQuota(info.BucketQuota), describeQuota(*config.quota))
+			case change == bucketRateLimitConfig:
+				p.add("set rate limit of bucket %q to %+v", bucketName, *config.rateLimit)
+			}
+		}
+		current, err := s3Client.GetBucketTagging(bucketName)
+		if err != nil {
+			return nil, rgwerr.Status(err, "failed to get bucket tags")
+		}
+		if merged := mergeBucketTags(current, tags); !reflect.DeepEqual(current, merged) {
+			p.add("replace tags %v of bucket %q with %v", current, bucketName, merged)
+		}
+		if err := planBucketNotifications(s3Client, bucketName, notifications, p); err != nil {
+			return nil, err
+		}
+	} else {
+		p.add("create bucket %q", bucketName)
+		if config.quota != nil {
+			p.add("set quota of bucket %q to %s", bucketName, describeQuota(*config.quota))
+		}
+		if config.rateLimit != nil {
+			p.add("set rate limit of bucket %q to %+v", bucketName, *config.rateLimit)
+		}
+		if len(tags) > 0 {
+			p.add("set tags of bucket %q to %v", bucketName, tags)
+		}
+		for _, n := range notifications {
+			p.add("configure notification %q of bucket %q to %s", n.Name, bucketName, n.Endpoint)
+		}
+	}
+	if err := planBucketSync(ctx, rgwAdminClient, bucketName, sync, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// planBucketNotifications adds the changes of the notifications of an existing bucket to the plan: the notifications
+// added or changed, and the notifications the driver configured before which are removed with their topics.
+// The topics of the requested notifications are always updated, as their attributes are not read back.
+func planBucketNotifications(s3Client *s3client.S3Agent, bucketName string, specs []notificationSpec, p *plan) error {
+	current, err := s3Client.GetBucketNotifications(bucketName)
+	if err != nil {
+		return rgwerr.Status(err, "failed to get bucket notifications")
+	}
+	configured := map[string]s3client.TopicNotification{}
+	for _, n := range current {
+		if isDriverNotification(bucketName, n) {
+			configured[n.ID] = n
+		}
+	}
+	requested := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		requested[spec.Name] = true
+		n, found := configured[spec.Name]
+		switch {
+		case !found:
+			p.add("configure notification %q of bucket %q to %s", spec.Name, bucketName, spec.Endpoint)
+		case !slices.Equal(n.Events, spec.Events) || n.Prefix != spec.Prefix || n.Suffix != spec.Suffix:
+			p.add("change events %v, prefix %q and suffix %q of notification %q of bucket %q to %v, %q and %q",
+				n.Events, n.Prefix, n.Suffix, spec.Name, bucketName, spec.Events, spec.Prefix, spec.Suffix)
+		}
+	}
+	for _, n := range current {
+		if isDriverNotification(bucketName, n) && !requested[n.ID] {
+			p.add("remove notification %q of bucket %q and delete topic %q", n.ID, bucketName, n.TopicARN)
+		}
+	}
+	return nil
+}
+
+// planBucketSync adds the changes of the sync policy of the bucket to the plan
+func planBucketSync(ctx context.Context, rgwAdminClient *rgwadmin.API, bucketName string, sync *bucketSync, p *plan) error {
+	switch {
+	case sync == nil:
+		return nil
+	case sync.policy == syncPolicyForbidden:
+		p.add("disable sync of bucket %q and remove its sync policy", bucketName)
+		return nil
+	}
+	current, err := adminops.GetBucketSyncPolicy(ctx, rgwAdminClient, bucketName)
+	if err != nil && !rgwerr.IsNotFound(err) {
+		return rgwerr.Status(err, "failed to get bucket sync policy")
+	}
+	if !reflect.DeepEqual(current, sync.rules()) {
+		p.add("enable sync of bucket %q between zones %v with source zone %q", bucketName, sync.zones, sync.sourceZone)
+	}
+	return nil
+}
+
+// planDeleteBucket computes the changes DriverDeleteBucket would make
+func planDeleteBucket(ctx context.Context, s3Client *s3client.S3Agent, rgwAdminClient *rgwadmin.API, bucketName string) (*plan, error) {
+	p := &plan{}
+	info, err := rgwAdminClient.GetBucketInfo(ctx, rgwadmin.Bucket{Bucket: bucketName})
+	switch {
+	case rgwerr.IsNotFound(err):
+	case err != nil:
+		return nil, rgwerr.Status(err, "failed to get bucket info")
+	case info.Usage.RgwMain.NumObjects != nil && *info.Usage.RgwMain.NumObjects > 0:
+		p.add("delete bucket %q, which fails while it holds %d objects", bucketName, *info.Usage.RgwMain.NumObjects)
+	default:
+		p.add("delete bucket %q", bucketName)
+	}
+	arns, err := driverTopics(s3Client, bucketName)
+	if err != nil && !rgwerr.HasCode(err, rgwerr.NoSuchBucket) {
+		return nil, rgwerr.Status(err, "failed to get bucket notifications")
+	}
+	for _, arn := range arns {
+		p.add("delete notification topic %q", arn)
+	}
+	return p, nil
+}
+
+// planGrantBucketAccess computes the changes DriverGrantBucketAccess would make: the user or subuser creation below
+// the owner user, its restrictions and the statement of the bucket policy
+func (s *provisionerServer) planGrantBucketAccess(ctx context.Context, s3Client *s3client.S3Agent, rgwAdminClient *rgwadmin.API,
+	userName, ownerName, bucketName, accessMode string, restrictions userRestrictions) (*plan, error) {
+	p := &plan{}
+	var principal string
+	switch accessMode {
+	case "", accessModeUser:
+		principal = userName
+		if err := planUser(ctx, rgwAdminClient, userName, restrictions, p); err != nil {
+			return nil, err
+		}
+	case accessModeSubuser:
+		principal = ownerName + subuserSeparator + userName
+		if err := planUser(ctx, rgwAdminClient, ownerName, restrictions, p); err != nil {
+			return nil, err
+		}
+		owner, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: ownerName})
+		if err != nil && !rgwerr.IsNotFound(err) {
+			return nil, rgwerr.Status(err, "failed to get owner user")
+		}
+		if err == nil {
+			if err := checkOwnerRestrictions(ctx, rgwAdminClient, owner, principal, restrictions); err != nil {
+				return nil, rgwerr.Status(err, "failed to check owner user restrictions")
+			}
+		}
+		if !hasSubuser(owner, principal) {
+			p.add("create subuser %q", principal)
+		}
+		if len(subuserKeys(owner.Keys, principal)) == 0 {
+			p.add("create s3 key of subuser %q", principal)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %q", accessModeParameter, accessMode)
+	}
+
+	policy, err := s3Client.GetBucketPolicy(bucketName)
+	if err != nil && !rgwerr.HasCode(err, rgwerr.NoSuchBucketPolicy) {
+		return nil, rgwerr.Status(err, "fetching policy failed")
+	}
+	statement := accessStatement(userName, principal, bucketName)
+	current, found := findStatement(policy, statement.Sid)
+	switch {
+	case !found:
+		p.add("add statement %q granting %q access to the policy of bucket %q", statement.Sid, principal, bucketName)
+	case !current.Equal(*statement):
+		p.add("replace modified statement %q in the policy of bucket %q", statement.Sid, bucketName)
+	}
+	return p, nil
+}
+
+// findStatement returns the statement with the SID, the policy may be missing
+func findStatement(policy *s3client.BucketPolicy, sid string) (s3client.PolicyStatement, bool) {
+	if policy == nil {
+		return s3client.PolicyStatement{}, false
+	}
+	return policy.FindStatement(sid)
+}
+
+// planUser adds the creation of the user, or the changes of the restrictions of an existing user, to the plan
+func planUser(ctx context.Context, rgwAdminClient *rgwadmin.API, userName string, restrictions userRestrictions, p *plan) error {
+	user, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: userName})
+	if rgwerr.IsNotFound(err) {
+		p.add("create user %q with max buckets %d", userName, restrictions.maxBuckets)
+		if restrictions.quota != nil {
+			p.add("set quota of user %q to %s", userName, describeQuota(*restrictions.quota))
+		}
+		if restrictions.opMask != "" {
+			p.add("set op mask of user %q to %q", userName, restrictions.opMask)
+		}
+		if restrictions.rateLimit != nil {
+			p.add("set rate limit of user %q to %+v", userName, *restrictions.rateLimit)
+		}
+		return nil
+	}
+	if err != nil {
+		return rgwerr.Status(err, "failed to get user")
+	}
+
+	if user.MaxBuckets == nil || *user.MaxBuckets != restrictions.maxBuckets {
+		p.add("set max buckets of user %q to %d", userName, restrictions.maxBuckets)
+	}
+	if q := restrictions.quota; q != nil && !quotaEqual(user.UserQuota, *q) {
+		p.add("set quota of user %q to %s", userName, describeQuota(*q))
+	}
+	if restrictions.opMask != "" && normalizeOpMask(user.OpMask) != normalizeOpMask(restrictions.opMask) {
+		p.add("set op mask of user %q from %q to %q", userName, user.OpMask, restrictions.opMask)
+	}
+	if restrictions.rateLimit != nil {
+		current, err := adminops.GetUserRateLimit(ctx, rgwAdminClient, userName)
+		if err != nil {
+			return rgwerr.Status(err, "failed to get user rate limit")
+		}
+		if current != *restrictions.rateLimit {
+			p.add("set rate limit of user %q to %+v", userName, *restrictions.rateLimit)
+		}
+	}
+	return nil
+}
+
+// planRevokeBucketAccess computes the changes DriverRevokeBucketAccess would make
+func planRevokeBucketAccess(ctx context.Context, s3Client *s3client.S3Agent, rgwAdminClient *rgwadmin.API, bucketName, accountID string) (*plan, error) {
+	p := &plan{}
+	policy, err := s3Client.GetBucketPolicy(bucketName)
+	if err != nil && !rgwerr.IsNotFound(err) {
+		return nil, rgwerr.Status(err, "fetching policy failed")
+	}
+	if _, found := findStatement(policy, accountName(accountID)); found {
+		p.add("remove statement %q from the policy of bucket %q", accountName(accountID), bucketName)
+	}
+
+	userName, subuserID := splitAccountID(accountID)
+	user, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: userName})
+	switch {
+	case rgwerr.IsNotFound(err):
+	case err != nil:
+		return nil, rgwerr.Status(err, "failed to get user")
+	case subuserID == "":
+		p.add("remove user %q", userName)
+	case hasSubuser(user, subuserID):
+		p.add("remove subuser %q and its keys", subuserID)
+	}
+	return p, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_provisionerServer_DryRun_FakeRGW(t *testing.T) {
+	backend := backendRef{namespace: "test-namespace", secretName: "test-user-secret"}
+	srv, s := newFakeRGWServer(t,
+		&v1alpha1.Bucket{
+			ObjectMeta: metav1.ObjectMeta{Name: "bucket-1"},
+			Status:     v1alpha1.BucketStatus{BucketID: backend.encode("bucket-1")},
+		},
+		&v1alpha1.BucketAccess{ObjectMeta: metav1.ObjectMeta{Name: "access", Namespace: "apps", UID: "1234"}},
+	)
+	ctx := context.Background()
+	recorder := record.NewFakeRecorder(10)
+	s.Recorder = recorder
+	s.DryRun = true
+	parameters := createParameters()
+	parameters[bucketMaxSizeParameter] = "1Gi"
+	parameters[bucketTagsParameter] = "team=storage"
+	grantParameters := createParameters()
+	grantParameters[opMaskParameter] = "read"
+
+	// expectPlan checks that the request was planned with the changes and recorded the plan as an event
+	expectPlan := func(err error, changes ...string) {
+		t.Helper()
+		if status.Code(err) != codes.FailedPrecondition || !isDryRun(err) {
+			t.Fatalf("dry run error = %v, want the plan with %v", err, codes.FailedPrecondition)
+		}
+		message := status.Convert(err).Message()
+		if len(changes) == 0 && message != "dry run: no changes" {
+			t.Errorf("plan = %q, want no changes", message)
+		}
+		for _, change := range changes {
+			if !strings.Contains(message, change) {
+				t.Errorf("plan = %q, want %q", message, change)
+			}
+		}
+		select {
+		case event := <-recorder.Events:
+			if !strings.HasPrefix(event, corev1.EventTypeNormal+" "+DryRunReason+" ") {
+				t.Errorf("event = %q, want %s %s", event, corev1.EventTypeNormal, DryRunReason)
+			}
+		default:
+			t.Errorf("no event, want %s %s", corev1.EventTypeNormal, DryRunReason)
+		}
+	}
+
+	_, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters})
+	expectPlan(err, `create bucket "bucket-1"`, "max size 1Gi, max objects unlimited", "team:storage")
+	if _, ok := srv.Bucket("bucket-1"); ok {
+		t.Fatalf("dry run created bucket")
+	}
+
+	s.DryRun = false
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	<-recorder.Events
+	<-recorder.Events
+	s.DryRun = true
+	_, err = s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-1234", Parameters: grantParameters})
+	expectPlan(err, `create user "ba-1234" with max buckets -1`, `set op mask of user "ba-1234" to "read"`, `add statement "ba-1234"`)
+	if _, ok := srv.User("ba-1234"); ok {
+		t.Fatalf("dry run created user")
+	}
+
+	// once applied the same requests plan no changes
+	s.DryRun = false
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-1234", Parameters: grantParameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+	for len(recorder.Events) > 0 {
+		<-recorder.Events
+	}
+	s.DryRun = true
+	_, err = s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters})
+	expectPlan(err)
+	_, err = s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-1234", Parameters: grantParameters})
+	expectPlan(err)
+
+	// changed parameters are planned against the existing bucket and user, or fail like the real request
+	grantParameters[opMaskParameter] = "read, write"
+	_, err = s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-1234", Parameters: grantParameters})
+	expectPlan(err, `set op mask of user "ba-1234" from "read" to "read, write"`)
+	parameters[bucketMaxSizeParameter] = "2Gi"
+	_, err = s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters})
+	expectPlan(err, `set quota of bucket "bucket-1" from max size 1Gi, max objects unlimited to max size 2Gi, max objects unlimited`)
+
+	// the retries of the sidecar planning the same changes record no further event
+	_, err = s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters})
+	if !isRepeatedDryRun(err) {
+		t.Errorf("retried dry run error = %v, want the repeated plan", err)
+	}
+	if len(recorder.Events) > 0 {
+		t.Errorf("retried dry run recorded event %q", <-recorder.Events)
+	}
+
+	// the notifications of an existing bucket are compared with the requested ones
+	parameters[bucketNotificationsParameter] = testNotifications
+	_, err = s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters})
+	expectPlan(err, `configure notification "uploads" of bucket "bucket-1" to kafka://kafka.kafka:9092`)
+	s.DryRun = false
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	for len(recorder.Events) > 0 {
+		<-recorder.Events
+	}
+	s.DryRun = true
+	parameters[bucketNotificationsParameter] = strings.Replace(testNotifications, "s3:ObjectCreated:*", "s3:ObjectRemoved:*", 1)
+	_, err = s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters})
+	expectPlan(err, `change events [s3:ObjectCreated:*], prefix "incoming/" and suffix ".jpg" of notification "uploads" of bucket "bucket-1" to [s3:ObjectRemoved:*]`)
+	delete(parameters, bucketNotificationsParameter)
+	topic, _ := srv.Topic("bucket-1_uploads")
+	_, err = s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters})
+	expectPlan(err, fmt.Sprintf(`remove notification "uploads" of bucket "bucket-1" and delete topic %q`, topic.ARN))
+	if _, ok := srv.Topic("bucket-1_uploads"); !ok {
+		t.Errorf("dry run deleted topic")
+	}
+
+	bucket, _ := srv.Bucket("bucket-1")
+	_, err = s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{BucketId: backend.encode("bucket-1"), AccountId: backend.encode("ba-1234")})
+	expectPlan(err, `remove statement "ba-1234" from the policy of bucket "bucket-1"`, `remove user "ba-1234"`)
+	if _, ok := srv.User("ba-1234"); !ok {
+		t.Errorf("dry run removed user")
+	}
+	if after, _ := srv.Bucket("bucket-1"); after.Policy != bucket.Policy {
+		t.Errorf("dry run changed policy %q to %q", bucket.Policy, after.Policy)
+	}
+
+	_, err = s.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: backend.encode("bucket-1")})
+	expectPlan(err, `delete bucket "bucket-1"`)
+	if _, ok := srv.Bucket("bucket-1"); !ok {
+		t.Errorf("dry run deleted bucket")
+	}
+}
+
+func Test_describeQuota(t *testing.T) {
+	size, objects, unlimited := int64(10*1024*1024*1024), int64(1000), int64(-1)
+	tests := []struct {
+		name  string
+		quota rgwadmin.QuotaSpec
+		want  string
+	}{
+		{name: "limits", quota: rgwadmin.QuotaSpec{MaxSize: &size, MaxObjects: &objects}, want: "max size 10Gi, max objects 1000"},
+		{name: "unlimited", quota: rgwadmin.QuotaSpec{MaxSize: &unlimited}, want: "max size unlimited, max objects unlimited"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeQuota(tt.quota); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("describeQuota() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/container-object-storage-interface/client/clientset/versioned/scheme"
+)
+
+// Reasons of the Events recorded on Buckets and BucketAccesses for the outcome of the provisioner RPCs
+const (
+	BucketCreatedReason      = "BucketCreated"
+	BucketCreateFailedReason = "BucketCreateFailed"
+	QuotaAppliedReason       = "QuotaApplied"
+	BucketDeletedReason      = "BucketDeleted"
+	BucketDeleteFailedReason = "BucketDeleteFailed"
+	BucketNotEmptyReason     = "BucketNotEmpty"
+	AccessGrantedReason      = "AccessGranted"
+	AccessGrantFailedReason  = "AccessGrantFailed"
+	PolicyUpdateFailedReason = "PolicyUpdateFailed"
+	AccessRevokedReason      = "AccessRevoked"
+	AccessRevokeFailedReason = "AccessRevokeFailed"
+)
+
+// newEventRecorder returns a recorder emitting Events on COSI objects in the name of the driver
+func newEventRecorder(clientset kubernetes.Interface, driverName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: driverName})
+}
+
+// recordOutcome records the outcome of an RPC on the object returned by lookup, the failure with the message of the
+// returned status and the plan of a request in dry-run mode as DryRunReason, which is only recorded again once the
+// plan changes. Objects which cannot be found, e.g. when the sidecar retries after they were deleted, get no Event.
+func (s *provisionerServer) recordOutcome(ctx context.Context, lookup func(context.Context) (runtime.Object, error),
+	err error, successReason, successMessage, failureReason string) {
+	if s.Recorder == nil || isRepeatedDryRun(err) {
+		return
+	}
+	object, lookupErr := lookup(ctx)
+	if lookupErr != nil {
+		klog.V(4).InfoS("No object to record the event on", "reason", successReason, "err", lookupErr)
+		return
+	}
+	if isDryRun(err) {
+		s.Recorder.Event(object, corev1.EventTypeNormal, DryRunReason, status.Convert(err).Message())
+		return
+	}
+	if err != nil {
+		s.Recorder.Event(object, corev1.EventTypeWarning, failureReason, status.Convert(err).Message())
+		return
+	}
+	s.Recorder.Event(object, corev1.EventTypeNormal, successReason, successMessage)
+}
+
+// bucketByName looks up the Bucket the sidecar named the create request after
+func (s *provisionerServer) bucketByName(name string) func(context.Context) (runtime.Object, error) {
+	return func(ctx context.Context) (runtime.Object, error) {
+		return s.BucketClientset.ObjectstorageV1alpha1().Buckets().Get(ctx, name, metav1.GetOptions{})
+	}
+}
+
+// bucketByID looks up the Bucket holding the bucket ID
+func (s *provisionerServer) bucketByID(bucketID string) func(context.Context) (runtime.Object, error) {
+	return func(ctx context.Context) (runtime.Object, error) {
+		if s.Objects == nil {
+			return nil, kubernetesRequired("finding the bucket of a bucket id")
+		}
+		return s.Objects.bucket(bucketID)
+	}
+}
+
+// bucketAccessByAccount looks up the BucketAccess the sidecar created the account name for
+func (s *provisionerServer) bucketAccessByAccount(accountName string) func(context.Context) (runtime.Object, error) {
+	return func(ctx context.Context) (runtime.Object, error) {
+		return s.findBucketAccess(accountName)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	fakebucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned/fake"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_provisionerServer_Events_FakeRGW(t *testing.T) {
+	backend := backendRef{namespace: "test-namespace", secretName: "test-user-secret"}
+	srv, s := newFakeRGWServer(t,
+		&v1alpha1.Bucket{
+			ObjectMeta: metav1.ObjectMeta{Name: "bucket-1"},
+			Status:     v1alpha1.BucketStatus{BucketReady: true, BucketID: backend.encode("bucket-1")},
+		},
+		&v1alpha1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket-3"}},
+		&v1alpha1.BucketAccess{ObjectMeta: metav1.ObjectMeta{Name: "access", Namespace: "apps", UID: "1234"}},
+		&v1alpha1.BucketAccess{ObjectMeta: metav1.ObjectMeta{Name: "subuser-access", Namespace: "apps", UID: "5678"}},
+	)
+	ctx := context.Background()
+	// the objects of the requests are found in the object index, the clientset is not listed again
+	clientset := s.BucketClientset.(*fakebucketclientset.Clientset)
+	lists := func() int {
+		n := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "list" {
+				n++
+			}
+		}
+		return n
+	}
+	informerLists := lists()
+	recorder := record.NewFakeRecorder(10)
+	s.Recorder = recorder
+	expectEvent := func(eventType, reason string) {
+		t.Helper()
+		select {
+		case event := <-recorder.Events:
+			if !strings.HasPrefix(event, eventType+" "+reason+" ") {
+				t.Errorf("event = %q, want %s %s", event, eventType, reason)
+			}
+		default:
+			t.Errorf("no event, want %s %s", eventType, reason)
+		}
+	}
+
+	invalid := createParameters()
+	invalid[bucketMaxObjectsParameter] = "many"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: invalid}); err == nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() with invalid quota succeeded")
+	}
+	expectEvent(corev1.EventTypeWarning, BucketCreateFailedReason)
+
+	parameters := createParameters()
+	parameters[bucketMaxObjectsParameter] = "10"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	expectEvent(corev1.EventTypeNormal, QuotaAppliedReason)
+	expectEvent(corev1.EventTypeNormal, BucketCreatedReason)
+
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-1234", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+	expectEvent(corev1.EventTypeNormal, AccessGrantedReason)
+	if _, err := s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{BucketId: backend.encode("bucket-1"), AccountId: backend.encode("ba-1234")}); err != nil {
+		t.Fatalf("provisionerServer.DriverRevokeBucketAccess() error = %v", err)
+	}
+	expectEvent(corev1.EventTypeNormal, AccessRevokedReason)
+	subuserParameters := createParameters()
+	subuserParameters[accessModeParameter] = accessModeSubuser
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-5678", Parameters: subuserParameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+	expectEvent(corev1.EventTypeNormal, AccessGrantedReason)
+
+	if err := srv.PutObject("bucket-1", "key", []byte("data")); err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+	if _, err := s.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: backend.encode("bucket-1")}); err == nil {
+		t.Fatalf("provisionerServer.DriverDeleteBucket() of a non empty bucket succeeded")
+	}
+	expectEvent(corev1.EventTypeWarning, BucketNotEmptyReason)
+	if got := lists(); got != informerLists {
+		t.Errorf("requests listed the COSI objects %d times, want 0", got-informerLists)
+	}
+
+	// the quota is not reported when a later step of the creation fails
+	srv.FailRequests(func(r *http.Request) bool {
+		return r.Method == http.MethodPut && r.URL.Query().Has("tagging")
+	}, 1, http.StatusForbidden, "AccessDenied")
+	parameters[bucketTagsParameter] = "team=storage"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-3", Parameters: parameters}); err == nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() with failing tagging succeeded")
+	}
+	expectEvent(corev1.EventTypeWarning, BucketCreateFailedReason)
+	if len(recorder.Events) != 0 {
+		t.Errorf("event %q recorded after the failed creation", <-recorder.Events)
+	}
+
+	// buckets without a Bucket object get no event
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-2", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("event %q recorded without a Bucket", <-recorder.Events)
+	}
+}
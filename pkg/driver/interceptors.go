@@ -0,0 +1,131 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"runtime/debug"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/redact"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog/v2"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+// requestIDHeader carries the request ID, it is taken from the incoming metadata if the caller set it
+// and returned in the response header
+const requestIDHeader = "x-request-id"
+
+// ServerOptions returns the options of the COSI gRPC server. Each request gets a request ID and a contextual logger
+// holding it and the bucket or access name, is logged with its outcome, and panics of the handlers are recovered
+// into codes.Internal instead of killing the driver.
+func ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(requestIDInterceptor, loggingInterceptor, recoveryInterceptor),
+	}
+}
+
+// requestIDInterceptor attaches a logger with the request ID, the method and the objects of the request to the context
+func requestIDInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(requestIDHeader)) > 0 {
+		requestID = md.Get(requestIDHeader)[0]
+	}
+	if requestID == "" {
+		requestID = string(uuid.NewUUID())
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, requestID)); err != nil {
+		klog.V(4).InfoS("Failed to set request ID header", "err", err)
+	}
+	values := append([]any{"requestID", requestID, "method", path.Base(info.FullMethod)}, requestSummary(req)...)
+	logger := klog.FromContext(ctx).WithValues(values...)
+	return handler(klog.NewContext(ctx, logger), req)
+}
+
+// loggingInterceptor logs the parameters of each request and a summary of the response
+func loggingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	logger := klog.FromContext(ctx)
+	if withParameters, ok := req.(interface{ GetParameters() map[string]string }); ok {
+		logger.V(4).Info("Request received", "parameters", redact.Map(withParameters.GetParameters()))
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	if isDryRun(err) {
+		logger.V(2).Info("Request planned", "duration", time.Since(start), "plan", status.Convert(err).Message())
+		return resp, err
+	}
+	if err != nil {
+		logger.Error(err, "Request failed", "code", status.Code(err), "duration", time.Since(start))
+		return resp, err
+	}
+	logger.V(2).Info("Request succeeded", append([]any{"duration", time.Since(start)}, responseSummary(resp)...)...)
+	return resp, nil
+}
+
+// recoveryInterceptor turns a panic of the handler into codes.Internal
+func recoveryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.FromContext(ctx).Error(fmt.Errorf("%v", r), "Recovered from panic", "stack", string(debug.Stack()))
+			resp, err = nil, status.Errorf(codes.Internal, "internal error in %s", path.Base(info.FullMethod))
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// requestSummary returns the names and IDs of the objects of the request as logger key/value pairs
+func requestSummary(req any) []any {
+	var values []any
+	if r, ok := req.(interface{ GetName() string }); ok && r.GetName() != "" {
+		values = append(values, "name", r.GetName())
+	}
+	if r, ok := req.(interface{ GetBucketId() string }); ok && r.GetBucketId() != "" {
+		values = append(values, "bucketID", r.GetBucketId())
+	}
+	if r, ok := req.(interface{ GetAccountId() string }); ok && r.GetAccountId() != "" {
+		values = append(values, "accountID", r.GetAccountId())
+	}
+	return values
+}
+
+// responseSummary returns the IDs of the response as logger key/value pairs, with the credentials redacted
+func responseSummary(resp any) []any {
+	var values []any
+	switch r := resp.(type) {
+	case *cosispec.DriverCreateBucketResponse:
+		values = append(values, "bucketID", r.GetBucketId())
+	case *cosispec.DriverGrantBucketAccessResponse:
+		values = append(values, "accountID", r.GetAccountId(), "credentials", redactCredentials(r.GetCredentials()))
+	}
+	return values
+}
+
+// redactCredentials returns the secrets of the credentials with the keys masked
+func redactCredentials(credentials map[string]*cosispec.CredentialDetails) map[string]map[string]string {
+	redacted := make(map[string]map[string]string, len(credentials))
+	for name, details := range credentials {
+		redacted[name] = redact.Map(details.GetSecrets())
+	}
+	return redacted
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/redact"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"k8s.io/klog/v2"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+// panickingProvisioner fails like a handler indexing the keys of a user without keys
+type panickingProvisioner struct {
+	cosispec.UnimplementedProvisionerServer
+}
+
+func (p *panickingProvisioner) DriverCreateBucket(ctx context.Context, req *cosispec.DriverCreateBucketRequest) (*cosispec.DriverCreateBucketResponse, error) {
+	var user rgwadmin.User
+	return &cosispec.DriverCreateBucketResponse{BucketId: user.Keys[0].AccessKey}, nil
+}
+
+func (p *panickingProvisioner) DriverDeleteBucket(ctx context.Context, req *cosispec.DriverDeleteBucketRequest) (*cosispec.DriverDeleteBucketResponse, error) {
+	klog.FromContext(ctx).Info("Deleting")
+	return &cosispec.DriverDeleteBucketResponse{}, nil
+}
+
+func Test_ServerOptions(t *testing.T) {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(ServerOptions()...)
+	cosispec.RegisterProvisionerServer(server, &panickingProvisioner{})
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := cosispec.NewProvisionerClient(conn)
+	ctx := context.Background()
+
+	var header metadata.MD
+	_, err = client.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket"}, grpc.Header(&header))
+	if status.Code(err) != codes.Internal {
+		t.Errorf("DriverCreateBucket() error = %v, want %v", err, codes.Internal)
+	}
+	if len(header.Get(requestIDHeader)) != 1 || header.Get(requestIDHeader)[0] == "" {
+		t.Errorf("header %s = %v, want a generated request ID", requestIDHeader, header.Get(requestIDHeader))
+	}
+
+	// the driver keeps serving after the panic, with the request ID of the caller
+	ctx = metadata.AppendToOutgoingContext(ctx, requestIDHeader, "abc")
+	if _, err := client.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: "bucket"}, grpc.Header(&header)); err != nil {
+		t.Fatalf("DriverDeleteBucket() error = %v", err)
+	}
+	if got := header.Get(requestIDHeader); !reflect.DeepEqual(got, []string{"abc"}) {
+		t.Errorf("header %s = %v, want [abc]", requestIDHeader, got)
+	}
+}
+
+func Test_requestSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		req  any
+		want []any
+	}{
+		{"Create", &cosispec.DriverCreateBucketRequest{Name: "bucket", Parameters: map[string]string{"a": "b"}}, []any{"name", "bucket"}},
+		{"Grant", &cosispec.DriverGrantBucketAccessRequest{BucketId: "ns/secret/bucket", Name: "ba-1"}, []any{"name", "ba-1", "bucketID", "ns/secret/bucket"}},
+		{"Revoke", &cosispec.DriverRevokeBucketAccessRequest{BucketId: "ns/secret/bucket", AccountId: "ns/secret/ba-1"}, []any{"bucketID", "ns/secret/bucket", "accountID", "ns/secret/ba-1"}},
+		{"Identity", &cosispec.DriverGetInfoRequest{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestSummary(tt.req); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requestSummary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_responseSummary(t *testing.T) {
+	resp := &cosispec.DriverGrantBucketAccessResponse{
+		AccountId: "ns/secret/ba-1",
+		Credentials: map[string]*cosispec.CredentialDetails{"s3": {Secrets: map[string]string{
+			"accessKeyID": "AK", "accessSecretKey": "SK", "endpoint": "http://rgw", "region": "",
+		}}},
+	}
+	want := []any{"accountID", "ns/secret/ba-1", "credentials", map[string]map[string]string{"s3": {
+		"accessKeyID": redact.Mask, "accessSecretKey": redact.Mask, "endpoint": "http://rgw", "region": "",
+	}}}
+	if got := responseSummary(resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("responseSummary() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/metrics"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	cosiapi "sigs.k8s.io/container-object-storage-interface/client/apis"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	bucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned"
+)
+
+const (
+	// RotateKeyAnnotation requests an immediate key rotation when set on a BucketAccess,
+	// it is removed by the driver once the new key has been issued
+	RotateKeyAnnotation = "ceph.objectstorage.k8s.io/rotate-key"
+	// KeyCreatedAtAnnotation records when the key currently issued for a BucketAccess was created
+	KeyCreatedAtAnnotation = "ceph.objectstorage.k8s.io/key-created-at"
+	// RetiredKeyAnnotation holds the access key ID replaced by the last rotation
+	RetiredKeyAnnotation = "ceph.objectstorage.k8s.io/retired-key"
+	// RetireAfterAnnotation holds the time after which the retired key is removed from RGW
+	RetireAfterAnnotation = "ceph.objectstorage.k8s.io/retire-after"
+	// RotatingKeyAnnotation holds the access key ID being replaced while a rotation is in progress
+	RotatingKeyAnnotation = "ceph.objectstorage.k8s.io/rotating-key"
+
+	// bucketInfoSecretKey is the key under which the sidecar stores the BucketInfo in the credentials secret
+	bucketInfoSecretKey = "BucketInfo"
+)
+
+// KeyRotationOptions configures the access key rotation of granted BucketAccesses
+type KeyRotationOptions struct {
+	// MaxKeyAge is the age after which a key is rotated, zero disables age based rotation
+	MaxKeyAge time.Duration
+	// Overlap is how long the replaced key stays valid after rotation
+	Overlap time.Duration
+	// Interval is how often BucketAccesses are checked
+	Interval time.Duration
+}
+
+// keyRotator periodically rotates the access keys of the BucketAccesses handled by the driver
+type keyRotator struct {
+	provisioner     string
+	clientset       kubernetes.Interface
+	bucketClientset bucketclientset.Interface
+	options         KeyRotationOptions
+	// backends holds the credentials of the local backend config
+	backends backends
+	now      func() time.Time
+	// reported holds the BucketAccesses with a key age metric, the metrics of BucketAccesses gone since are deleted
+	reported map[types.NamespacedName]bool
+}
+
+func newKeyRotator(provisioner string, clientset kubernetes.Interface, bucketClientset bucketclientset.Interface, options KeyRotationOptions) *keyRotator {
+	return &keyRotator{
+		provisioner:     provisioner,
+		clientset:       clientset,
+		bucketClientset: bucketClientset,
+		options:         options,
+		now:             time.Now,
+		reported:        map[types.NamespacedName]bool{},
+	}
+}
+
+// Run checks the BucketAccesses every interval until the context is cancelled
+func (r *keyRotator) Run(ctx context.Context) {
+	klog.InfoS("Starting access key rotation", "maxKeyAge", r.options.MaxKeyAge, "overlap", r.options.Overlap)
+	wait.UntilWithContext(ctx, r.reconcileAll, r.options.Interval)
+}
+
+func (r *keyRotator) reconcileAll(ctx context.Context) {
+	bucketAccesses, err := r.bucketClientset.ObjectstorageV1alpha1().BucketAccesses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.ErrorS(err, "failed to list bucket accesses")
+		return
+	}
+	previous := r.reported
+	r.reported = map[types.NamespacedName]bool{}
+	for i := range bucketAccesses.Items {
+		ba := &bucketAccesses.Items[i]
+		if err := r.reconcile(ctx, ba); err != nil {
+			logReconcileError(err, "failed to rotate access key", "namespace", ba.Namespace, "bucketAccess", ba.Name)
+		}
+	}
+	for key := range previous {
+		if !r.reported[key] {
+			metrics.AccessKeyAge.DeleteLabelValues(key.Namespace, key.Name)
+		}
+	}
+}
+
+func (r *keyRotator) reconcile(ctx context.Context, ba *v1alpha1.BucketAccess) error {
+	if !ba.Status.AccessGranted || ba.Status.AccountID == "" || !ba.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	bac, err := r.bucketClientset.ObjectstorageV1alpha1().BucketAccessClasses().Get(ctx, ba.Spec.BucketAccessClassName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get bucket access class: %w", err)
+	}
+	if !strings.EqualFold(bac.DriverName, r.provisioner) {
+		return nil
+	}
+
+	now := r.now()
+	createdAt := ba.CreationTimestamp.Time
+	if v, ok := ba.Annotations[KeyCreatedAtAnnotation]; ok {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			createdAt = t
+		}
+	}
+	metrics.AccessKeyAge.WithLabelValues(ba.Namespace, ba.Name).Set(now.Sub(createdAt).Seconds())
+	r.reported[types.NamespacedName{Namespace: ba.Namespace, Name: ba.Name}] = true
+
+	retiredKey := ba.Annotations[RetiredKeyAnnotation]
+	_, requested := ba.Annotations[RotateKeyAnnotation]
+	_, interrupted := ba.Annotations[RotatingKeyAnnotation]
+	expired := r.options.MaxKeyAge > 0 && now.Sub(createdAt) >= r.options.MaxKeyAge
+	if retiredKey == "" && !requested && !interrupted && !expired {
+		return nil
+	}
+
+	parameters := bac.Parameters
+	if backend, _, ok := decodeID(ba.Status.AccountID); ok {
+		parameters = backend.parameters()
+	}
+	_, rgwAdminClient, err := r.backends.initializeClients(ctx, r.clientset, parameters)
+	if err != nil {
+		return fmt.Errorf("failed to initialize clients: %w", err)
+	}
+
+	if retiredKey != "" {
+		// only one rotation at a time, the previous key has to be removed first
+		return r.retireKey(ctx, rgwAdminClient, ba, retiredKey, now)
+	}
+	return r.rotateKey(ctx, rgwAdminClient, ba, now)
+}
+
+// rotateKey creates a new key for the user, publishes it in the credentials secret
+// and schedules the removal of the previous key.
+// The replaced key is recorded on the BucketAccess before RGW and the secret are touched, so that a rotation
+// interrupted by a failure is resumed by the next pass instead of starting over and losing track of the key.
+func (r *keyRotator) rotateKey(ctx context.Context, rgwAdminClient *rgwadmin.API, ba *v1alpha1.BucketAccess, now time.Time) error {
+	_, accountID, _ := decodeID(ba.Status.AccountID)
+	userName, subuserID := splitAccountID(accountID)
+	secret, err := r.clientset.CoreV1().Secrets(ba.Namespace).Get(ctx, ba.Spec.CredentialsSecretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get credentials secret: %w", err)
+	}
+	bucketInfo := cosiapi.BucketInfo{}
+	if err := json.Unmarshal(secret.Data[bucketInfoSecretKey], &bucketInfo); err != nil {
+		return fmt.Errorf("failed to parse bucket info from credentials secret: %w", err)
+	}
+	if bucketInfo.Spec.S3 == nil {
+		return fmt.Errorf("credentials secret %q has no s3 credentials", secret.Name)
+	}
+
+	oldKey, resumed := ba.Annotations[RotatingKeyAnnotation]
+	if !resumed {
+		oldKey = bucketInfo.Spec.S3.AccessKeyID
+		if err := r.patchAnnotations(ctx, ba, map[string]*string{RotatingKeyAnnotation: &oldKey}); err != nil {
+			return err
+		}
+	}
+
+	// a resumed rotation may already have published the new key, or created it without publishing it
+	if bucketInfo.Spec.S3.AccessKeyID == oldKey {
+		newKey, err := r.newKey(ctx, rgwAdminClient, userName, subuserID, oldKey)
+		if err != nil {
+			return err
+		}
+		bucketInfo.Spec.S3.AccessKeyID = newKey.AccessKey
+		bucketInfo.Spec.S3.AccessSecretKey = newKey.SecretKey
+		data, err := json.Marshal(bucketInfo)
+		if err != nil {
+			return fmt.Errorf("failed to serialize bucket info: %w", err)
+		}
+		secret.Data[bucketInfoSecretKey] = data
+		if _, err := r.clientset.CoreV1().Secrets(ba.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update credentials secret: %w", err)
+		}
+	}
+
+	createdAt := now.Format(time.RFC3339)
+	retireAfter := now.Add(r.options.Overlap).Format(time.RFC3339)
+	if err := r.patchAnnotations(ctx, ba, map[string]*string{
+		RotateKeyAnnotation:    nil,
+		RotatingKeyAnnotation:  nil,
+		KeyCreatedAtAnnotation: &createdAt,
+		RetiredKeyAnnotation:   &oldKey,
+		RetireAfterAnnotation:  &retireAfter,
+	}); err != nil {
+		return err
+	}
+	metrics.AccessKeyAge.WithLabelValues(ba.Namespace, ba.Name).Set(0)
+	klog.InfoS("Rotated access key", "namespace", ba.Namespace, "bucketAccess", ba.Name, "user", ba.Status.AccountID, "retireAfter", retireAfter)
+	return nil
+}
+
+// newKey returns the key replacing oldKey. A key other than oldKey left by an interrupted rotation is reused,
+// otherwise a new key is created.
+func (r *keyRotator) newKey(ctx context.Context, rgwAdminClient *rgwadmin.API, userName, subuserID, oldKey string) (*rgwadmin.UserKeySpec, error) {
+	owner := userName
+	if subuserID != "" {
+		owner = subuserID
+	}
+	user, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: userName})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user %q: %w", userName, err)
+	}
+	existing := make(map[string]bool, len(user.Keys))
+	for i, k := range user.Keys {
+		if k.User == owner && k.AccessKey != oldKey {
+			klog.InfoS("Reusing key of an interrupted rotation", "user", owner)
+			return &user.Keys[i], nil
+		}
+		existing[k.AccessKey] = true
+	}
+
+	generateKey := true
+	keys, err := rgwAdminClient.CreateKey(ctx, rgwadmin.UserKeySpec{
+		UID:         userName,
+		SubUser:     subuserID,
+		KeyType:     "s3",
+		GenerateKey: &generateKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key for user %q: %w", owner, err)
+	}
+	for i, k := range *keys {
+		if !existing[k.AccessKey] && (subuserID == "" || k.User == subuserID) {
+			return &(*keys)[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no new key found for user %q after key creation", owner)
+}
+
+// patchAnnotations merge patches the annotations of the BucketAccess, nil values remove the annotation.
+// Unlike an update, the patch does not conflict with changes the sidecar makes to the BucketAccess.
+func (r *keyRotator) patchAnnotations(ctx context.Context, ba *v1alpha1.BucketAccess, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": annotations}})
+	if err != nil {
+		return fmt.Errorf("failed to serialize annotations: %w", err)
+	}
+	_, err = r.bucketClientset.ObjectstorageV1alpha1().BucketAccesses(ba.Namespace).Patch(ctx, ba.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to annotate bucket access: %w", err)
+	}
+	return nil
+}
+
+// retireKey removes the key replaced by the last rotation once the overlap window has passed
+func (r *keyRotator) retireKey(ctx context.Context, rgwAdminClient *rgwadmin.API, ba *v1alpha1.BucketAccess, retiredKey string, now time.Time) error {
+	retireAfter, err := time.Parse(time.RFC3339, ba.Annotations[RetireAfterAnnotation])
+	if err == nil && now.Before(retireAfter) {
+		return nil
+	}
+
+	_, accountID, _ := decodeID(ba.Status.AccountID)
+	userName, subuserID := splitAccountID(accountID)
+	err = rgwAdminClient.RemoveKey(ctx, rgwadmin.UserKeySpec{
+		UID:       userName,
+		SubUser:   subuserID,
+		AccessKey: retiredKey,
+		KeyType:   "s3",
+	})
+	if err != nil && !rgwerr.HasCode(err, rgwerr.InvalidAccessKey) {
+		return fmt.Errorf("failed to remove key of user %q: %w", userName, err)
+	}
+
+	if err := r.patchAnnotations(ctx, ba, map[string]*string{RetiredKeyAnnotation: nil, RetireAfterAnnotation: nil}); err != nil {
+		return err
+	}
+	klog.InfoS("Removed retired access key", "namespace", ba.Namespace, "bucketAccess", ba.Name, "user", ba.Status.AccountID)
+	return nil
+}
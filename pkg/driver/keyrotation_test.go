@@ -0,0 +1,344 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/metrics"
+	s3cli "github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	cosiapi "sigs.k8s.io/container-object-storage-interface/client/apis"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	fakebucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned/fake"
+)
+
+func Test_keyRotator_reconcile(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	removedKeys := []string{}
+
+	initializeClients = func(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string, s3Options s3cli.Options) (*s3cli.S3Agent, *rgwadmin.API, error) {
+		mockClient := &MockClient{
+			MockDo: func(req *http.Request) (*http.Response, error) {
+				switch {
+				case req.Method == http.MethodGet && req.URL.RawQuery == "format=json&uid=ba-test":
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(`{"user_id":"ba-test","keys":[{"user":"ba-test","access_key":"OldKey","secret_key":"OldSecret"}]}`))),
+					}, nil
+				case req.Method == http.MethodPut && req.URL.Query().Has("key"):
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(`[{"user":"ba-test","access_key":"OldKey","secret_key":"OldSecret"},{"user":"ba-test","access_key":"NewKey","secret_key":"NewSecret"}]`))),
+					}, nil
+				case req.Method == http.MethodDelete && req.URL.Query().Has("key"):
+					removedKeys = append(removedKeys, req.URL.Query().Get("access-key"))
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(``))),
+					}, nil
+				}
+				return nil, fmt.Errorf("unexpected request: %q. method %q. path %q", req.URL.RawQuery, req.Method, req.URL.Path)
+			},
+		}
+		rgwAdminClient, err := rgwadmin.New("rgw-my-store:8000", "accesskey", "secretkey", mockClient)
+		if err != nil {
+			t.Fatalf("failed to create rgw admin client: %v", err)
+		}
+		return nil, rgwAdminClient, nil
+	}
+
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		maxKeyAge       time.Duration
+		wantKey         string
+		wantAnnotations map[string]string
+		wantRemoved     []string
+	}{
+		{
+			name:            "No rotation needed",
+			annotations:     map[string]string{KeyCreatedAtAnnotation: now.Add(-time.Hour).Format(time.RFC3339)},
+			maxKeyAge:       24 * time.Hour,
+			wantKey:         "OldKey",
+			wantAnnotations: map[string]string{KeyCreatedAtAnnotation: now.Add(-time.Hour).Format(time.RFC3339)},
+		},
+		{
+			name:        "Rotation requested by annotation",
+			annotations: map[string]string{RotateKeyAnnotation: "true"},
+			wantKey:     "NewKey",
+			wantAnnotations: map[string]string{
+				KeyCreatedAtAnnotation: now.Format(time.RFC3339),
+				RetiredKeyAnnotation:   "OldKey",
+				RetireAfterAnnotation:  now.Add(time.Hour).Format(time.RFC3339),
+			},
+		},
+		{
+			name:        "Rotation on max key age",
+			annotations: map[string]string{KeyCreatedAtAnnotation: now.Add(-48 * time.Hour).Format(time.RFC3339)},
+			maxKeyAge:   24 * time.Hour,
+			wantKey:     "NewKey",
+			wantAnnotations: map[string]string{
+				KeyCreatedAtAnnotation: now.Format(time.RFC3339),
+				RetiredKeyAnnotation:   "OldKey",
+				RetireAfterAnnotation:  now.Add(time.Hour).Format(time.RFC3339),
+			},
+		},
+		{
+			name: "Retired key kept during overlap",
+			annotations: map[string]string{
+				RetiredKeyAnnotation:  "RetiredKey",
+				RetireAfterAnnotation: now.Add(time.Minute).Format(time.RFC3339),
+			},
+			wantKey: "OldKey",
+			wantAnnotations: map[string]string{
+				RetiredKeyAnnotation:  "RetiredKey",
+				RetireAfterAnnotation: now.Add(time.Minute).Format(time.RFC3339),
+			},
+		},
+		{
+			name: "Retired key removed after overlap",
+			annotations: map[string]string{
+				RetiredKeyAnnotation:  "RetiredKey",
+				RetireAfterAnnotation: now.Add(-time.Minute).Format(time.RFC3339),
+			},
+			wantKey:         "OldKey",
+			wantAnnotations: map[string]string{},
+			wantRemoved:     []string{"RetiredKey"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removedKeys = []string{}
+			bucketInfo, err := json.Marshal(cosiapi.BucketInfo{
+				Spec: cosiapi.BucketInfoSpec{
+					BucketName: "test-bucket",
+					S3: &cosiapi.SecretS3{
+						AccessKeyID:     "OldKey",
+						AccessSecretKey: "OldSecret",
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("failed to marshal bucket info: %v", err)
+			}
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-secret", Namespace: "test-namespace"},
+				Data:       map[string][]byte{bucketInfoSecretKey: bucketInfo},
+			}
+			bac := &v1alpha1.BucketAccessClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-bac"},
+				DriverName: "ceph.objectstorage.k8s.io",
+				Parameters: createParameters(),
+			}
+			ba := &v1alpha1.BucketAccess{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-access",
+					Namespace:   "test-namespace",
+					Annotations: tt.annotations,
+				},
+				Spec: v1alpha1.BucketAccessSpec{
+					BucketAccessClassName: "test-bac",
+					CredentialsSecretName: "test-secret",
+				},
+				Status: v1alpha1.BucketAccessStatus{AccountID: "ba-test", AccessGranted: true},
+			}
+			clientset := fakekubeclientset.NewSimpleClientset(secret)
+			bucketClientset := fakebucketclientset.NewSimpleClientset(bac, ba)
+			r := newKeyRotator("ceph.objectstorage.k8s.io", clientset, bucketClientset, KeyRotationOptions{
+				MaxKeyAge: tt.maxKeyAge,
+				Overlap:   time.Hour,
+			})
+			r.now = func() time.Time { return now }
+
+			if err := r.reconcile(context.Background(), ba); err != nil {
+				t.Fatalf("keyRotator.reconcile() error = %v", err)
+			}
+
+			gotSecret, err := clientset.CoreV1().Secrets("test-namespace").Get(context.Background(), "test-secret", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get secret: %v", err)
+			}
+			gotInfo := cosiapi.BucketInfo{}
+			if err := json.Unmarshal(gotSecret.Data[bucketInfoSecretKey], &gotInfo); err != nil {
+				t.Fatalf("failed to unmarshal bucket info: %v", err)
+			}
+			if gotInfo.Spec.S3.AccessKeyID != tt.wantKey {
+				t.Errorf("access key = %v, want %v", gotInfo.Spec.S3.AccessKeyID, tt.wantKey)
+			}
+
+			gotBA, err := bucketClientset.ObjectstorageV1alpha1().BucketAccesses("test-namespace").Get(context.Background(), "test-access", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get bucket access: %v", err)
+			}
+			if len(gotBA.Annotations) != len(tt.wantAnnotations) {
+				t.Errorf("annotations = %v, want %v", gotBA.Annotations, tt.wantAnnotations)
+			}
+			for k, v := range tt.wantAnnotations {
+				if gotBA.Annotations[k] != v {
+					t.Errorf("annotation %s = %v, want %v", k, gotBA.Annotations[k], v)
+				}
+			}
+			if fmt.Sprint(removedKeys) != fmt.Sprint(tt.wantRemoved) {
+				t.Errorf("removed keys = %v, want %v", removedKeys, tt.wantRemoved)
+			}
+			expectAllowedByRBAC(t, clientset.Actions(), bucketClientset.Actions())
+		})
+	}
+}
+
+func Test_keyRotator_resumeInterruptedRotation(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	createdKeys := 0
+	initializeClients = func(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string, s3Options s3cli.Options) (*s3cli.S3Agent, *rgwadmin.API, error) {
+		mockClient := &MockClient{
+			MockDo: func(req *http.Request) (*http.Response, error) {
+				switch {
+				case req.Method == http.MethodGet && req.URL.RawQuery == "format=json&uid=ba-test":
+					keys := `{"user":"ba-test","access_key":"OldKey","secret_key":"OldSecret"}`
+					if createdKeys > 0 {
+						keys += `,{"user":"ba-test","access_key":"NewKey","secret_key":"NewSecret"}`
+					}
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(`{"user_id":"ba-test","keys":[` + keys + `]}`))),
+					}, nil
+				case req.Method == http.MethodPut && req.URL.Query().Has("key"):
+					createdKeys++
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(`[{"user":"ba-test","access_key":"OldKey","secret_key":"OldSecret"},{"user":"ba-test","access_key":"NewKey","secret_key":"NewSecret"}]`))),
+					}, nil
+				}
+				return nil, fmt.Errorf("unexpected request: %q. method %q. path %q", req.URL.RawQuery, req.Method, req.URL.Path)
+			},
+		}
+		rgwAdminClient, err := rgwadmin.New("rgw-my-store:8000", "accesskey", "secretkey", mockClient)
+		if err != nil {
+			t.Fatalf("failed to create rgw admin client: %v", err)
+		}
+		return nil, rgwAdminClient, nil
+	}
+	t.Cleanup(func() { initializeClients = InitializeClients })
+
+	bucketInfo, err := json.Marshal(cosiapi.BucketInfo{
+		Spec: cosiapi.BucketInfoSpec{S3: &cosiapi.SecretS3{AccessKeyID: "OldKey", AccessSecretKey: "OldSecret"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal bucket info: %v", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-secret", Namespace: "test-namespace"},
+		Data:       map[string][]byte{bucketInfoSecretKey: bucketInfo},
+	}
+	bac := &v1alpha1.BucketAccessClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-bac"},
+		DriverName: "ceph.objectstorage.k8s.io",
+		Parameters: createParameters(),
+	}
+	ba := &v1alpha1.BucketAccess{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-access",
+			Namespace:   "test-namespace",
+			Annotations: map[string]string{RotateKeyAnnotation: "true"},
+		},
+		Spec:   v1alpha1.BucketAccessSpec{BucketAccessClassName: "test-bac", CredentialsSecretName: "test-secret"},
+		Status: v1alpha1.BucketAccessStatus{AccountID: "ba-test", AccessGranted: true},
+	}
+	clientset := fakekubeclientset.NewSimpleClientset(secret)
+	bucketClientset := fakebucketclientset.NewSimpleClientset(bac, ba)
+	// the BucketAccess cannot be annotated once the new key was published
+	failed := false
+	bucketClientset.PrependReactor("patch", "bucketaccesses", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if !failed && strings.Contains(string(action.(clienttesting.PatchAction).GetPatch()), RetiredKeyAnnotation) {
+			failed = true
+			return true, nil, fmt.Errorf("conflict")
+		}
+		return false, nil, nil
+	})
+	r := newKeyRotator("ceph.objectstorage.k8s.io", clientset, bucketClientset, KeyRotationOptions{Overlap: time.Hour})
+	r.now = func() time.Time { return now }
+
+	getBucketAccess := func() *v1alpha1.BucketAccess {
+		t.Helper()
+		got, err := bucketClientset.ObjectstorageV1alpha1().BucketAccesses("test-namespace").Get(context.Background(), "test-access", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get bucket access: %v", err)
+		}
+		return got
+	}
+	if err := r.reconcile(context.Background(), getBucketAccess()); err == nil {
+		t.Fatalf("keyRotator.reconcile() with a failing bucket access update succeeded")
+	}
+	if got := getBucketAccess().Annotations[RotatingKeyAnnotation]; got != "OldKey" {
+		t.Errorf("rotating key = %q, want OldKey", got)
+	}
+
+	// the next pass resumes the rotation and retires the original key
+	if err := r.reconcile(context.Background(), getBucketAccess()); err != nil {
+		t.Fatalf("keyRotator.reconcile() error = %v", err)
+	}
+	annotations := getBucketAccess().Annotations
+	if annotations[RetiredKeyAnnotation] != "OldKey" {
+		t.Errorf("retired key = %q, want OldKey", annotations[RetiredKeyAnnotation])
+	}
+	for _, key := range []string{RotatingKeyAnnotation, RotateKeyAnnotation} {
+		if _, ok := annotations[key]; ok {
+			t.Errorf("annotation %s not removed", key)
+		}
+	}
+	if createdKeys != 1 {
+		t.Errorf("created %d keys, want 1", createdKeys)
+	}
+	gotSecret, err := clientset.CoreV1().Secrets("test-namespace").Get(context.Background(), "test-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get secret: %v", err)
+	}
+	if !bytes.Contains(gotSecret.Data[bucketInfoSecretKey], []byte("NewKey")) {
+		t.Errorf("credentials secret = %s, want NewKey", gotSecret.Data[bucketInfoSecretKey])
+	}
+	expectAllowedByRBAC(t, clientset.Actions(), bucketClientset.Actions())
+
+	// the key age of deleted BucketAccesses is no longer reported
+	metrics.AccessKeyAge.Reset()
+	r.reconcileAll(context.Background())
+	if n := testutil.CollectAndCount(metrics.AccessKeyAge); n != 1 {
+		t.Errorf("%d key age metrics, want 1", n)
+	}
+	if err := bucketClientset.ObjectstorageV1alpha1().BucketAccesses("test-namespace").Delete(context.Background(), "test-access", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete bucket access: %v", err)
+	}
+	r.reconcileAll(context.Background())
+	if n := testutil.CollectAndCount(metrics.AccessKeyAge); n != 0 {
+		t.Errorf("%d key age metrics after the bucket access was deleted, want 0", n)
+	}
+}
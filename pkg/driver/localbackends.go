@@ -0,0 +1,147 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// backendConfig is the format of the local backend config file. Each backend is named like the object store user
+// secret the classes reference and holds the data of the secret, so classes work unchanged with and without the file.
+//
+//	backends:
+//	- namespace: rook-ceph
+//	  secretName: cosi-admin
+//	  endpoint: http://rgw.example.com
+//	  accessKey: ...
+//	  secretKey: ...
+//	  s3:                  # optional, overrides the --s3-* flags
+//	    timeout: 1m
+//	    maxRetries: 10
+//	    virtualHostedStyle: true
+//	    region: eu-central
+//	    userAgent: my-driver
+type backendConfig struct {
+	Backends []localBackend `json:"backends"`
+}
+
+type localBackend struct {
+	Namespace  string          `json:"namespace"`
+	SecretName string          `json:"secretName"`
+	Endpoint   string          `json:"endpoint"`
+	AccessKey  string          `json:"accessKey"`
+	SecretKey  string          `json:"secretKey"`
+	S3         *localBackendS3 `json:"s3,omitempty"`
+}
+
+// localBackendS3 overrides the S3 client options of the flags for a backend
+type localBackendS3 struct {
+	Timeout            *metav1.Duration `json:"timeout,omitempty"`
+	MaxRetries         *int             `json:"maxRetries,omitempty"`
+	VirtualHostedStyle *bool            `json:"virtualHostedStyle,omitempty"`
+	Region             string           `json:"region,omitempty"`
+	UserAgent          string           `json:"userAgent,omitempty"`
+}
+
+// secretData returns the backend in the form of the data of an object store user secret
+func (b localBackend) secretData() map[string][]byte {
+	return map[string][]byte{
+		"Endpoint":  []byte(b.Endpoint),
+		"AccessKey": []byte(b.AccessKey),
+		"SecretKey": []byte(b.SecretKey),
+	}
+}
+
+// s3Options returns the options of the flags with the overrides of the backend applied
+func (b localBackend) s3Options(options s3client.Options) s3client.Options {
+	if b.S3 == nil {
+		return options
+	}
+	if b.S3.Timeout != nil {
+		options.Timeout = b.S3.Timeout.Duration
+	}
+	if b.S3.MaxRetries != nil {
+		options.MaxRetries = b.S3.MaxRetries
+	}
+	if b.S3.VirtualHostedStyle != nil {
+		options.VirtualHostedStyle = *b.S3.VirtualHostedStyle
+	}
+	if b.S3.Region != "" {
+		options.Region = b.S3.Region
+	}
+	if b.S3.UserAgent != "" {
+		options.UserAgent = b.S3.UserAgent
+	}
+	return options
+}
+
+// backends creates the clients of the backends. The zero value reads all credentials from the secrets.
+type backends struct {
+	// local holds the backends of the local config file
+	local map[backendRef]localBackend
+	// s3Options configures the S3 clients, backends of the local config may override them
+	s3Options s3client.Options
+}
+
+// loadBackendConfig reads the local backend config file
+func loadBackendConfig(path string) (map[backendRef]localBackend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backend config: %w", err)
+	}
+	var config backendConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid backend config %q: %w", path, err)
+	}
+	backends := map[backendRef]localBackend{}
+	for i, b := range config.Backends {
+		if b.Namespace == "" || b.SecretName == "" || b.Endpoint == "" || b.AccessKey == "" || b.SecretKey == "" {
+			return nil, fmt.Errorf("invalid backend config %q: backend %d requires namespace, secretName, endpoint, accessKey and secretKey", path, i)
+		}
+		ref := backendRef{namespace: b.Namespace, secretName: b.SecretName}
+		if _, ok := backends[ref]; ok {
+			return nil, fmt.Errorf("invalid backend config %q: duplicate backend %s/%s", path, b.Namespace, b.SecretName)
+		}
+		if b.S3 != nil && b.S3.MaxRetries != nil && *b.S3.MaxRetries < 0 {
+			return nil, fmt.Errorf("invalid backend config %q: backend %s/%s has negative maxRetries", path, b.Namespace, b.SecretName)
+		}
+		backends[ref] = b
+	}
+	klog.InfoS("Loaded backend config", "path", path, "backends", len(backends))
+	return backends, nil
+}
+
+// initializeClients creates the clients of the backend selected by the parameters, from the local config if it
+// has the backend and from the object store user secret otherwise
+func (b backends) initializeClients(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string) (*s3client.S3Agent, *rgwadmin.API, error) {
+	if backend, err := backendFromParameters(parameters); err == nil {
+		if local, ok := b.local[backend]; ok {
+			klog.V(5).InfoS("Using local backend config", "namespace", backend.namespace, "secretName", backend.secretName)
+			return newClients(local.secretData(), local.s3Options(b.s3Options))
+		}
+	}
+	return initializeClients(ctx, clientset, parameters, b.s3Options)
+}
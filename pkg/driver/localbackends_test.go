@@ -0,0 +1,195 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/fakergw"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func Test_loadBackendConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    int
+		wantErr bool
+	}{
+		{"Empty config", "backends: []", 0, false},
+		{"Two backends", `
+backends:
+- {namespace: ns, secretName: a, endpoint: http://a, accessKey: ak, secretKey: sk}
+- {namespace: ns, secretName: b, endpoint: http://b, accessKey: ak, secretKey: sk}
+`, 2, false},
+		{"Missing secret key", "backends: [{namespace: ns, secretName: a, endpoint: http://a, accessKey: ak}]", 0, true},
+		{"Duplicate backend", `
+backends:
+- {namespace: ns, secretName: a, endpoint: http://a, accessKey: ak, secretKey: sk}
+- {namespace: ns, secretName: a, endpoint: http://b, accessKey: ak, secretKey: sk}
+`, 0, true},
+		{"Unknown field", "backends: [{namespace: ns, secretName: a, endpoint: http://a, accessKey: ak, secretKey: sk, region: us}]", 0, true},
+		{"S3 options", "backends: [{namespace: ns, secretName: a, endpoint: http://a, accessKey: ak, secretKey: sk, s3: {timeout: 1m, maxRetries: 0}}]", 1, false},
+		{"Negative retries", "backends: [{namespace: ns, secretName: a, endpoint: http://a, accessKey: ak, secretKey: sk, s3: {maxRetries: -1}}]", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadBackendConfig(writeTestFile(t, "backends.yaml", tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadBackendConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("loadBackendConfig() = %v, want %d backends", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_localBackend_s3Options(t *testing.T) {
+	flagRetries, backendRetries := 5, 0
+	virtualHosted := true
+	flags := s3client.Options{Debug: true, Timeout: time.Minute, MaxRetries: &flagRetries, Region: "us", UserAgent: "driver"}
+
+	tests := []struct {
+		name string
+		s3   *localBackendS3
+		want s3client.Options
+	}{
+		{"No overrides", nil, flags},
+		{"Empty overrides", &localBackendS3{}, flags},
+		{"Overrides", &localBackendS3{
+			Timeout:            &metav1.Duration{Duration: time.Second},
+			MaxRetries:         &backendRetries,
+			VirtualHostedStyle: &virtualHosted,
+			Region:             "eu",
+		}, s3client.Options{Debug: true, Timeout: time.Second, MaxRetries: &backendRetries, VirtualHostedStyle: true, Region: "eu", UserAgent: "driver"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (localBackend{S3: tt.s3}).s3Options(flags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("localBackend.s3Options() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadKubeConfig(t *testing.T) {
+	kubeconfig := writeTestFile(t, "kubeconfig", `
+apiVersion: v1
+kind: Config
+clusters:
+- name: one
+  cluster: {server: https://one.example.com}
+- name: two
+  cluster: {server: https://two.example.com}
+users:
+- name: admin
+  user: {token: secret}
+contexts:
+- name: one
+  context: {cluster: one, user: admin}
+- name: two
+  context: {cluster: two, user: admin}
+current-context: one
+`)
+	tests := []struct {
+		name        string
+		kubeContext string
+		want        string
+		wantErr     bool
+	}{
+		{"Current context", "", "https://one.example.com", false},
+		{"Selected context", "two", "https://two.example.com", false},
+		{"Unknown context", "three", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadKubeConfig(kubeconfig, tt.kubeContext)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadKubeConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Host != tt.want {
+				t.Errorf("loadKubeConfig().Host = %v, want %v", got.Host, tt.want)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_LocalBackends_FakeRGW(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	srv, _ := newFakeRGWServer(t)
+
+	ctx := context.Background()
+	config := writeTestFile(t, "backends.yaml", fmt.Sprintf(`
+backends:
+- namespace: test-namespace
+  secretName: test-user-secret
+  endpoint: %s
+  accessKey: %s
+  secretKey: %s
+`, srv.URL, fakergw.AdminAccessKey, fakergw.AdminSecretKey))
+
+	if _, err := newProvisionerServer("ceph.objectstorage.k8s.io", ConnectionOptions{}); err != rest.ErrNotInCluster {
+		t.Fatalf("newProvisionerServer() without config error = %v, want %v", err, rest.ErrNotInCluster)
+	}
+	s, err := newProvisionerServer("ceph.objectstorage.k8s.io", ConnectionOptions{BackendConfig: config})
+	if err != nil {
+		t.Fatalf("newProvisionerServer() error = %v", err)
+	}
+	if s.Clientset != nil || s.BucketClientset != nil || s.Recorder != nil {
+		t.Fatalf("newProvisionerServer() outside a cluster has Kubernetes clients")
+	}
+
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "local-bucket", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if _, ok := srv.Bucket("local-bucket"); !ok {
+		t.Errorf("bucket not created on the backend of the config")
+	}
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-namespace/test-user-secret/local-bucket", Name: "ba-1234", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+
+	// backends missing from the config need the secret
+	other := map[string]string{objectStoreUserSecretNameParameter: "other-secret", objectStoreUserSecretNamespaceParameter: "test-namespace"}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "other-bucket", Parameters: other}); err == nil {
+		t.Errorf("provisionerServer.DriverCreateBucket() on a backend missing from the config succeeded")
+	}
+	if _, _, err := s.Backends.initializeClients(ctx, nil, other); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("localBackends.initializeClients() error = %v, want %v", err, codes.FailedPrecondition)
+	}
+}
@@ -1,11 +1,19 @@
 package driver
 
 import (
+	"io"
 	"net/http"
+	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/restxml"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 )
 
 // MockClient is the mock of the HTTP Client
@@ -71,3 +79,62 @@ func (m mockS3Client) GetBucketPolicy(input *s3.GetBucketPolicyInput) (*s3.GetBu
 	}
 	return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
 }
+
+func (m mockS3Client) GetBucketTagging(input *s3.GetBucketTaggingInput) (*s3.GetBucketTaggingOutput, error) {
+	switch *input.Bucket {
+	case "test-bucket", "test-bucket-owned-by-you":
+		return nil, awserr.New("NoSuchTagSet", "NoSuchTagSet", nil)
+	}
+	return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+}
+
+func (m mockS3Client) PutBucketTagging(input *s3.PutBucketTaggingInput) (*s3.PutBucketTaggingOutput, error) {
+	switch *input.Bucket {
+	case "test-bucket", "test-bucket-owned-by-you":
+		return &s3.PutBucketTaggingOutput{}, nil
+	}
+	return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+}
+
+func (m mockS3Client) GetBucketNotificationConfigurationRequest(input *s3.GetBucketNotificationConfigurationRequest) (*request.Request, *s3.NotificationConfiguration) {
+	switch *input.Bucket {
+	case "test-bucket", "test-bucket-not-empty":
+		return mockRequest(input, `<NotificationConfiguration><TopicConfiguration><Id>uploads</Id>`+
+			`<Topic>arn:aws:sns:default::`+*input.Bucket+`_uploads</Topic></TopicConfiguration></NotificationConfiguration>`, nil), nil
+	case "test-bucket-owned-by-you", "test-bucket-fail-internal":
+		return mockRequest(input, `<NotificationConfiguration/>`, nil), nil
+	}
+	return mockRequest(input, "", awserr.New("NoSuchBucket", "NoSuchBucket", nil)), nil
+}
+
+func (m mockS3Client) PutBucketNotificationConfigurationRequest(input *s3.PutBucketNotificationConfigurationInput) (*request.Request, *s3.PutBucketNotificationConfigurationOutput) {
+	switch *input.Bucket {
+	case "test-bucket", "test-bucket-owned-by-you":
+		return mockRequest(input, "", nil), nil
+	}
+	return mockRequest(input, "", awserr.New("NoSuchBucket", "NoSuchBucket", nil)), nil
+}
+
+// mockRequest returns a request which responds with the body, or fails with the error when it is sent.
+// It has the handlers of the REST XML protocol which the S3 client replaces for requests it serializes itself.
+func mockRequest(input interface{}, body string, err error) *request.Request {
+	handlers := request.Handlers{}
+	handlers.Build.PushBackNamed(restxml.BuildHandler)
+	handlers.Send.PushBack(func(r *request.Request) {
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+		r.Error = err
+	})
+	handlers.Unmarshal.PushBackNamed(restxml.UnmarshalHandler)
+	return request.New(aws.Config{}, metadata.ClientInfo{}, handlers, nil, &request.Operation{HTTPMethod: http.MethodGet, HTTPPath: "/"}, input, nil)
+}
+
+type mockSNSClient struct {
+	snsiface.SNSAPI
+}
+
+func (m mockSNSClient) DeleteTopic(input *sns.DeleteTopicInput) (*sns.DeleteTopicOutput, error) {
+	if *input.TopicArn != "arn:aws:sns:default::test-bucket_uploads" {
+		return nil, awserr.New("NotFound", "NotFound", nil)
+	}
+	return &sns.DeleteTopicOutput{}, nil
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// bucketNotificationsParameter holds the notifications of the bucket as a JSON or YAML list, see notificationSpec
+	bucketNotificationsParameter = "bucketNotifications"
+	// bucketNotificationsConfigMapParameter references a ConfigMap holding the notifications, in the form <namespace>/<name>
+	bucketNotificationsConfigMapParameter = "bucketNotificationsConfigMap"
+	// notificationsConfigMapKey is the key of the notifications in the ConfigMap
+	notificationsConfigMapKey = "notifications"
+
+	// topicSeparator separates the bucket name from the notification name in topic names,
+	// bucket names never contain it so that the topics of a bucket are found by prefix
+	topicSeparator = "_"
+	// pushEndpointAttribute is the topic attribute holding the endpoint RGW sends the events to
+	pushEndpointAttribute = "push-endpoint"
+)
+
+var (
+	notificationNamePattern = regexp.MustCompile(`^[a-zA-Z0-9-]{1,64}$`)
+	// pushEndpointSchemes are the endpoint types RGW can push notifications to
+	pushEndpointSchemes = map[string]bool{"http": true, "https": true, "amqp": true, "amqps": true, "kafka": true}
+)
+
+// notificationSpec describes a notification of the bucket and the topic it is published to
+type notificationSpec struct {
+	// Name identifies the notification on the bucket and names its topic <bucket name>_<name>
+	Name string `json:"name"`
+	// Endpoint is the push endpoint of the topic, e.g. kafka://kafka:9092, amqp://user@rabbitmq:5672 or http://webhook
+	Endpoint string `json:"endpoint"`
+	// Attributes are additional topic attributes, e.g. kafka-ack-level, amqp-exchange or persistent
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Events are the event types notified, e.g. s3:ObjectCreated:*, all events if empty
+	Events []string `json:"events,omitempty"`
+	// Prefix and Suffix filter the notified object keys
+	Prefix string `json:"prefix,omitempty"`
+	Suffix string `json:"suffix,omitempty"`
+}
+
+// bucketNotifications reads the notifications of the bucket from the BucketClass parameters or the ConfigMap they reference
+func (s *provisionerServer) bucketNotifications(ctx context.Context, parameters map[string]string) ([]notificationSpec, error) {
+	inline, hasInline := parameters[bucketNotificationsParameter]
+	ref, hasConfigMap := parameters[bucketNotificationsConfigMapParameter]
+	if hasInline && hasConfigMap {
+		return nil, status.Errorf(codes.InvalidArgument, "only one of %s and %s may be set", bucketNotificationsParameter, bucketNotificationsConfigMapParameter)
+	}
+	data, source := inline, bucketNotificationsParameter
+	if hasConfigMap {
+		namespace, name, ok := strings.Cut(ref, "/")
+		if !ok || namespace == "" || name == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q, expected <namespace>/<name>", bucketNotificationsConfigMapParameter, ref)
+		}
+		if s.Clientset == nil {
+			return nil, kubernetesRequired(bucketNotificationsConfigMapParameter)
+		}
+		configMap, err := s.Clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			klog.ErrorS(err, "failed to get notifications config map", "namespace", namespace, "name", name)
+			return nil, status.Errorf(codes.Internal, "failed to get config map %q", ref)
+		}
+		data, source = configMap.Data[notificationsConfigMapKey], fmt.Sprintf("config map %q", ref)
+	}
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+
+	var specs []notificationSpec
+	if err := yaml.UnmarshalStrict([]byte(data), &specs); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid notifications in %s: %v", source, err)
+	}
+	names := map[string]bool{}
+	for _, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid notification %q in %s: %v", spec.Name, source, err)
+		}
+		if names[spec.Name] {
+			return nil, status.Errorf(codes.InvalidArgument, "duplicate notification %q in %s", spec.Name, source)
+		}
+		names[spec.Name] = true
+	}
+	return specs, nil
+}
+
+func (n notificationSpec) validate() error {
+	if !notificationNamePattern.MatchString(n.Name) {
+		return fmt.Errorf("name must be 1 to 64 letters, digits or hyphens")
+	}
+	endpoint, err := url.Parse(n.Endpoint)
+	if err != nil || !pushEndpointSchemes[endpoint.Scheme] || endpoint.Host == "" {
+		return fmt.Errorf("endpoint must be an http, https, amqp, amqps or kafka URL")
+	}
+	if _, ok := n.Attributes[pushEndpointAttribute]; ok {
+		return fmt.Errorf("%s is set by the endpoint", pushEndpointAttribute)
+	}
+	for _, event := range n.Events {
+		if !strings.HasPrefix(event, "s3:") {
+			return fmt.Errorf("unsupported event %q", event)
+		}
+	}
+	return nil
+}
+
+// topicName returns the name of the topic of a notification of the bucket
+func topicName(bucketName, notificationName string) string {
+	return bucketName + topicSeparator + notificationName
+}
+
+// isDriverNotification reports whether the notification was configured by the driver,
+// which publishes every notification to the topic named after the bucket and the notification
+func isDriverNotification(bucketName string, n s3client.TopicNotification) bool {
+	return s3client.TopicName(n.TopicARN) == topicName(bucketName, n.ID)
+}
+
+// driverTopics returns the topics of the notifications the driver configured on the bucket.
+// The notification configuration is the record of the topics the driver created for the bucket.
+func driverTopics(s3Client *s3client.S3Agent, bucketName string) ([]string, error) {
+	current, err := s3Client.GetBucketNotifications(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	var arns []string
+	for _, n := range current {
+		if isDriverNotification(bucketName, n) {
+			arns = append(arns, n.TopicARN)
+		}
+	}
+	return arns, nil
+}
+
+// applyBucketNotifications creates the topics of the notifications and sets them on the bucket.
+// Notifications of other clients are kept, notifications the driver configured before and which are no longer
+// requested are removed with their topics.
+func applyBucketNotifications(s3Client *s3client.S3Agent, bucketName string, specs []notificationSpec) error {
+	current, err := s3Client.GetBucketNotifications(bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to get notifications of bucket %q: %w", bucketName, err)
+	}
+	requested := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		requested[spec.Name] = true
+	}
+	notifications := make([]s3client.TopicNotification, 0, len(current)+len(specs))
+	var stale []string
+	for _, n := range current {
+		switch {
+		case !isDriverNotification(bucketName, n):
+			notifications = append(notifications, n)
+		case !requested[n.ID]:
+			stale = append(stale, n.TopicARN)
+		}
+	}
+
+	for _, spec := range specs {
+		attributes := map[string]string{pushEndpointAttribute: spec.Endpoint}
+		for k, v := range spec.Attributes {
+			attributes[k] = v
+		}
+		arn, err := s3Client.CreateTopic(topicName(bucketName, spec.Name), attributes)
+		if err != nil {
+			return fmt.Errorf("failed to create topic of notification %q: %w", spec.Name, err)
+		}
+		notifications = append(notifications, s3client.TopicNotification{
+			ID:       spec.Name,
+			TopicARN: arn,
+			Events:   spec.Events,
+			Prefix:   spec.Prefix,
+			Suffix:   spec.Suffix,
+		})
+	}
+
+	if !reflect.DeepEqual(current, notifications) {
+		if err := s3Client.PutBucketNotifications(bucketName, notifications); err != nil {
+			return fmt.Errorf("failed to set notifications of bucket %q: %w", bucketName, err)
+		}
+		klog.InfoS("Configured bucket notifications", "bucketName", bucketName, "notifications", len(notifications))
+	}
+	// the topics are only deleted once no notification publishes to them
+	return deleteTopics(s3Client, bucketName, stale)
+}
+
+// deleteTopics deletes the notification topics of the bucket.
+// Topics which are already gone, or which the driver's user may not delete, are skipped.
+func deleteTopics(s3Client *s3client.S3Agent, bucketName string, arns []string) error {
+	for _, arn := range arns {
+		err := s3Client.DeleteTopic(arn)
+		switch {
+		case err == nil:
+			klog.InfoS("Deleted bucket notification topic", "bucketName", bucketName, "topic", arn)
+		case rgwerr.IsNotFound(err) || rgwerr.HasCode(err, rgwerr.AccessDenied):
+			klog.V(3).InfoS("skipped bucket notification topic", "bucketName", bucketName, "topic", arn, "reason", err)
+		default:
+			return fmt.Errorf("failed to delete topic %q: %w", arn, err)
+		}
+	}
+	return nil
+}
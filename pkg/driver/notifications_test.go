@@ -0,0 +1,213 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/fakergw"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+const testNotifications = `
+- name: uploads
+  endpoint: kafka://kafka.kafka:9092
+  attributes:
+    kafka-ack-level: broker
+  events: ["s3:ObjectCreated:*"]
+  prefix: incoming/
+  suffix: .jpg
+`
+
+func Test_provisionerServer_bucketNotifications(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "notifications", Namespace: "test-namespace"},
+		Data:       map[string]string{notificationsConfigMapKey: testNotifications},
+	}
+	s := &provisionerServer{Clientset: fakekubeclientset.NewSimpleClientset(configMap)}
+	want := []notificationSpec{{
+		Name:       "uploads",
+		Endpoint:   "kafka://kafka.kafka:9092",
+		Attributes: map[string]string{"kafka-ack-level": "broker"},
+		Events:     []string{"s3:ObjectCreated:*"},
+		Prefix:     "incoming/",
+		Suffix:     ".jpg",
+	}}
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       []notificationSpec
+		wantErr    bool
+	}{
+		{"No notifications", map[string]string{}, nil, false},
+		{"Inline", map[string]string{bucketNotificationsParameter: testNotifications}, want, false},
+		{"Inline JSON", map[string]string{bucketNotificationsParameter: `[{"name":"hook","endpoint":"http://hook:8080"}]`}, []notificationSpec{{Name: "hook", Endpoint: "http://hook:8080"}}, false},
+		{"Config map", map[string]string{bucketNotificationsConfigMapParameter: "test-namespace/notifications"}, want, false},
+		{"Missing config map", map[string]string{bucketNotificationsConfigMapParameter: "test-namespace/missing"}, nil, true},
+		{"Invalid config map reference", map[string]string{bucketNotificationsConfigMapParameter: "notifications"}, nil, true},
+		{"Both set", map[string]string{bucketNotificationsParameter: testNotifications, bucketNotificationsConfigMapParameter: "test-namespace/notifications"}, nil, true},
+		{"Unknown field", map[string]string{bucketNotificationsParameter: `[{"name":"hook","endpoint":"http://hook","topic":"x"}]`}, nil, true},
+		{"Unsupported endpoint", map[string]string{bucketNotificationsParameter: `[{"name":"hook","endpoint":"ftp://hook"}]`}, nil, true},
+		{"Invalid name", map[string]string{bucketNotificationsParameter: `[{"name":"a_b","endpoint":"http://hook"}]`}, nil, true},
+		{"Invalid event", map[string]string{bucketNotificationsParameter: `[{"name":"hook","endpoint":"http://hook","events":["ObjectCreated"]}]`}, nil, true},
+		{"Duplicate name", map[string]string{bucketNotificationsParameter: `[{"name":"hook","endpoint":"http://a"},{"name":"hook","endpoint":"http://b"}]`}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.bucketNotifications(context.Background(), tt.parameters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("provisionerServer.bucketNotifications() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("provisionerServer.bucketNotifications() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_Notifications_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	ctx := context.Background()
+	parameters := createParameters()
+	parameters[bucketNotificationsParameter] = testNotifications
+
+	created, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: parameters})
+	if err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() retry error = %v", err)
+	}
+	// a bucket whose name starts like the other one keeps its topics
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket-2", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+
+	topic, ok := srv.Topic("test-bucket_uploads")
+	if !ok {
+		t.Fatalf("topic test-bucket_uploads not created, topics = %v", srv.Topics())
+	}
+	wantAttributes := map[string]string{pushEndpointAttribute: "kafka://kafka.kafka:9092", "kafka-ack-level": "broker"}
+	if !reflect.DeepEqual(topic.Attributes, wantAttributes) {
+		t.Errorf("topic attributes = %v, want %v", topic.Attributes, wantAttributes)
+	}
+	b, _ := srv.Bucket("test-bucket")
+	wantNotifications := []fakergw.Notification{{
+		ID:       "uploads",
+		TopicARN: topic.ARN,
+		Events:   []string{"s3:ObjectCreated:*"},
+		Prefix:   "incoming/",
+		Suffix:   ".jpg",
+	}}
+	if !reflect.DeepEqual(b.Notifications, wantNotifications) {
+		t.Errorf("bucket notifications = %+v, want %+v", b.Notifications, wantNotifications)
+	}
+
+	// removing the notifications from the class removes them and their topics from the bucket
+	delete(parameters, bucketNotificationsParameter)
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket-2", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if b, _ := srv.Bucket("test-bucket-2"); len(b.Notifications) != 0 {
+		t.Errorf("bucket notifications = %+v, want none", b.Notifications)
+	}
+	if _, ok := srv.Topic("test-bucket-2_uploads"); ok {
+		t.Errorf("topic test-bucket-2_uploads not deleted")
+	}
+
+	// only the topics the driver configured on the bucket are deleted with it
+	srv.CreateTopic("test-bucket_manual")
+	if _, err := s.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: created.BucketId}); err != nil {
+		t.Fatalf("provisionerServer.DriverDeleteBucket() error = %v", err)
+	}
+	if got := srv.Topics(); !reflect.DeepEqual(got, []string{"test-bucket_manual"}) {
+		t.Errorf("topics after delete = %v, want [test-bucket_manual]", got)
+	}
+	if _, err := s.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: created.BucketId}); err != nil {
+		t.Errorf("provisionerServer.DriverDeleteBucket() retry error = %v", err)
+	}
+}
+
+func Test_provisionerServer_Notifications_ForeignFilters_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	ctx := context.Background()
+	parameters := createParameters()
+	parameters[bucketNotificationsParameter] = testNotifications
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+
+	// a notification of another client filtering on what the SDK does not model
+	topic := srv.CreateTopic("manual")
+	foreign := fakergw.Notification{
+		ID:             "manual",
+		TopicARN:       topic.ARN,
+		Events:         []string{"s3:ObjectRemoved:*"},
+		Prefix:         "logs/",
+		Regex:          "[0-9]+\\.log",
+		MetadataFilter: map[string]string{"x-amz-meta-team": "storage"},
+		TagFilter:      map[string]string{"retention": "short"},
+	}
+	if err := srv.PutNotification("test-bucket", foreign); err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the notifications of the class rewrites the configuration of the bucket
+	delete(parameters, bucketNotificationsParameter)
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	b, _ := srv.Bucket("test-bucket")
+	if want := []fakergw.Notification{foreign}; !reflect.DeepEqual(b.Notifications, want) {
+		t.Errorf("bucket notifications = %+v, want %+v", b.Notifications, want)
+	}
+}
+
+func Test_deleteTopics_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	s3Client, _, err := s.Backends.initializeClients(context.Background(), s.Clientset, createParameters())
+	if err != nil {
+		t.Fatalf("initializeClients() error = %v", err)
+	}
+	denied := srv.CreateTopic("denied")
+	deleted := srv.CreateTopic("deleted")
+	deleteDenied := func(r *http.Request) bool {
+		return r.Method == http.MethodPost && r.ParseForm() == nil && r.PostForm.Get("TopicArn") == denied.ARN
+	}
+
+	// topics which are gone or which may not be deleted are skipped
+	srv.FailRequests(deleteDenied, 1, http.StatusForbidden, "AccessDenied")
+	arns := []string{denied.ARN, "arn:aws:sns:default::missing", deleted.ARN}
+	if err := deleteTopics(s3Client, "test-bucket", arns); err != nil {
+		t.Fatalf("deleteTopics() error = %v", err)
+	}
+	if got := srv.Topics(); !reflect.DeepEqual(got, []string{"denied"}) {
+		t.Errorf("topics = %v, want [denied]", got)
+	}
+
+	srv.FailRequests(deleteDenied, 10, http.StatusInternalServerError, "InternalError")
+	if err := deleteTopics(s3Client, "test-bucket", []string{denied.ARN}); err == nil {
+		t.Errorf("deleteTopics() error = nil, want the internal error")
+	}
+}
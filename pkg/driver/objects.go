@@ -0,0 +1,101 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	bucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned"
+	"sigs.k8s.io/container-object-storage-interface/client/informers/externalversions"
+)
+
+const (
+	// bucketIDIndex indexes the Buckets by the bucket ID in their status
+	bucketIDIndex = "bucketID"
+	// uidIndex indexes the BucketAccesses by UID, which the sidecar names the accounts after
+	uidIndex = "uid"
+)
+
+// objectIndex finds the COSI objects of the requests in the informer caches of the Buckets and BucketAccesses.
+// The requests only carry the bucket ID or the account name, which are not the names of the objects.
+type objectIndex struct {
+	buckets        cache.Indexer
+	bucketAccesses cache.Indexer
+}
+
+// newObjectIndex starts the informers of the Buckets and BucketAccesses and waits for their caches to be synced.
+// The informers stop with the context.
+func newObjectIndex(ctx context.Context, client bucketclientset.Interface) (*objectIndex, error) {
+	factory := externalversions.NewSharedInformerFactory(client, 0)
+	buckets := factory.Objectstorage().V1alpha1().Buckets().Informer()
+	err := buckets.AddIndexers(cache.Indexers{bucketIDIndex: func(obj interface{}) ([]string, error) {
+		if bucket, ok := obj.(*v1alpha1.Bucket); ok && bucket.Status.BucketID != "" {
+			return []string{bucket.Status.BucketID}, nil
+		}
+		return nil, nil
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to index buckets: %w", err)
+	}
+	bucketAccesses := factory.Objectstorage().V1alpha1().BucketAccesses().Informer()
+	err = bucketAccesses.AddIndexers(cache.Indexers{uidIndex: func(obj interface{}) ([]string, error) {
+		if ba, ok := obj.(*v1alpha1.BucketAccess); ok {
+			return []string{string(ba.UID)}, nil
+		}
+		return nil, nil
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to index bucket accesses: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync the cache of %v", informer)
+		}
+	}
+	return &objectIndex{buckets: buckets.GetIndexer(), bucketAccesses: bucketAccesses.GetIndexer()}, nil
+}
+
+// bucket returns the Bucket holding the bucket ID
+func (i *objectIndex) bucket(bucketID string) (*v1alpha1.Bucket, error) {
+	objects, err := i.buckets.ByIndex(bucketIDIndex, bucketID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up bucket: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no bucket found for bucket id %q", bucketID)
+	}
+	return objects[0].(*v1alpha1.Bucket), nil
+}
+
+// bucketAccess returns the BucketAccess with the UID. A BucketAccess created moments ago may not be cached yet,
+// the NotFound error makes the sidecar retry.
+func (i *objectIndex) bucketAccess(uid string) (*v1alpha1.BucketAccess, error) {
+	objects, err := i.bucketAccesses.ByIndex(uidIndex, uid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up bucket access: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no bucket access found with uid %q", uid)
+	}
+	return objects[0].(*v1alpha1.BucketAccess), nil
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+)
+
+const (
+	// PolicyDriftReason is the reason of the Event emitted on a BucketAccess whose policy statement was removed or modified
+	PolicyDriftReason = "PolicyDrift"
+	// PolicyRestoredReason is the reason of the Event emitted when the policy statement of a BucketAccess was put back
+	PolicyRestoredReason = "PolicyRestored"
+)
+
+// PolicyReconcileOptions configures the detection of bucket policy drift
+type PolicyReconcileOptions struct {
+	// Interval is how often the policies are compared, zero disables the detection
+	Interval time.Duration
+	// Restore puts back the statements which were removed or modified
+	Restore bool
+}
+
+// policyReconciler periodically compares the bucket policy statements granted to the BucketAccesses of the driver
+// with the bucket policies
+type policyReconciler struct {
+	server  *provisionerServer
+	options PolicyReconcileOptions
+}
+
+func newPolicyReconciler(server *provisionerServer, options PolicyReconcileOptions) *policyReconciler {
+	return &policyReconciler{server: server, options: options}
+}
+
+// Run compares the policies every interval until the context is cancelled
+func (r *policyReconciler) Run(ctx context.Context) {
+	klog.InfoS("Starting bucket policy drift detection", "interval", r.options.Interval, "restore", r.options.Restore)
+	wait.UntilWithContext(ctx, r.reconcileAll, r.options.Interval)
+}
+
+func (r *policyReconciler) reconcileAll(ctx context.Context) {
+	bucketAccesses, err := r.server.BucketClientset.ObjectstorageV1alpha1().BucketAccesses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.ErrorS(err, "failed to list bucket accesses")
+		return
+	}
+	for i := range bucketAccesses.Items {
+		ba := &bucketAccesses.Items[i]
+		if err := r.reconcile(ctx, ba); err != nil {
+			logReconcileError(err, "failed to reconcile bucket policy", "namespace", ba.Namespace, "bucketAccess", ba.Name)
+		}
+	}
+}
+
+func (r *policyReconciler) reconcile(ctx context.Context, ba *v1alpha1.BucketAccess) error {
+	if !ba.Status.AccessGranted || ba.Status.AccountID == "" || !ba.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	client := r.server.BucketClientset.ObjectstorageV1alpha1()
+	bac, err := client.BucketAccessClasses().Get(ctx, ba.Spec.BucketAccessClassName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get bucket access class: %w", err)
+	}
+	if !strings.EqualFold(bac.DriverName, r.server.Provisioner) {
+		return nil
+	}
+	claim, err := client.BucketClaims(ba.Namespace).Get(ctx, ba.Spec.BucketClaimName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get bucket claim: %w", err)
+	}
+	bucket, err := client.Buckets().Get(ctx, claim.Status.BucketName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get bucket: %w", err)
+	}
+	if bucket.Status.BucketID == "" {
+		return nil
+	}
+
+	parameters, bucketName, err := r.server.resolveBucket(ctx, bucket.Status.BucketID)
+	if err != nil {
+		return err
+	}
+	s3Client, _, err := r.server.Backends.initializeClients(ctx, r.server.Clientset, parameters)
+	if err != nil {
+		return fmt.Errorf("failed to initialize clients: %w", err)
+	}
+
+	_, accountID, _ := decodeID(ba.Status.AccountID)
+	expected := accessStatement(accountName(accountID), accountID, bucketName)
+	policy, err := s3Client.GetBucketPolicy(bucketName)
+	if err != nil && !rgwerr.HasCode(err, rgwerr.NoSuchBucketPolicy) {
+		return fmt.Errorf("failed to get policy of bucket %q: %w", bucketName, err)
+	}
+	drift := "is missing"
+	if policy != nil {
+		current, found := policy.FindStatement(expected.Sid)
+		if found && current.Equal(*expected) {
+			return nil
+		}
+		if found {
+			drift = "was modified"
+		}
+	}
+	klog.InfoS("Bucket policy drifted", "bucketName", bucketName, "sid", expected.Sid, "drift", drift)
+	r.server.Recorder.Eventf(ba, corev1.EventTypeWarning, PolicyDriftReason,
+		"Statement %q in the policy of bucket %q %s", expected.Sid, bucketName, drift)
+	if !r.options.Restore {
+		return nil
+	}
+
+	if policy == nil {
+		policy = s3client.NewBucketPolicy(*expected)
+	} else {
+		policy = policy.ModifyBucketPolicy(*expected)
+	}
+	if _, err := s3Client.PutBucketPolicy(bucketName, *policy); err != nil {
+		return fmt.Errorf("failed to restore policy of bucket %q: %w", bucketName, err)
+	}
+	r.server.Recorder.Eventf(ba, corev1.EventTypeNormal, PolicyRestoredReason,
+		"Restored statement %q in the policy of bucket %q", expected.Sid, bucketName)
+	return nil
+}
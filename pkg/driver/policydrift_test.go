@@ -0,0 +1,120 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	s3cli "github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_policyReconciler_FakeRGW(t *testing.T) {
+	backend := backendRef{namespace: "test-namespace", secretName: "test-user-secret"}
+	ba := &v1alpha1.BucketAccess{
+		ObjectMeta: metav1.ObjectMeta{Name: "access", Namespace: "apps", UID: "1234"},
+		Spec:       v1alpha1.BucketAccessSpec{BucketAccessClassName: "test-access-class", BucketClaimName: "claim"},
+		Status:     v1alpha1.BucketAccessStatus{AccessGranted: true, AccountID: backend.encode("ba-1234")},
+	}
+	srv, s := newFakeRGWServer(t,
+		&v1alpha1.BucketAccessClass{ObjectMeta: metav1.ObjectMeta{Name: "test-access-class"}, DriverName: "ceph.objectstorage.k8s.io", Parameters: createParameters()},
+		&v1alpha1.BucketClaim{ObjectMeta: metav1.ObjectMeta{Name: "claim", Namespace: "apps"}, Status: v1alpha1.BucketClaimStatus{BucketName: "bucket", BucketReady: true}},
+		&v1alpha1.Bucket{
+			ObjectMeta: metav1.ObjectMeta{Name: "bucket"},
+			Spec:       v1alpha1.BucketSpec{DriverName: "ceph.objectstorage.k8s.io"},
+			Status:     v1alpha1.BucketStatus{BucketReady: true, BucketID: backend.encode("test-bucket")},
+		},
+		ba,
+	)
+	ctx := context.Background()
+	recorder := record.NewFakeRecorder(10)
+	s.Recorder = recorder
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("test-bucket"), Name: "ba-1234", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, AccessGrantedReason) {
+		t.Fatalf("event = %q, want %s", event, AccessGrantedReason)
+	}
+	data := srv.SecretData()
+	adminClient, err := s3cli.NewS3Agent(string(data["AccessKey"]), string(data["SecretKey"]), string(data["Endpoint"]), nil, false)
+	if err != nil {
+		t.Fatalf("failed to create s3 client: %v", err)
+	}
+
+	r := newPolicyReconciler(s, PolicyReconcileOptions{})
+	if err := r.reconcile(ctx, ba); err != nil {
+		t.Fatalf("policyReconciler.reconcile() error = %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("event %q emitted without drift", <-recorder.Events)
+	}
+
+	// the statement is narrowed by hand
+	modified := accessStatement("ba-1234", "ba-1234", "test-bucket").Actions(s3cli.GetObject)
+	if _, err := adminClient.PutBucketPolicy("test-bucket", *s3cli.NewBucketPolicy(*modified)); err != nil {
+		t.Fatalf("failed to put policy: %v", err)
+	}
+	if err := r.reconcile(ctx, ba); err != nil {
+		t.Fatalf("policyReconciler.reconcile() error = %v", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, PolicyDriftReason) || !strings.Contains(event, "was modified") {
+		t.Errorf("event = %q, want %s of a modified statement", event, PolicyDriftReason)
+	}
+	if b, _ := srv.Bucket("test-bucket"); strings.Contains(b.Policy, string(s3cli.PutObject)) {
+		t.Errorf("policy = %s, want it left unchanged without restore", b.Policy)
+	}
+
+	// the statement is removed by hand and restored
+	other := s3cli.NewPolicyStatement().WithSID("manual").ForPrincipals("someone").ForResources("test-bucket").Allows().Actions(s3cli.GetObject)
+	if _, err := adminClient.PutBucketPolicy("test-bucket", *s3cli.NewBucketPolicy(*other)); err != nil {
+		t.Fatalf("failed to put policy: %v", err)
+	}
+	r.options.Restore = true
+	if err := r.reconcile(ctx, ba); err != nil {
+		t.Fatalf("policyReconciler.reconcile() error = %v", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, PolicyDriftReason) || !strings.Contains(event, "is missing") {
+		t.Errorf("event = %q, want %s of a missing statement", event, PolicyDriftReason)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, PolicyRestoredReason) {
+		t.Errorf("event = %q, want %s", event, PolicyRestoredReason)
+	}
+	policy, err := adminClient.GetBucketPolicy("test-bucket")
+	if err != nil {
+		t.Fatalf("failed to get policy: %v", err)
+	}
+	if stmt, ok := policy.FindStatement("ba-1234"); !ok || !stmt.Equal(*accessStatement("ba-1234", "ba-1234", "test-bucket")) {
+		t.Errorf("statement = %+v, found %v, want the granted statement", stmt, ok)
+	}
+	if _, ok := policy.FindStatement("manual"); !ok {
+		t.Errorf("statement added by hand removed by restore")
+	}
+	if err := r.reconcile(ctx, ba); err != nil {
+		t.Fatalf("policyReconciler.reconcile() error = %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("event %q emitted after restore", <-recorder.Events)
+	}
+}
@@ -18,19 +18,26 @@ package driver
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"os"
 
+	"github.com/ceph/cosi-driver-ceph/pkg/util/breaker"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/redact"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
 	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
 
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
 	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
 	bucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned"
 	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
 )
@@ -41,17 +48,76 @@ import (
 type provisionerServer struct {
 	cosispec.UnimplementedProvisionerServer
 	Provisioner     string
-	Clientset       *kubernetes.Clientset
+	Clientset       kubernetes.Interface
 	KubeConfig      *rest.Config
 	BucketClientset bucketclientset.Interface
+	// ClusterID is tagged on the buckets to tell clusters sharing an RGW apart
+	ClusterID string
+	// Recorder emits Events on the COSI objects
+	Recorder record.EventRecorder
+	// Objects finds the COSI objects of the requests, it is set by NewDriver when the driver has Kubernetes access
+	Objects *objectIndex
+	// Backends creates the clients of the backends, from the local backend config which takes precedence over the secrets
+	Backends backends
+	// DryRun validates the requests and computes their changes without applying them, see plan
+	DryRun bool
+	// planned remembers the plans of the requests in dry-run mode
+	planned plannedRequests
+}
+
+// ConnectionOptions configures how the driver reaches Kubernetes and the backends
+type ConnectionOptions struct {
+	// KubeConfig is the path of a kubeconfig file, the in-cluster config is used if it and KubeContext are empty
+	KubeConfig string
+	// KubeContext selects a context of the kubeconfig instead of its current context
+	KubeContext string
+	// BackendConfig is the path of a local file holding the credentials of the backends.
+	// With it the driver starts without Kubernetes access when there is no in-cluster config.
+	BackendConfig string
+	// S3 configures the S3 clients of the backends, the local backend config may override it per backend
+	S3 s3client.Options
+	// Breaker configures the circuit breaker and the in-flight limit of each backend
+	Breaker breaker.Options
 }
 
 var _ cosispec.ProvisionerServer = &provisionerServer{}
 
 var initializeClients = InitializeClients
 
-func NewProvisionerServer(provisioner string) (cosispec.ProvisionerServer, error) {
-	kubeConfig, err := rest.InClusterConfig()
+func NewProvisionerServer(provisioner string, options ConnectionOptions) (cosispec.ProvisionerServer, error) {
+	return newProvisionerServer(provisioner, options)
+}
+
+// NewProvisionerServerWithClients creates a provisioner server using the given clients
+// instead of the in-cluster configuration, e.g. for tests
+func NewProvisionerServerWithClients(provisioner string, clientset kubernetes.Interface, bucketClientset bucketclientset.Interface) cosispec.ProvisionerServer {
+	return &provisionerServer{
+		Provisioner:     provisioner,
+		Clientset:       clientset,
+		BucketClientset: bucketClientset,
+		Recorder:        newEventRecorder(clientset, provisioner),
+	}
+}
+
+func newProvisionerServer(provisioner string, options ConnectionOptions) (*provisionerServer, error) {
+	s := &provisionerServer{Provisioner: provisioner}
+	s.Backends.s3Options = options.S3
+	if options.Breaker.FailureThreshold > 0 || options.Breaker.MaxInFlight > 0 {
+		s.Backends.s3Options.Breakers = breaker.NewSet(options.Breaker)
+	}
+	if options.BackendConfig != "" {
+		local, err := loadBackendConfig(options.BackendConfig)
+		if err != nil {
+			return nil, err
+		}
+		s.Backends.local = local
+	}
+
+	kubeConfig, err := loadKubeConfig(options.KubeConfig, options.KubeContext)
+	if errors.Is(err, rest.ErrNotInCluster) && options.BackendConfig != "" {
+		klog.InfoS("Not running in a cluster, starting without Kubernetes access", "backendConfig", options.BackendConfig)
+		return s, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -66,127 +132,337 @@ func NewProvisionerServer(provisioner string) (cosispec.ProvisionerServer, error
 		return nil, err
 	}
 
-	return &provisionerServer{
-		Provisioner:     provisioner,
-		Clientset:       clientset,
-		KubeConfig:      kubeConfig,
-		BucketClientset: bucketClientset,
-	}, nil
+	s.Clientset = clientset
+	s.KubeConfig = kubeConfig
+	s.BucketClientset = bucketClientset
+	s.Recorder = newEventRecorder(clientset, provisioner)
+	return s, nil
+}
+
+// loadKubeConfig returns the in-cluster config, or the config of the kubeconfig file and context if either is set.
+// Without an explicit file the kubeconfig is looked up like kubectl does, from $KUBECONFIG or ~/.kube/config.
+func loadKubeConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
+	if kubeconfig == "" && kubeContext == "" {
+		return rest.InClusterConfig()
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	kubeConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	return kubeConfig, nil
+}
+
+// kubernetesRequired is returned by features reading Kubernetes objects when the driver runs without Kubernetes access
+func kubernetesRequired(feature string) error {
+	return status.Errorf(codes.FailedPrecondition, "%s requires Kubernetes access", feature)
 }
 
 // ProvisionerCreateBucket is an idempotent method for creating buckets
 // It is expected to create the same bucket given a bucketName and protocol
-// If the bucket already exists, then it MUST return codes.AlreadyExists
+// If the bucket already exists and is owned by the driver, its configuration is reconciled and it succeeds,
+// otherwise it MUST return codes.AlreadyExists
 // Return values
 //
-//	nil -                   Bucket successfully created
-//	codes.AlreadyExists -   Bucket already exists. No more retries
+//	nil -                   Bucket successfully created or already created by the driver
+//	codes.AlreadyExists -   Bucket exists with another owner. No more retries
 //	non-nil err -           Internal error                                [requeue'd with exponential backoff]
 func (s *provisionerServer) DriverCreateBucket(ctx context.Context,
-	req *cosispec.DriverCreateBucketRequest) (*cosispec.DriverCreateBucketResponse, error) {
-	klog.V(5).Infof("req %v", req)
+	req *cosispec.DriverCreateBucketRequest) (_ *cosispec.DriverCreateBucketResponse, err error) {
+	logger := klog.FromContext(ctx)
+
+	var bucketName string
+	defer func() {
+		s.recordOutcome(ctx, s.bucketByName(req.GetName()), err,
+			BucketCreatedReason, fmt.Sprintf("Bucket %q is ready", bucketName), BucketCreateFailedReason)
+	}()
+	parameters := req.GetParameters()
 
-	bucketName := req.GetName()
-	klog.V(3).InfoS("Creating Bucket", "name", bucketName)
+	bucketName, err = s.backendBucketName(ctx, req.GetName(), parameters)
+	if err != nil {
+		logger.Error(err, "failed to generate bucket name", "name", req.GetName())
+		return nil, err
+	}
+	logger.V(3).Info("Creating Bucket", "name", req.GetName(), "bucketName", bucketName)
 
-	parameters := req.GetParameters()
+	config, err := parseBucketConfig(parameters)
+	if err != nil {
+		logger.Error(err, "invalid bucket configuration")
+		return nil, err
+	}
+	sync, err := parseBucketSync(parameters)
+	if err != nil {
+		logger.Error(err, "invalid bucket sync policy")
+		return nil, err
+	}
+	tagging, err := parseBucketTagging(parameters)
+	if err != nil {
+		logger.Error(err, "invalid bucket tagging")
+		return nil, err
+	}
+	backend, err := backendFromParameters(parameters)
+	if err != nil {
+		logger.Error(err, "invalid backend parameters")
+		return nil, err
+	}
+	tags, err := s.bucketTags(ctx, req.GetName(), tagging)
+	if err != nil {
+		logger.Error(err, "failed to compute bucket tags", "name", req.GetName())
+		return nil, status.Error(codes.Internal, "failed to compute bucket tags")
+	}
+	notifications, err := s.bucketNotifications(ctx, parameters)
+	if err != nil {
+		logger.Error(err, "invalid bucket notifications")
+		return nil, err
+	}
 
-	s3Client, _, err := initializeClients(ctx, s.Clientset, parameters)
+	s3Client, rgwAdminClient, err := s.Backends.initializeClients(ctx, s.Clientset, parameters)
 	if err != nil {
-		klog.ErrorS(err, "failed to initialize clients")
+		logger.Error(err, "failed to initialize clients")
 		return nil, status.Error(codes.Internal, "failed to initialize clients")
 	}
+	if s.DryRun {
+		p, err := planCreateBucket(ctx, s3Client, rgwAdminClient, req.GetName(), bucketName, config, tags, notifications, sync)
+		if err != nil {
+			logger.Error(err, "failed to plan bucket creation", "bucketName", bucketName)
+			return nil, err
+		}
+		return nil, s.dryRun(ctx, "create/"+bucketName, p)
+	}
 
 	err = s3Client.CreateBucket(bucketName)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			klog.InfoS("DEBUG: after s3 call", "ok", ok, "aerr", aerr)
-			switch aerr.Code() {
-			case s3.ErrCodeBucketAlreadyExists:
-				klog.InfoS("bucket already exists", "name", bucketName)
-				return nil, status.Error(codes.AlreadyExists, "bucket already exists")
-			case s3.ErrCodeBucketAlreadyOwnedByYou:
-				klog.InfoS("bucket already owned by you", "name", bucketName)
-				return nil, status.Error(codes.AlreadyExists, "bucket already owned by you")
+		if rgwerr.HasCode(err, rgwerr.BucketAlreadyExists, rgwerr.BucketAlreadyOwnedByYou) {
+			logger.Info("bucket already exists", "name", bucketName)
+			info, err := checkExistingBucket(ctx, rgwAdminClient, bucketName)
+			if err != nil {
+				logger.Error(err, "existing bucket can not be reused", "bucketName", bucketName)
+				return nil, err
+			}
+			if err := adoptExistingBucket(ctx, s3Client, rgwAdminClient, info, req.GetName(), config); err != nil {
+				logger.Error(err, "existing bucket can not be reused", "bucketName", bucketName)
+				return nil, err
+			}
+			if err := reconcileBucketConfig(ctx, rgwAdminClient, info, config); err != nil {
+				logger.Error(err, "failed to configure bucket", "bucketName", bucketName)
+				return nil, rgwerr.Status(err, "failed to configure bucket")
 			}
+			if err := reconcileBucketTags(s3Client, bucketName, tags); err != nil {
+				logger.Error(err, "failed to tag bucket", "bucketName", bucketName)
+				return nil, rgwerr.Status(err, "failed to tag bucket")
+			}
+			if err := s.configureNotifications(s3Client, bucketName, notifications); err != nil {
+				return nil, err
+			}
+			if err := configureSync(ctx, rgwAdminClient, bucketName, sync); err != nil {
+				return nil, err
+			}
+			return &cosispec.DriverCreateBucketResponse{
+				BucketId: backend.encode(bucketName),
+			}, nil
 		}
-		klog.ErrorS(err, "failed to create bucket", "bucketName", bucketName)
-		return nil, status.Error(codes.Internal, "failed to create bucket")
+		logger.Error(err, "failed to create bucket", "bucketName", bucketName)
+		return nil, rgwerr.Status(err, "failed to create bucket")
+	}
+	// the bucket is tagged first, so that a retry after a failed step recognizes the bucket as its own
+	if err := reconcileBucketTags(s3Client, bucketName, tags); err != nil {
+		logger.Error(err, "failed to tag bucket", "bucketName", bucketName)
+		return nil, rgwerr.Status(err, "failed to tag bucket")
+	}
+	if err := applyBucketConfig(ctx, rgwAdminClient, bucketName, config); err != nil {
+		logger.Error(err, "failed to configure bucket", "bucketName", bucketName)
+		return nil, rgwerr.Status(err, "failed to configure bucket")
+	}
+	if err := s.configureNotifications(s3Client, bucketName, notifications); err != nil {
+		return nil, err
+	}
+	if err := configureSync(ctx, rgwAdminClient, bucketName, sync); err != nil {
+		return nil, err
+	}
+	logger.Info("Successfully created Backend Bucket", "bucketName", bucketName)
+	// the quota is only reported once every step of the creation succeeded
+	if config.quota != nil || config.rateLimit != nil {
+		s.recordOutcome(ctx, s.bucketByName(req.GetName()), nil,
+			QuotaAppliedReason, fmt.Sprintf("Applied the quota and rate limit of bucket %q", bucketName), "")
 	}
-	klog.InfoS("Successfully created Backend Bucket", "bucketName", bucketName)
 
 	return &cosispec.DriverCreateBucketResponse{
-		BucketId: bucketName,
+		BucketId: backend.encode(bucketName),
 	}, nil
 }
 
+// configureNotifications sets up the notifications of the bucket, see applyBucketNotifications
+func (s *provisionerServer) configureNotifications(s3Client *s3client.S3Agent, bucketName string, notifications []notificationSpec) error {
+	if err := applyBucketNotifications(s3Client, bucketName, notifications); err != nil {
+		klog.ErrorS(err, "failed to configure bucket notifications", "bucketName", bucketName)
+		return rgwerr.Status(err, "failed to configure bucket notifications")
+	}
+	return nil
+}
+
+// configureSync applies the sync policy of the bucket and reports the resulting sync status
+func configureSync(ctx context.Context, rgwAdminClient *rgwadmin.API, bucketName string, sync *bucketSync) error {
+	if err := applyBucketSync(ctx, rgwAdminClient, bucketName, sync); err != nil {
+		klog.FromContext(ctx).Error(err, "failed to configure bucket sync policy", "bucketName", bucketName)
+		return rgwerr.Status(err, "failed to configure bucket sync policy")
+	}
+	reportBucketSync(ctx, rgwAdminClient, bucketName, sync)
+	return nil
+}
+
 func (s *provisionerServer) DriverDeleteBucket(ctx context.Context,
-	req *cosispec.DriverDeleteBucketRequest) (*cosispec.DriverDeleteBucketResponse, error) {
-	klog.V(5).Infof("req %v", req)
-	bucketName := req.GetBucketId()
-	klog.V(3).InfoS("Deleting Bucket", "name", bucketName)
-	bucket, err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Get(ctx, bucketName, metav1.GetOptions{})
+	req *cosispec.DriverDeleteBucketRequest) (_ *cosispec.DriverDeleteBucketResponse, err error) {
+	logger := klog.FromContext(ctx)
+	failureReason := BucketDeleteFailedReason
+	defer func() {
+		s.recordOutcome(ctx, s.bucketByID(req.GetBucketId()), err, BucketDeletedReason, "Bucket deleted", failureReason)
+	}()
+	logger.V(3).Info("Deleting Bucket", "id", req.GetBucketId())
+	if req.GetBucketId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "bucket id is required")
+	}
+	parameters, bucketName, err := s.resolveBucket(ctx, req.GetBucketId())
 	if err != nil {
-		klog.ErrorS(err, "failed to get bucket", "bucketName", bucketName)
-		return nil, status.Error(codes.Internal, "failed to get bucket")
+		return nil, err
 	}
 
-	parameters := bucket.Spec.Parameters
-	s3Client, _, err := initializeClients(ctx, s.Clientset, parameters)
+	s3Client, rgwAdminClient, err := s.Backends.initializeClients(ctx, s.Clientset, parameters)
 	if err != nil {
-		klog.ErrorS(err, "failed to initialize clients")
+		logger.Error(err, "failed to initialize clients")
 		return nil, status.Error(codes.Internal, "failed to initialize clients")
 	}
+	if s.DryRun {
+		p, err := planDeleteBucket(ctx, s3Client, rgwAdminClient, bucketName)
+		if err != nil {
+			logger.Error(err, "failed to plan bucket deletion", "bucketName", bucketName)
+			return nil, err
+		}
+		return nil, s.dryRun(ctx, "delete/"+bucketName, p)
+	}
+
+	// RGW removes the notifications with the bucket but keeps their topics, which are read from the
+	// notifications before and deleted after the bucket
+	topics, err := driverTopics(s3Client, bucketName)
+	if err != nil && !rgwerr.HasCode(err, rgwerr.NoSuchBucket) {
+		logger.Error(err, "failed to get bucket notifications", "bucketName", bucketName)
+		return nil, rgwerr.Status(err, "failed to get bucket notifications")
+	}
 
 	_, err = s3Client.DeleteBucket(bucketName)
-	if err != nil {
-		klog.ErrorS(err, "failed to delete bucket", "bucketName", bucketName)
-		return nil, status.Error(codes.Internal, "failed to delete bucket")
+	if rgwerr.HasCode(err, rgwerr.NoSuchBucket) {
+		logger.Info("bucket already deleted", "bucketName", bucketName)
+	} else if err != nil {
+		logger.Error(err, "failed to delete bucket", "bucketName", bucketName)
+		if rgwerr.HasCode(err, rgwerr.BucketNotEmpty) {
+			failureReason = BucketNotEmptyReason
+		}
+		return nil, rgwerr.Status(err, "failed to delete bucket")
+	} else {
+		logger.Info("Successfully deleted Backend Bucket", "bucketName", bucketName)
+	}
+	forgetBucketSync(bucketName)
+
+	if err := deleteTopics(s3Client, bucketName, topics); err != nil {
+		logger.Error(err, "failed to delete notification topics", "bucketName", bucketName, "topics", topics)
+		return nil, rgwerr.Status(err, "failed to delete notification topics")
 	}
-	klog.InfoS("Successfully deleted Backend Bucket", "bucketName", bucketName)
 	return &cosispec.DriverDeleteBucketResponse{}, nil
 }
 
 func (s *provisionerServer) DriverGrantBucketAccess(ctx context.Context,
-	req *cosispec.DriverGrantBucketAccessRequest) (*cosispec.DriverGrantBucketAccessResponse, error) {
+	req *cosispec.DriverGrantBucketAccessRequest) (_ *cosispec.DriverGrantBucketAccessResponse, err error) {
 	// TODO : validate below details, Authenticationtype, Parameters
 	userName := req.GetName()
-	bucketName := req.GetBucketId()
-	klog.V(5).Infof("req %v", req)
-	klog.Info("Granting user accessPolicy to bucket ", "userName", userName, "bucketName", bucketName)
+	logger := klog.FromContext(ctx)
 	parameters := req.GetParameters()
 
-	s3Client, rgwAdminClient, err := initializeClients(ctx, s.Clientset, parameters)
+	var bucketName string
+	// the BucketAccess found for the owner user of a subuser is reused for the event
+	var bucketAccess *v1alpha1.BucketAccess
+	failureReason := AccessGrantFailedReason
+	defer func() {
+		lookup := s.bucketAccessByAccount(userName)
+		if bucketAccess != nil {
+			lookup = func(context.Context) (runtime.Object, error) { return bucketAccess, nil }
+		}
+		s.recordOutcome(ctx, lookup, err, AccessGrantedReason, fmt.Sprintf("Granted access to bucket %q", bucketName), failureReason)
+	}()
+
+	restrictions, err := parseUserRestrictions(parameters)
 	if err != nil {
-		klog.ErrorS(err, "failed to initialize clients")
-		return nil, status.Error(codes.Internal, "failed to initialize clients")
+		logger.Error(err, "invalid user restrictions")
+		return nil, err
 	}
 
-	user, err := rgwAdminClient.CreateUser(ctx, rgwadmin.User{
-		ID:          userName,
-		DisplayName: userName,
-	})
-
-	// TODO : Do we need fail for UserErrorExists, or same account can have multiple BAR
-	if err != nil && !errors.Is(err, rgwadmin.ErrUserExists) {
-		klog.ErrorS(err, "failed to create user")
-		return nil, status.Error(codes.Internal, "User creation failed")
+	// the access is granted on the backend of the bucket, the secret parameters of the class only apply to
+	// bucket IDs without a backend, which were created by older versions
+	backend, bucketName, ok := decodeID(req.GetBucketId())
+	if !ok {
+		backend, err = backendFromParameters(parameters)
+		if err != nil {
+			logger.Error(err, "invalid backend parameters")
+			return nil, err
+		}
 	}
+	logger.Info("Granting user accessPolicy to bucket", "userName", userName, "bucketName", bucketName)
 
-	policy, err := s3Client.GetBucketPolicy(bucketName)
+	s3Client, rgwAdminClient, err := s.Backends.initializeClients(ctx, s.Clientset, backend.parameters())
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != "NoSuchBucketPolicy" {
-			return nil, status.Error(codes.Internal, "fetching policy failed")
+		logger.Error(err, "failed to initialize clients")
+		return nil, status.Error(codes.Internal, "failed to initialize clients")
+	}
+	accessMode := parameters[accessModeParameter]
+	var ownerName string
+	if accessMode == accessModeSubuser {
+		bucketAccess, err = s.findBucketAccess(userName)
+		if err != nil {
+			logger.Error(err, "failed to find bucket access", "userName", userName)
+			return nil, status.Error(status.Code(err), "failed to find bucket access namespace")
+		}
+		ownerName = ownerUserPrefix + bucketAccess.Namespace
+	}
+	if s.DryRun {
+		p, err := s.planGrantBucketAccess(ctx, s3Client, rgwAdminClient, userName, ownerName, bucketName, accessMode, restrictions)
+		if err != nil {
+			logger.Error(err, "failed to plan bucket access", "userName", userName, "bucketName", bucketName)
+			return nil, err
 		}
+		return nil, s.dryRun(ctx, "grant/"+userName, p)
 	}
 
-	statement := s3client.NewPolicyStatement().
-		WithSID(userName).
-		ForPrincipals(userName).
-		ForResources(bucketName).
-		ForSubResources(bucketName).
-		Allows().
-		Actions(s3client.AllowedActions...)
+	var user rgwadmin.User
+	switch accessMode {
+	case "", accessModeUser:
+		user, err = ensureUser(ctx, rgwAdminClient, userName, ownershipMarker(s.Provisioner, s.ClusterID), restrictions)
+		if err != nil {
+			logger.Error(err, "failed to create user")
+			return nil, rgwerr.Status(err, "User creation failed")
+		}
+	case accessModeSubuser:
+		user, err = ensureSubuser(ctx, rgwAdminClient, ownerName, userName, ownershipMarker(s.Provisioner, s.ClusterID), restrictions)
+		if err != nil {
+			logger.Error(err, "failed to create subuser")
+			return nil, rgwerr.Status(err, "Subuser creation failed")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %q", accessModeParameter, accessMode)
+	}
+	credentials, err := fetchUserCredentials(user, rgwAdminClient.Endpoint, "")
+	if err != nil {
+		logger.Error(err, "failed to fetch user credentials", "userName", user.ID)
+		return nil, err
+	}
+
+	policy, err := s3Client.GetBucketPolicy(bucketName)
+	if err != nil && !rgwerr.HasCode(err, rgwerr.NoSuchBucketPolicy) {
+		logger.Error(err, "failed to fetch policy", "bucketName", bucketName)
+		failureReason = PolicyUpdateFailedReason
+		return nil, rgwerr.Status(err, "fetching policy failed")
+	}
+
+	statement := accessStatement(userName, user.ID, bucketName)
 	if policy == nil {
 		policy = s3client.NewBucketPolicy(*statement)
 	} else {
@@ -194,48 +470,138 @@ func (s *provisionerServer) DriverGrantBucketAccess(ctx context.Context,
 	}
 	_, err = s3Client.PutBucketPolicy(bucketName, *policy)
 	if err != nil {
-		klog.ErrorS(err, "failed to set policy")
-		return nil, status.Error(codes.Internal, "failed to set policy")
+		logger.Error(err, "failed to set policy")
+		failureReason = PolicyUpdateFailedReason
+		return nil, rgwerr.Status(err, "failed to set policy")
 	}
 
-	// TODO : limit the bucket count for this user to 0
-
 	// Below response if not final, may change in future
 	return &cosispec.DriverGrantBucketAccessResponse{
-		AccountId:   userName,
-		Credentials: fetchUserCredentials(user, rgwAdminClient.Endpoint, ""),
+		AccountId:   backend.encode(user.ID),
+		Credentials: credentials,
 	}, nil
 }
 
 func (s *provisionerServer) DriverRevokeBucketAccess(ctx context.Context,
-	req *cosispec.DriverRevokeBucketAccessRequest) (*cosispec.DriverRevokeBucketAccessResponse, error) {
-	klog.V(5).Infof("req %v", req)
-	bucketName := req.GetBucketId()
-	bucket, err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Get(ctx, bucketName, metav1.GetOptions{})
+	req *cosispec.DriverRevokeBucketAccessRequest) (_ *cosispec.DriverRevokeBucketAccessResponse, err error) {
+	logger := klog.FromContext(ctx)
+	failureReason := AccessRevokeFailedReason
+	defer func() {
+		_, accountID, _ := decodeID(req.GetAccountId())
+		s.recordOutcome(ctx, s.bucketAccessByAccount(accountName(accountID)), err, AccessRevokedReason, "Access revoked", failureReason)
+	}()
+	if req.GetAccountId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "account id is required")
+	}
+	parameters, bucketName, err := s.resolveBucket(ctx, req.GetBucketId())
 	if err != nil {
-		klog.ErrorS(err, "failed to get bucket", "bucketName", bucketName)
-		return nil, status.Error(codes.Internal, "failed to get bucket")
+		return nil, err
 	}
-
-	parameters := bucket.Spec.Parameters
-	_, rgwAdminClient, err := initializeClients(ctx, s.Clientset, parameters)
+	s3Client, rgwAdminClient, err := s.Backends.initializeClients(ctx, s.Clientset, parameters)
 	if err != nil {
-		klog.ErrorS(err, "failed to initialize clients")
+		logger.Error(err, "failed to initialize clients")
 		return nil, status.Error(codes.Internal, "failed to initialize clients")
 	}
 
-	userName := req.GetAccountId()
+	_, accountID, _ := decodeID(req.GetAccountId())
+	if s.DryRun {
+		p, err := planRevokeBucketAccess(ctx, s3Client, rgwAdminClient, bucketName, accountID)
+		if err != nil {
+			logger.Error(err, "failed to plan access revocation", "bucketName", bucketName, "accountID", accountID)
+			return nil, err
+		}
+		return nil, s.dryRun(ctx, "revoke/"+accountID, p)
+	}
+	userName, subuserID := splitAccountID(accountID)
+	if err := dropPolicyStatement(s3Client, bucketName, accountName(accountID)); err != nil {
+		logger.Error(err, "failed to remove policy statement", "bucketName", bucketName, "accountName", accountName(accountID))
+		failureReason = PolicyUpdateFailedReason
+		return nil, rgwerr.Status(err, "failed to remove policy statement")
+	}
+
+	if subuserID != "" {
+		// the owner user is shared with other accesses, only the subuser is removed
+		owner, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: userName})
+		if rgwerr.HasCode(err, rgwerr.NoSuchUser) {
+			logger.Info("owner user already deleted", "userName", userName)
+			return &cosispec.DriverRevokeBucketAccessResponse{}, nil
+		}
+		if err != nil {
+			logger.Error(err, "failed to get owner user", "userName", userName)
+			return nil, rgwerr.Status(err, "failed to get owner user")
+		}
+		if !hasSubuser(owner, subuserID) {
+			logger.Info("subuser already deleted", "subuser", subuserID)
+			return &cosispec.DriverRevokeBucketAccessResponse{}, nil
+		}
+
+		purgeKeys := true
+		err = rgwAdminClient.RemoveSubuser(ctx, rgwadmin.User{ID: userName}, rgwadmin.SubuserSpec{
+			Name:      subuserID,
+			PurgeKeys: &purgeKeys,
+		})
+		if err != nil {
+			logger.Error(err, "failed to delete subuser")
+			return nil, rgwerr.Status(err, "failed to delete subuser")
+		}
+		return &cosispec.DriverRevokeBucketAccessResponse{}, nil
+	}
 
 	// TODO : instead of deleting user, revoke its permission and delete only if no more bucket attached to it
 	err = rgwAdminClient.RemoveUser(ctx, rgwadmin.User{ID: userName})
+	if rgwerr.HasCode(err, rgwerr.NoSuchUser) {
+		logger.Info("user already deleted", "userName", userName)
+		return &cosispec.DriverRevokeBucketAccessResponse{}, nil
+	}
 	if err != nil {
-		klog.ErrorS(err, "failed to delete user")
-		return nil, status.Error(codes.Internal, "failed to delete user")
+		logger.Error(err, "failed to delete user")
+		return nil, rgwerr.Status(err, "failed to delete user")
 	}
 	return &cosispec.DriverRevokeBucketAccessResponse{}, nil
 }
 
-func fetchUserCredentials(user rgwadmin.User, endpoint string, region string) map[string]*cosispec.CredentialDetails {
+// accessStatement is the bucket policy statement granting an account access to the bucket,
+// identified by the account name and naming the RGW user or subuser as principal
+func accessStatement(accountName, principal, bucketName string) *s3client.PolicyStatement {
+	return s3client.NewPolicyStatement().
+		WithSID(accountName).
+		ForPrincipals(principal).
+		ForResources(bucketName).
+		ForSubResources(bucketName).
+		Allows().
+		Actions(s3client.AllowedActions...)
+}
+
+// dropPolicyStatement removes the statement granting the account access from the bucket policy.
+// A missing bucket, policy or statement is not an error.
+func dropPolicyStatement(s3Client *s3client.S3Agent, bucketName, accountName string) error {
+	policy, err := s3Client.GetBucketPolicy(bucketName)
+	if rgwerr.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, statement := range policy.Statement {
+		if statement.Sid == accountName {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	_, err = s3Client.PutBucketPolicy(bucketName, *policy.DropPolicyStatements(accountName))
+	if rgwerr.HasCode(err, rgwerr.NoSuchBucket) {
+		return nil
+	}
+	return err
+}
+
+func fetchUserCredentials(user rgwadmin.User, endpoint string, region string) (map[string]*cosispec.CredentialDetails, error) {
+	if len(user.Keys) == 0 {
+		return nil, status.Errorf(codes.Internal, "no s3 keys found for user %q", user.ID)
+	}
 	s3Keys := make(map[string]string)
 	s3Keys["accessKeyID"] = user.Keys[0].AccessKey
 	s3Keys["accessSecretKey"] = user.Keys[0].SecretKey
@@ -246,36 +612,47 @@ func fetchUserCredentials(user rgwadmin.User, endpoint string, region string) ma
 	}
 	credDetails := make(map[string]*cosispec.CredentialDetails)
 	credDetails["s3"] = creds
-	return credDetails
+	return credDetails, nil
 }
 
-func InitializeClients(ctx context.Context, clientset *kubernetes.Clientset, parameters map[string]string) (*s3client.S3Agent, *rgwadmin.API, error) {
-	klog.V(5).Infof("Initializing clients %v", parameters)
+func InitializeClients(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string, s3Options s3client.Options) (*s3client.S3Agent, *rgwadmin.API, error) {
+	klog.V(5).InfoS("Initializing clients", "parameters", redact.Map(parameters))
 
 	objectStoreUserSecretName, namespace, err := fetchSecretNameAndNamespace(parameters)
 	if err != nil {
 		return nil, nil, err
 	}
+	if clientset == nil {
+		return nil, nil, kubernetesRequired(fmt.Sprintf("object store user secret %s/%s outside the backend config", namespace, objectStoreUserSecretName))
+	}
 
 	objectStoreUserSecret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, objectStoreUserSecretName, metav1.GetOptions{})
 	if err != nil {
-		klog.ErrorS(err, "failed to get object store user secret")
+		klog.FromContext(ctx).Error(err, "failed to get object store user secret")
 		return nil, nil, status.Error(codes.Internal, "failed to get object store user secret")
 	}
+	return newClients(objectStoreUserSecret.Data, s3Options)
+}
 
-	accessKey, secretKey, rgwEndpoint, _, err := fetchParameters(objectStoreUserSecret.Data)
+// newClients creates the clients of a backend from the data of its object store user secret
+func newClients(secretData map[string][]byte, s3Options s3client.Options) (*s3client.S3Agent, *rgwadmin.API, error) {
+	accessKey, secretKey, rgwEndpoint, _, err := fetchParameters(secretData)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// TODO : validate endpoint and support TLS certs
 
-	rgwAdminClient, err := rgwadmin.New(rgwEndpoint, accessKey, secretKey, nil)
+	adminHTTPClient := &http.Client{
+		Timeout:   s3Options.RequestTimeout(),
+		Transport: s3Options.Breakers.Transport(rgwEndpoint, http.DefaultTransport),
+	}
+	rgwAdminClient, err := rgwadmin.New(rgwEndpoint, accessKey, secretKey, adminHTTPClient)
 	if err != nil {
 		klog.ErrorS(err, "failed to create rgw admin client")
 		return nil, nil, status.Error(codes.Internal, "failed to create rgw admin client")
 	}
-	s3Client, err := s3client.NewS3Agent(accessKey, secretKey, rgwEndpoint, nil, true)
+	s3Client, err := s3client.NewS3AgentWithOptions(accessKey, secretKey, rgwEndpoint, nil, s3Options)
 	if err != nil {
 		klog.ErrorS(err, "failed to create s3 client")
 		return nil, nil, status.Error(codes.Internal, "failed to create s3 client")
@@ -296,10 +673,10 @@ func fetchParameters(secretData map[string][]byte) (string, string, string, stri
 }
 
 func fetchSecretNameAndNamespace(parameters map[string]string) (string, string, error) {
-	secretName := parameters["objectStoreUserSecretName"]
+	secretName := parameters[objectStoreUserSecretNameParameter]
 	namespace := os.Getenv("POD_NAMESPACE")
-	if parameters["objectStoreUserSecretNamespace"] != "" {
-		namespace = parameters["objectStoreUserSecretNamespace"]
+	if parameters[objectStoreUserSecretNamespaceParameter] != "" {
+		namespace = parameters[objectStoreUserSecretNamespaceParameter]
 	}
 	if secretName == "" || namespace == "" {
 		return "", "", status.Error(codes.InvalidArgument, "objectStoreUserSecretName and Namespace is required")
@@ -22,14 +22,28 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ceph/cosi-driver-ceph/pkg/util/breaker"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/fakergw"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/redact"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
 	s3cli "github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
 
 	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2"
 	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
 	fakebucketclientset "sigs.k8s.io/container-object-storage-interface/client/clientset/versioned/fake"
 	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
@@ -87,6 +101,38 @@ func createParameters() map[string]string {
 		"objectStoreUserSecretNamespace": "test-namespace",
 	}
 }
+
+// newFakeRGWServer starts a fake RGW and returns it with a provisioner server reaching it through the
+// test-user-secret of test-namespace, the objects are added to the COSI clientset and the object index of the server
+func newFakeRGWServer(t *testing.T, objects ...runtime.Object) (*fakergw.Server, *provisionerServer) {
+	t.Helper()
+	previous := initializeClients
+	initializeClients = InitializeClients
+	srv := fakergw.New()
+	t.Cleanup(func() {
+		srv.Close()
+		initializeClients = previous
+	})
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-user-secret", Namespace: "test-namespace"},
+		Data:       srv.SecretData(),
+	}
+	bucketClientset := fakebucketclientset.NewSimpleClientset(objects...)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	index, err := newObjectIndex(ctx, bucketClientset)
+	if err != nil {
+		t.Fatalf("newObjectIndex() error = %v", err)
+	}
+	return srv, &provisionerServer{
+		Provisioner:     "ceph.objectstorage.k8s.io",
+		Clientset:       fakekubeclientset.NewSimpleClientset(secret),
+		BucketClientset: bucketClientset,
+		Objects:         index,
+	}
+}
+
 func Test_provisionerServer_DriverCreateBucket(t *testing.T) {
 	type fields struct {
 		provisioner string
@@ -97,17 +143,49 @@ func Test_provisionerServer_DriverCreateBucket(t *testing.T) {
 		req *cosispec.DriverCreateBucketRequest
 	}
 
-	initializeClients = func(ctx context.Context, clientset *kubernetes.Clientset, parameters map[string]string) (*s3cli.S3Agent, *rgwadmin.API, error) {
+	initializeClients = func(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string, s3Options s3cli.Options) (*s3cli.S3Agent, *rgwadmin.API, error) {
 		_, _, err := fetchSecretNameAndNamespace(parameters)
 		if err != nil {
 			t.Fatalf("failed to fetch secret name and namespace: %v", err)
 		}
 		s3Client := &s3cli.S3Agent{
-			Client: mockS3Client{},
+			Client:    mockS3Client{},
+			SNSClient: mockSNSClient{},
 		}
-		return s3Client, nil, nil
+		mockClient := &MockClient{
+			MockDo: func(req *http.Request) (*http.Response, error) {
+				switch {
+				case req.Method == http.MethodGet && req.URL.RawQuery == "access-key=accesskey&format=json":
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(`{"user_id":"cosi-admin"}`))),
+					}, nil
+				case req.Method == http.MethodGet && req.URL.Query().Get("bucket") == "test-bucket-already-exists":
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(`{"bucket":"test-bucket-already-exists","owner":"other-user"}`))),
+					}, nil
+				case req.Method == http.MethodGet && req.URL.Query().Get("bucket") == "test-bucket-owned-by-you":
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(`{"bucket":"test-bucket-owned-by-you","owner":"cosi-admin","bucket_quota":{"enabled":false,"max_size":-1,"max_objects":-1}}`))),
+					}, nil
+				}
+				return nil, fmt.Errorf("unexpected request: %q. method %q. path %q", req.URL.RawQuery, req.Method, req.URL.Path)
+			},
+		}
+		rgwAdminClient, err := rgwadmin.New("rgw-my-store:8000", "accesskey", "secretkey", mockClient)
+		if err != nil {
+			t.Fatalf("failed to create rgw admin client: %v", err)
+		}
+		return s3Client, rgwAdminClient, nil
 	}
 
+	quotaParameters := createParameters()
+	quotaParameters[bucketMaxObjectsParameter] = "100"
+	invalidParameters := createParameters()
+	invalidParameters[bucketMaxSizeParameter] = "lots"
+
 	tests := []struct {
 		name    string
 		fields  fields
@@ -116,15 +194,19 @@ func Test_provisionerServer_DriverCreateBucket(t *testing.T) {
 		wantErr bool
 	}{
 		{"Empty Bucket Name", fields{"CreateBucket Empty Bucket Name"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "", Parameters: createParameters()}}, nil, true},
-		{"Create Bucket success", fields{"CreateBucket Success"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: createParameters()}}, &cosispec.DriverCreateBucketResponse{BucketId: "test-bucket"}, false},
+		{"Create Bucket success", fields{"CreateBucket Success"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: createParameters()}}, &cosispec.DriverCreateBucketResponse{BucketId: "test-namespace/test-user-secret/test-bucket"}, false},
 		{"Create Bucket failure", fields{"CreateBucket Failure"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "failed-bucket", Parameters: createParameters()}}, nil, true},
 		{"Bucket already Exists", fields{"CreateBucket Already Exists"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "test-bucket-already-exists", Parameters: createParameters()}}, nil, true},
 		{"Bucket owned same user", fields{"CreateBucket Owned by same user"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "test-bucket-owned-by-same-user", Parameters: createParameters()}}, nil, true},
+		{"Bucket owned by driver", fields{"CreateBucket Owned by driver"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "test-bucket-owned-by-you", Parameters: createParameters()}}, &cosispec.DriverCreateBucketResponse{BucketId: "test-namespace/test-user-secret/test-bucket-owned-by-you"}, false},
+		{"Bucket owned by driver failing to apply config", fields{"CreateBucket Owned by driver failing config"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "test-bucket-owned-by-you", Parameters: quotaParameters}}, nil, true},
+		{"Invalid bucket config", fields{"CreateBucket Invalid config"}, args{context.Background(), &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: invalidParameters}}, nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &provisionerServer{
-				Provisioner: tt.fields.provisioner,
+				Provisioner:     tt.fields.provisioner,
+				BucketClientset: fakebucketclientset.NewSimpleClientset(),
 			}
 			got, err := s.DriverCreateBucket(tt.args.ctx, tt.args.req)
 			if (err != nil) != tt.wantErr {
@@ -146,7 +228,7 @@ func Test_provisionerServer_DriverGrantBucketAccess(t *testing.T) {
 		ctx context.Context
 		req *cosispec.DriverGrantBucketAccessRequest
 	}
-	initializeClients = func(ctx context.Context, clientset *kubernetes.Clientset, parameters map[string]string) (*s3cli.S3Agent, *rgwadmin.API, error) {
+	initializeClients = func(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string, s3Options s3cli.Options) (*s3cli.S3Agent, *rgwadmin.API, error) {
 		_, _, err := fetchSecretNameAndNamespace(parameters)
 		if err != nil {
 			t.Fatalf("failed to fetch secret name and namespace: %v", err)
@@ -158,7 +240,15 @@ func Test_provisionerServer_DriverGrantBucketAccess(t *testing.T) {
 		mockClient := &MockClient{
 			MockDo: func(req *http.Request) (*http.Response, error) {
 				if req.Method == http.MethodPut {
-					if req.URL.RawQuery == "display-name=test-user&format=json&uid=test-user" {
+					if req.URL.RawQuery == "display-name=test-user&format=json&max-buckets=-1&uid=test-user" {
+						return &http.Response{
+							StatusCode: 200,
+							Body:       io.NopCloser(bytes.NewReader([]byte(userCreateJSON))),
+						}, nil
+					}
+				}
+				if req.Method == http.MethodPost {
+					if req.URL.RawQuery == "format=json&max-buckets=-1&uid=test-user" {
 						return &http.Response{
 							StatusCode: 200,
 							Body:       io.NopCloser(bytes.NewReader([]byte(userCreateJSON))),
@@ -179,6 +269,10 @@ func Test_provisionerServer_DriverGrantBucketAccess(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to unmarshal user create json: %v", err)
 	}
+	credentials, err := fetchUserCredentials(u, "rgw-my-store:8000", "")
+	if err != nil {
+		t.Fatalf("failed to fetch user credentials: %v", err)
+	}
 	tests := []struct {
 		name    string
 		fields  fields
@@ -188,7 +282,7 @@ func Test_provisionerServer_DriverGrantBucketAccess(t *testing.T) {
 	}{
 		{"Empty Bucket Name", fields{"GrantBucketAccess Empty Bucket Name"}, args{context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "", Name: "test-user", Parameters: createParameters()}}, nil, true},
 		{"Empty User Name", fields{"GrantBucketAccess Empty User Name"}, args{context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "", Parameters: createParameters()}}, nil, true},
-		{"Grant Bucket Access success", fields{"GrantBucketAccess Success"}, args{context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "test-user", Parameters: createParameters()}}, &cosispec.DriverGrantBucketAccessResponse{AccountId: "test-user", Credentials: fetchUserCredentials(u, "rgw-my-store:8000", "")}, false},
+		{"Grant Bucket Access success", fields{"GrantBucketAccess Success"}, args{context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "test-user", Parameters: createParameters()}}, &cosispec.DriverGrantBucketAccessResponse{AccountId: "test-namespace/test-user-secret/test-user", Credentials: credentials}, false},
 		{"Grant Bucket Access failure", fields{"GrantBucketAccess Failure"}, args{context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "failed-bucket", Name: "test-user", Parameters: createParameters()}}, nil, true},
 		{"Bucket does not exist", fields{"GrantBucketAccess Does not exist"}, args{context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket-does-not-exist", Name: "test-user", Parameters: createParameters()}}, nil, true},
 		{"User does not exist", fields{"GrantBucketAccess User Does not exist"}, args{context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "test-user-does-not-exist", Parameters: createParameters()}}, nil, true},
@@ -210,6 +304,118 @@ func Test_provisionerServer_DriverGrantBucketAccess(t *testing.T) {
 	}
 }
 
+func Test_provisionerServer_DriverGrantBucketAccess_AccessModes(t *testing.T) {
+	var adminRequests []string
+	initializeClients = func(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string, s3Options s3cli.Options) (*s3cli.S3Agent, *rgwadmin.API, error) {
+		s3Client := &s3cli.S3Agent{
+			Client: mockS3Client{},
+		}
+		respond := func(code int, body string) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: code,
+				Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+			}, nil
+		}
+		mockClient := &MockClient{
+			MockDo: func(req *http.Request) (*http.Response, error) {
+				q := req.URL.Query()
+				switch {
+				case req.Method == http.MethodPost || (req.Method == http.MethodPut && q.Has("quota")):
+					adminRequests = append(adminRequests, req.Method+" "+req.URL.RawQuery)
+					return respond(200, `{}`)
+				case req.Method == http.MethodPut && q.Has("key"):
+					return respond(200, `[{"user":"cosi-test-namespace:ba-1234","access_key":"SubAccessKey","secret_key":"SubSecretKey"}]`)
+				case req.Method == http.MethodPut && q.Has("subuser"):
+					return respond(200, `[]`)
+				case req.Method == http.MethodPut && q.Get("uid") == "existing-user":
+					return respond(409, `{"Code":"UserAlreadyExists"}`)
+				case req.Method == http.MethodPut && q.Get("uid") == "keyless-user":
+					return respond(200, `{"user_id":"keyless-user","keys":[]}`)
+				case q.Get("uid") == "cosi-test-namespace":
+					return respond(200, `{"user_id":"cosi-test-namespace","keys":[]}`)
+				case req.Method == http.MethodGet && q.Get("uid") == "existing-user":
+					return respond(200, `{"user_id":"existing-user","keys":[{"user":"existing-user","access_key":"ExistingAccessKey","secret_key":"ExistingSecretKey"}]}`)
+				}
+				return nil, fmt.Errorf("unexpected request: %q. method %q. path %q", req.URL.RawQuery, req.Method, req.URL.Path)
+			},
+		}
+		rgwAdminClient, err := rgwadmin.New("rgw-my-store:8000", "accesskey", "secretkey", mockClient)
+		if err != nil {
+			t.Fatalf("failed to create rgw admin client: %v", err)
+		}
+		return s3Client, rgwAdminClient, nil
+	}
+	subuserParameters := createParameters()
+	subuserParameters[accessModeParameter] = accessModeSubuser
+	invalidParameters := createParameters()
+	invalidParameters[accessModeParameter] = "invalid"
+	restrictedParameters := createParameters()
+	restrictedParameters[maxBucketsParameter] = "0"
+	restrictedParameters[userQuotaMaxSizeParameter] = "1Ki"
+	restrictedParameters[opMaskParameter] = "read"
+	bucketAccess := &v1alpha1.BucketAccess{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-access", Namespace: "test-namespace", UID: "1234"},
+	}
+	bucketClientset := fakebucketclientset.NewSimpleClientset(bucketAccess)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	index, err := newObjectIndex(ctx, bucketClientset)
+	if err != nil {
+		t.Fatalf("newObjectIndex() error = %v", err)
+	}
+
+	tests := []struct {
+		name              string
+		req               *cosispec.DriverGrantBucketAccessRequest
+		wantUser          string
+		wantKey           string
+		wantErr           bool
+		wantErrMsg        string
+		wantAdminRequests []string
+	}{
+		{"Existing user", &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "existing-user", Parameters: createParameters()}, "test-namespace/test-user-secret/existing-user", "ExistingAccessKey", false, "", []string{"POST format=json&max-buckets=-1&uid=existing-user"}},
+		{"Existing user with restrictions", &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "existing-user", Parameters: restrictedParameters}, "test-namespace/test-user-secret/existing-user", "ExistingAccessKey", false, "", []string{
+			"POST format=json&max-buckets=0&uid=existing-user",
+			"PUT enabled=true&format=json&max-objects=-1&max-size=1024&quota=&quota-type=user&uid=existing-user",
+			"POST format=json&op-mask=read&uid=existing-user",
+		}},
+		{"Invalid restrictions", &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "existing-user", Parameters: map[string]string{maxBucketsParameter: "none"}}, "", "", true, `invalid maxBuckets "none": strconv.Atoi: parsing "none": invalid syntax`, nil},
+		{"User without keys", &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "keyless-user", Parameters: createParameters()}, "", "", true, `no s3 keys found for user "keyless-user"`, []string{"POST format=json&max-buckets=-1&uid=keyless-user"}},
+		{"Subuser", &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "ba-1234", Parameters: subuserParameters}, "test-namespace/test-user-secret/cosi-test-namespace:ba-1234", "SubAccessKey", false, "", []string{"POST format=json&max-buckets=-1&uid=cosi-test-namespace"}},
+		{"Subuser unknown bucket access", &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "ba-5678", Parameters: subuserParameters}, "", "", true, `failed to find bucket access namespace`, nil},
+		{"Invalid access mode", &cosispec.DriverGrantBucketAccessRequest{BucketId: "test-bucket", Name: "existing-user", Parameters: invalidParameters}, "", "", true, `unsupported accessMode "invalid"`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &provisionerServer{
+				Provisioner:     "GrantBucketAccess AccessModes",
+				BucketClientset: bucketClientset,
+				Objects:         index,
+			}
+			adminRequests = nil
+			got, err := s.DriverGrantBucketAccess(context.Background(), tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(adminRequests, tt.wantAdminRequests) {
+				t.Errorf("provisionerServer.DriverGrantBucketAccess() admin requests = %v, want %v", adminRequests, tt.wantAdminRequests)
+			}
+			if tt.wantErr {
+				if status.Convert(err).Message() != tt.wantErrMsg {
+					t.Errorf("provisionerServer.DriverGrantBucketAccess() error = %v, want %v", status.Convert(err).Message(), tt.wantErrMsg)
+				}
+				return
+			}
+			if got.AccountId != tt.wantUser {
+				t.Errorf("provisionerServer.DriverGrantBucketAccess() AccountId = %v, want %v", got.AccountId, tt.wantUser)
+			}
+			if key := got.Credentials["s3"].Secrets["accessKeyID"]; key != tt.wantKey {
+				t.Errorf("provisionerServer.DriverGrantBucketAccess() accessKeyID = %v, want %v", key, tt.wantKey)
+			}
+		})
+	}
+}
+
 func Test_provisionerServer_DriverDeleteBucket(t *testing.T) {
 	type fields struct {
 		provisioner string
@@ -220,13 +426,14 @@ func Test_provisionerServer_DriverDeleteBucket(t *testing.T) {
 		req *cosispec.DriverDeleteBucketRequest
 	}
 
-	initializeClients = func(ctx context.Context, clientset *kubernetes.Clientset, parameters map[string]string) (*s3cli.S3Agent, *rgwadmin.API, error) {
+	initializeClients = func(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string, s3Options s3cli.Options) (*s3cli.S3Agent, *rgwadmin.API, error) {
 		_, _, err := fetchSecretNameAndNamespace(parameters)
 		if err != nil {
 			t.Fatalf("failed to fetch secret name and namespace: %v", err)
 		}
 		s3Client := &s3cli.S3Agent{
-			Client: mockS3Client{},
+			Client:    mockS3Client{},
+			SNSClient: mockSNSClient{},
 		}
 		return s3Client, nil, nil
 	}
@@ -240,8 +447,8 @@ func Test_provisionerServer_DriverDeleteBucket(t *testing.T) {
 	}{
 		{"Empty Bucket Name", fields{"DeleteBucket Empty Bucket Name"}, args{context.Background(), &cosispec.DriverDeleteBucketRequest{BucketId: ""}}, nil, true},
 		{"Delete Bucket success", fields{"DeleteBucket Success"}, args{context.Background(), &cosispec.DriverDeleteBucketRequest{BucketId: "test-bucket"}}, &cosispec.DriverDeleteBucketResponse{}, false},
-		{"Delete Bucket failure", fields{"DeleteBucket Failure"}, args{context.Background(), &cosispec.DriverDeleteBucketRequest{BucketId: "failed-bucket"}}, nil, true},
-		{"Bucket does not exist", fields{"DeleteBucket Does not exist"}, args{context.Background(), &cosispec.DriverDeleteBucketRequest{BucketId: "test-bucket-does-not-exist"}}, nil, true},
+		{"Delete Bucket failure", fields{"DeleteBucket Failure"}, args{context.Background(), &cosispec.DriverDeleteBucketRequest{BucketId: "test-bucket-fail-internal"}}, nil, true},
+		{"Bucket does not exist", fields{"DeleteBucket Does not exist"}, args{context.Background(), &cosispec.DriverDeleteBucketRequest{BucketId: "test-bucket-does-not-exist"}}, &cosispec.DriverDeleteBucketResponse{}, false},
 		{"Bucket not empty", fields{"DeleteBucket Not Empty"}, args{context.Background(), &cosispec.DriverDeleteBucketRequest{BucketId: "test-bucket-not-empty"}}, nil, true},
 	}
 
@@ -282,7 +489,7 @@ func Test_provisonerServer_DriverRevokeBucketAccess(t *testing.T) {
 		req *cosispec.DriverRevokeBucketAccessRequest
 	}
 
-	initializeClients = func(ctx context.Context, clientset *kubernetes.Clientset, parameters map[string]string) (*s3cli.S3Agent, *rgwadmin.API, error) {
+	initializeClients = func(ctx context.Context, clientset kubernetes.Interface, parameters map[string]string, s3Options s3cli.Options) (*s3cli.S3Agent, *rgwadmin.API, error) {
 		_, _, err := fetchSecretNameAndNamespace(parameters)
 		if err != nil {
 			t.Fatalf("failed to fetch secret name and namespace: %v", err)
@@ -293,12 +500,25 @@ func Test_provisonerServer_DriverRevokeBucketAccess(t *testing.T) {
 		mockClient := &MockClient{
 			MockDo: func(req *http.Request) (*http.Response, error) {
 				if req.Method == http.MethodDelete {
-					if req.URL.RawQuery == "format=json&uid=test-user" {
+					if req.URL.RawQuery == "format=json&uid=test-user" ||
+						req.URL.RawQuery == "format=json&purge-keys=true&subuser=cosi-test-namespace%3Aba-1234&uid=cosi-test-namespace" {
 						return &http.Response{
 							StatusCode: 200,
 							Body:       io.NopCloser(bytes.NewReader([]byte(`[]`))),
 						}, nil
 					}
+					if req.URL.RawQuery == "format=json&uid=removed-user" {
+						return &http.Response{
+							StatusCode: 404,
+							Body:       io.NopCloser(bytes.NewReader([]byte(`{"Code":"NoSuchUser"}`))),
+						}, nil
+					}
+				}
+				if req.Method == http.MethodGet && req.URL.RawQuery == "format=json&uid=cosi-test-namespace" {
+					return &http.Response{
+						StatusCode: 200,
+						Body:       io.NopCloser(bytes.NewReader([]byte(`{"user_id":"cosi-test-namespace","subusers":[{"id":"cosi-test-namespace:ba-1234","permissions":"full-control"}]}`))),
+					}, nil
 				}
 				return nil, fmt.Errorf("unexpected request: %q. method %q. path %q", req.URL.RawQuery, req.Method, req.URL.Path)
 			},
@@ -320,6 +540,10 @@ func Test_provisonerServer_DriverRevokeBucketAccess(t *testing.T) {
 	}{
 		{"Empty User Name", fields{"RevokeBucketAccess Empty User Name"}, args{context.Background(), &cosispec.DriverRevokeBucketAccessRequest{BucketId: "test-bucket", AccountId: ""}}, nil, true},
 		{"Revoke Bucket Access success", fields{"RevokeBucketAccess Success"}, args{context.Background(), &cosispec.DriverRevokeBucketAccessRequest{BucketId: "test-bucket", AccountId: "test-user"}}, &cosispec.DriverRevokeBucketAccessResponse{}, false},
+		{"Revoke Subuser Access success", fields{"RevokeBucketAccess Subuser Success"}, args{context.Background(), &cosispec.DriverRevokeBucketAccessRequest{BucketId: "test-bucket", AccountId: "cosi-test-namespace:ba-1234"}}, &cosispec.DriverRevokeBucketAccessResponse{}, false},
+		{"Revoke removed user", fields{"RevokeBucketAccess Removed User"}, args{context.Background(), &cosispec.DriverRevokeBucketAccessRequest{BucketId: "test-bucket", AccountId: "removed-user"}}, &cosispec.DriverRevokeBucketAccessResponse{}, false},
+		{"Revoke removed subuser", fields{"RevokeBucketAccess Removed Subuser"}, args{context.Background(), &cosispec.DriverRevokeBucketAccessRequest{BucketId: "test-bucket", AccountId: "cosi-test-namespace:ba-5678"}}, &cosispec.DriverRevokeBucketAccessResponse{}, false},
+		{"Revoke encoded Bucket Access success", fields{"RevokeBucketAccess Encoded Success"}, args{context.Background(), &cosispec.DriverRevokeBucketAccessRequest{BucketId: "test-namespace/test-user-secret/test-bucket", AccountId: "test-namespace/test-user-secret/test-user"}}, &cosispec.DriverRevokeBucketAccessResponse{}, false},
 		{"Revoke Bucket Access failure", fields{"RevokeBucketAccess Failure"}, args{context.Background(), &cosispec.DriverRevokeBucketAccessRequest{BucketId: "failed-bucket", AccountId: "failed-user"}}, nil, true},
 	}
 
@@ -350,3 +574,235 @@ func Test_provisonerServer_DriverRevokeBucketAccess(t *testing.T) {
 		})
 	}
 }
+
+func Test_provisionerServer_Lifecycle_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	ctx := context.Background()
+
+	created, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: createParameters()})
+	if err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	bucketID := created.BucketId
+	if bucketID != "test-namespace/test-user-secret/test-bucket" {
+		t.Errorf("bucket id = %v, want test-namespace/test-user-secret/test-bucket", bucketID)
+	}
+	if b, ok := srv.Bucket("test-bucket"); !ok || b.Owner != fakergw.AdminUser {
+		t.Fatalf("bucket = %+v, found %v, want owned by %s", b, ok, fakergw.AdminUser)
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: createParameters()}); err != nil {
+		t.Errorf("provisionerServer.DriverCreateBucket() retry error = %v", err)
+	}
+	quotaParameters := createParameters()
+	quotaParameters[bucketMaxObjectsParameter] = "10"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: quotaParameters}); err != nil {
+		t.Errorf("provisionerServer.DriverCreateBucket() with different config error = %v", err)
+	}
+	if b, _ := srv.Bucket("test-bucket"); b.Quota.MaxObjects == nil || *b.Quota.MaxObjects != 10 {
+		t.Errorf("bucket quota = %+v, want max objects 10 applied to the existing bucket", b.Quota)
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "quota-bucket", Parameters: quotaParameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if b, _ := srv.Bucket("quota-bucket"); b.Quota.MaxObjects == nil || *b.Quota.MaxObjects != 10 {
+		t.Errorf("bucket quota = %+v, want max objects 10", b.Quota)
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "quota-bucket", Parameters: quotaParameters}); err != nil {
+		t.Errorf("provisionerServer.DriverCreateBucket() retry with quota error = %v", err)
+	}
+
+	grant, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: bucketID, Name: "ba-1234", Parameters: createParameters()})
+	if err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+	if grant.AccountId != "test-namespace/test-user-secret/ba-1234" {
+		t.Errorf("account id = %v, want test-namespace/test-user-secret/ba-1234", grant.AccountId)
+	}
+	u, ok := srv.User("ba-1234")
+	if !ok {
+		t.Fatalf("user ba-1234 not created")
+	}
+	if u.MaxBuckets != defaultMaxBuckets {
+		t.Errorf("max buckets = %v, want %v", u.MaxBuckets, defaultMaxBuckets)
+	}
+
+	creds := grant.Credentials["s3"].Secrets
+	userClient, err := s3cli.NewS3Agent(creds["accessKeyID"], creds["accessSecretKey"], creds["endpoint"], nil, false)
+	if err != nil {
+		t.Fatalf("failed to create s3 client: %v", err)
+	}
+	if _, err := userClient.PutObjectInBucket("test-bucket", "data", "key", "text/plain"); err != nil {
+		t.Errorf("granted user failed to put object: %v", err)
+	}
+	if err := userClient.CreateBucket("other-bucket"); err == nil {
+		t.Errorf("granted user created a bucket despite max buckets %d", defaultMaxBuckets)
+	}
+
+	if _, err := s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{BucketId: bucketID, AccountId: grant.AccountId}); err != nil {
+		t.Fatalf("provisionerServer.DriverRevokeBucketAccess() error = %v", err)
+	}
+	if _, ok := srv.User("ba-1234"); ok {
+		t.Errorf("user ba-1234 not removed")
+	}
+
+	if b, _ := srv.Bucket("test-bucket"); strings.Contains(b.Policy, "ba-1234") {
+		t.Errorf("policy = %s, want statement of ba-1234 removed", b.Policy)
+	}
+	if _, err := s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{BucketId: bucketID, AccountId: grant.AccountId}); err != nil {
+		t.Errorf("provisionerServer.DriverRevokeBucketAccess() retry error = %v", err)
+	}
+
+	if _, err := s.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: bucketID}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("provisionerServer.DriverDeleteBucket() of a non empty bucket error = %v, want %v", err, codes.FailedPrecondition)
+	}
+	if b, _ := srv.Bucket("test-bucket"); string(b.Objects["key"]) != "data" {
+		t.Errorf("object = %q, want %q", b.Objects["key"], "data")
+	}
+}
+
+func Test_newClients_S3Debug_FakeRGW(t *testing.T) {
+	srv := fakergw.New()
+	defer srv.Close()
+
+	logs := &bytes.Buffer{}
+	klog.LogToStderr(false)
+	klog.SetOutput(logs)
+	defer func() {
+		klog.SetOutput(io.Discard)
+		klog.LogToStderr(true)
+	}()
+
+	for _, debug := range []bool{false, true} {
+		logs.Reset()
+		s3Client, _, err := newClients(srv.SecretData(), s3cli.Options{Debug: debug})
+		if err != nil {
+			t.Fatalf("newClients() error = %v", err)
+		}
+		if _, err := s3Client.ListBuckets(); err != nil {
+			t.Fatalf("failed to list buckets: %v", err)
+		}
+		klog.Flush()
+		output := logs.String()
+		if debug != strings.Contains(output, "DEBUG: Request") {
+			t.Errorf("debug %v logged %q", debug, output)
+		}
+		if strings.Contains(output, fakergw.AdminAccessKey) || strings.Contains(output, "Signature=") {
+			t.Errorf("credentials not redacted from %q", output)
+		}
+		if debug && !strings.Contains(output, "Authorization: "+redact.Mask) {
+			t.Errorf("Authorization header not redacted in %q", output)
+		}
+	}
+}
+
+func Test_newClients_S3Options(t *testing.T) {
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	maxRetries := 2
+	data := map[string][]byte{"Endpoint": []byte(srv.URL), "AccessKey": []byte("access"), "SecretKey": []byte("secret")}
+	s3Client, _, err := newClients(data, s3cli.Options{MaxRetries: &maxRetries, Region: "eu-central", UserAgent: "cosi-test"})
+	if err != nil {
+		t.Fatalf("newClients() error = %v", err)
+	}
+	if _, err := s3Client.GetObjectInBucket("bucket", "key"); err == nil {
+		t.Fatalf("S3Agent.GetObjectInBucket() of a failing endpoint succeeded")
+	}
+	if len(requests) != maxRetries+1 {
+		t.Fatalf("sent %d requests, want %d", len(requests), maxRetries+1)
+	}
+	r := requests[0]
+	if !strings.HasPrefix(r.URL.Path, "/bucket") {
+		t.Errorf("path = %s, want the bucket in the path", r.URL.Path)
+	}
+	if !strings.Contains(r.Header.Get("Authorization"), "/eu-central/s3/") {
+		t.Errorf("Authorization = %s, want a signature for region eu-central", r.Header.Get("Authorization"))
+	}
+	if !strings.HasSuffix(r.Header.Get("User-Agent"), "cosi-test") {
+		t.Errorf("User-Agent = %s, want it to end with cosi-test", r.Header.Get("User-Agent"))
+	}
+}
+
+func Test_newClients_Breaker(t *testing.T) {
+	var mu sync.Mutex
+	requests, inFlight, maxInFlight, healthy := 0, 0, 0, false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		ok := healthy
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+	sent := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	maxRetries := 0
+	data := map[string][]byte{"Endpoint": []byte(srv.URL), "AccessKey": []byte("access"), "SecretKey": []byte("secret")}
+	options := s3cli.Options{
+		MaxRetries: &maxRetries,
+		Breakers:   breaker.NewSet(breaker.Options{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond, MaxInFlight: 1}),
+	}
+	s3Client, rgwAdminClient, err := newClients(data, options)
+	if err != nil {
+		t.Fatalf("newClients() error = %v", err)
+	}
+
+	// both clients of the backend count towards the circuit
+	if _, err := s3Client.GetObjectInBucket("bucket", "key"); err == nil {
+		t.Fatalf("S3Agent.GetObjectInBucket() of a failing backend succeeded")
+	}
+	if _, err := rgwAdminClient.GetUser(context.Background(), rgwadmin.User{ID: "user"}); err == nil {
+		t.Fatalf("API.GetUser() of a failing backend succeeded")
+	}
+	_, err = s3Client.GetObjectInBucket("bucket", "key")
+	if got := rgwerr.Status(err, "failed to get object"); status.Code(got) != codes.Unavailable {
+		t.Errorf("error of an open circuit = %v, want %v", got, codes.Unavailable)
+	}
+	if sent() != 2 {
+		t.Errorf("sent %d requests, want 2 before the circuit opened", sent())
+	}
+
+	// a probe is sent after the open timeout and closes the circuit
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	healthy = true
+	mu.Unlock()
+	if _, err := s3Client.GetObjectInBucket("bucket", "key"); err != nil {
+		t.Fatalf("S3Agent.GetObjectInBucket() probe error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s3Client.GetObjectInBucket("bucket", "key"); err != nil {
+				t.Errorf("S3Agent.GetObjectInBucket() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight != 1 {
+		t.Errorf("%d concurrent requests, want at most 1", maxInFlight)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strconv"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// bucketMaxReadOpsParameter and the following parameters limit the operations and bytes per minute
+	// of a bucket, enforced by every RGW instance on its own
+	bucketMaxReadOpsParameter    = "bucketMaxReadOps"
+	bucketMaxWriteOpsParameter   = "bucketMaxWriteOps"
+	bucketMaxReadBytesParameter  = "bucketMaxReadBytes"
+	bucketMaxWriteBytesParameter = "bucketMaxWriteBytes"
+
+	// userMaxReadOpsParameter and the following parameters limit the operations and bytes per minute
+	// of a granted user, enforced by every RGW instance on its own
+	userMaxReadOpsParameter    = "userMaxReadOps"
+	userMaxWriteOpsParameter   = "userMaxWriteOps"
+	userMaxReadBytesParameter  = "userMaxReadBytes"
+	userMaxWriteBytesParameter = "userMaxWriteBytes"
+)
+
+// rateLimitParameters are the names of the parameters of a rate limit
+type rateLimitParameters struct {
+	readOps, writeOps, readBytes, writeBytes string
+}
+
+var (
+	bucketRateLimitParameters = rateLimitParameters{bucketMaxReadOpsParameter, bucketMaxWriteOpsParameter, bucketMaxReadBytesParameter, bucketMaxWriteBytesParameter}
+	userRateLimitParameters   = rateLimitParameters{userMaxReadOpsParameter, userMaxWriteOpsParameter, userMaxReadBytesParameter, userMaxWriteBytesParameter}
+)
+
+// parseRateLimit reads a rate limit from the class parameters, nil if none of its parameters is set.
+// Ops are plain numbers and bytes are quantities, e.g. "100Mi". Limits which are not set are unlimited.
+func parseRateLimit(parameters map[string]string, names rateLimitParameters) (*adminops.RateLimit, error) {
+	limit := &adminops.RateLimit{Enabled: true}
+	found := false
+	for _, p := range []struct {
+		name  string
+		bytes bool
+		value *int64
+	}{
+		{names.readOps, false, &limit.MaxReadOps},
+		{names.writeOps, false, &limit.MaxWriteOps},
+		{names.readBytes, true, &limit.MaxReadBytes},
+		{names.writeBytes, true, &limit.MaxWriteBytes},
+	} {
+		v, ok := parameters[p.name]
+		if !ok {
+			continue
+		}
+		found = true
+		if p.bytes {
+			q, err := resource.ParseQuantity(v)
+			if err != nil || q.Sign() < 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q", p.name, v)
+			}
+			*p.value = q.Value()
+			continue
+		}
+		ops, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ops < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q", p.name, v)
+		}
+		*p.value = ops
+	}
+	if !found {
+		return nil, nil
+	}
+	return limit, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/fakergw"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_parseRateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       *adminops.RateLimit
+		wantErr    bool
+	}{
+		{"No limit", map[string]string{}, nil, false},
+		{"Ops", map[string]string{bucketMaxReadOpsParameter: "100", bucketMaxWriteOpsParameter: "10"}, &adminops.RateLimit{MaxReadOps: 100, MaxWriteOps: 10, Enabled: true}, false},
+		{"Bytes", map[string]string{bucketMaxReadBytesParameter: "1Mi", bucketMaxWriteBytesParameter: "1000"}, &adminops.RateLimit{MaxReadBytes: 1 << 20, MaxWriteBytes: 1000, Enabled: true}, false},
+		{"Zero is unlimited", map[string]string{bucketMaxReadOpsParameter: "0"}, &adminops.RateLimit{Enabled: true}, false},
+		{"User parameters ignored", map[string]string{userMaxReadOpsParameter: "100"}, nil, false},
+		{"Negative ops", map[string]string{bucketMaxReadOpsParameter: "-1"}, nil, true},
+		{"Ops quantity", map[string]string{bucketMaxWriteOpsParameter: "1k"}, nil, true},
+		{"Negative bytes", map[string]string{bucketMaxReadBytesParameter: "-1Mi"}, nil, true},
+		{"Invalid bytes", map[string]string{bucketMaxWriteBytesParameter: "lots"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRateLimit(tt.parameters, bucketRateLimitParameters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRateLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && status.Code(err) != codes.InvalidArgument {
+				t.Errorf("parseRateLimit() error code = %v, want %v", status.Code(err), codes.InvalidArgument)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRateLimit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_RateLimit_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	ctx := context.Background()
+
+	limited := createParameters()
+	limited[bucketMaxReadOpsParameter] = "100"
+	limited[bucketMaxWriteBytesParameter] = "10Mi"
+	bucket, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "limited-bucket", Parameters: limited})
+	if err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	want := fakergw.RateLimit{MaxReadOps: 100, MaxWriteBytes: 10 << 20, Enabled: true}
+	if b, _ := srv.Bucket("limited-bucket"); b.RateLimit != want {
+		t.Errorf("bucket rate limit = %+v, want %+v", b.RateLimit, want)
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "limited-bucket", Parameters: limited}); err != nil {
+		t.Errorf("provisionerServer.DriverCreateBucket() retry error = %v", err)
+	}
+	limited[bucketMaxReadOpsParameter] = "200"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "limited-bucket", Parameters: limited}); err != nil {
+		t.Errorf("provisionerServer.DriverCreateBucket() with different rate limit error = %v", err)
+	}
+	want.MaxReadOps = 200
+	if b, _ := srv.Bucket("limited-bucket"); b.RateLimit != want {
+		t.Errorf("bucket rate limit = %+v, want %+v applied to the existing bucket", b.RateLimit, want)
+	}
+
+	invalid := createParameters()
+	invalid[bucketMaxReadOpsParameter] = "many"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "invalid-bucket", Parameters: invalid}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("provisionerServer.DriverCreateBucket() with invalid rate limit error = %v, want %v", err, codes.InvalidArgument)
+	}
+	if _, ok := srv.Bucket("invalid-bucket"); ok {
+		t.Errorf("bucket with invalid rate limit created")
+	}
+
+	grantParameters := createParameters()
+	grantParameters[userMaxWriteOpsParameter] = "50"
+	grantParameters[userMaxReadBytesParameter] = "1Gi"
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: bucket.BucketId, Name: "ba-limited", Parameters: grantParameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+	wantUser := fakergw.RateLimit{MaxWriteOps: 50, MaxReadBytes: 1 << 30, Enabled: true}
+	if u, _ := srv.User("ba-limited"); u.RateLimit != wantUser {
+		t.Errorf("user rate limit = %+v, want %+v", u.RateLimit, wantUser)
+	}
+
+	grantParameters[userMaxReadBytesParameter] = "-1"
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: bucket.BucketId, Name: "ba-invalid", Parameters: grantParameters}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("provisionerServer.DriverGrantBucketAccess() with invalid rate limit error = %v, want %v", err, codes.InvalidArgument)
+	}
+	if _, ok := srv.User("ba-invalid"); ok {
+		t.Errorf("user with invalid rate limit created")
+	}
+}
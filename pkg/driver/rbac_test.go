@@ -0,0 +1,64 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+// rbacManifest is the manifest granting the driver access to the Kubernetes API
+const rbacManifest = "../../resources/rbac.yaml"
+
+// expectAllowedByRBAC fails the test for each action of the fake clientsets which the ClusterRole of the driver does
+// not allow. The fake clientsets do not check RBAC, so a missing verb is otherwise only found in a cluster.
+func expectAllowedByRBAC(t *testing.T, actions ...[]clienttesting.Action) {
+	t.Helper()
+	data, err := os.ReadFile(rbacManifest)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", rbacManifest, err)
+	}
+	var role rbacv1.ClusterRole
+	for _, document := range strings.Split(string(data), "\n---") {
+		var object rbacv1.ClusterRole
+		if err := yaml.Unmarshal([]byte(document), &object); err != nil {
+			t.Fatalf("failed to parse %s: %v", rbacManifest, err)
+		}
+		if object.Kind == "ClusterRole" {
+			role = object
+		}
+	}
+
+	for _, action := range slices.Concat(actions...) {
+		resource := action.GetResource().Resource
+		if action.GetSubresource() != "" {
+			resource += "/" + action.GetSubresource()
+		}
+		allowed := slices.ContainsFunc(role.Rules, func(rule rbacv1.PolicyRule) bool {
+			return slices.Contains(rule.APIGroups, action.GetResource().Group) &&
+				slices.Contains(rule.Resources, resource) && slices.Contains(rule.Verbs, action.GetVerb())
+		})
+		if !allowed {
+			t.Errorf("%s does not allow %s on %s in API group %q", rbacManifest, action.GetVerb(), resource, action.GetResource().Group)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/metrics"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+)
+
+const (
+	// bucketSyncPolicyParameter is the multisite sync policy of the bucket, enabled or forbidden.
+	// Buckets without it follow the sync policy of the zonegroup.
+	bucketSyncPolicyParameter = "bucketSyncPolicy"
+	// bucketSyncZonesParameter is a comma separated list of the zones the bucket is synced between, all zones if empty
+	bucketSyncZonesParameter = "bucketSyncZones"
+	// bucketSyncDirectionParameter is symmetric, syncing between all zones, or directional, syncing from the source zone only
+	bucketSyncDirectionParameter = "bucketSyncDirection"
+	// bucketSyncSourceZoneParameter is the zone a directional sync starts from
+	bucketSyncSourceZoneParameter = "bucketSyncSourceZone"
+
+	syncPolicyEnabled   = "enabled"
+	syncPolicyForbidden = "forbidden"
+
+	syncDirectionSymmetric   = "symmetric"
+	syncDirectionDirectional = "directional"
+
+	// syncRuleID names the sync policy rule owned by the driver
+	syncRuleID = "cosi-sync"
+)
+
+// bucketSync is the multisite sync policy of a bucket requested by the BucketClass parameters
+type bucketSync struct {
+	policy     string
+	zones      []string
+	sourceZone string
+}
+
+// parseBucketSync reads the sync policy from the BucketClass parameters, nil if the bucket follows the zonegroup
+func parseBucketSync(parameters map[string]string) (*bucketSync, error) {
+	policy, ok := parameters[bucketSyncPolicyParameter]
+	if !ok {
+		for _, p := range []string{bucketSyncZonesParameter, bucketSyncDirectionParameter, bucketSyncSourceZoneParameter} {
+			if _, set := parameters[p]; set {
+				return nil, status.Errorf(codes.InvalidArgument, "%s requires %s", p, bucketSyncPolicyParameter)
+			}
+		}
+		return nil, nil
+	}
+
+	sync := &bucketSync{policy: policy}
+	for _, zone := range strings.Split(parameters[bucketSyncZonesParameter], ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			sync.zones = append(sync.zones, zone)
+		}
+	}
+	switch policy {
+	case syncPolicyEnabled:
+	case syncPolicyForbidden:
+		if len(sync.zones) > 0 || parameters[bucketSyncDirectionParameter] != "" || parameters[bucketSyncSourceZoneParameter] != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s %q takes no zones or direction", bucketSyncPolicyParameter, policy)
+		}
+		return sync, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %q", bucketSyncPolicyParameter, policy)
+	}
+
+	switch direction := parameters[bucketSyncDirectionParameter]; direction {
+	case "", syncDirectionSymmetric:
+		if parameters[bucketSyncSourceZoneParameter] != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s requires a %s sync", bucketSyncSourceZoneParameter, syncDirectionDirectional)
+		}
+	case syncDirectionDirectional:
+		sync.sourceZone = strings.TrimSpace(parameters[bucketSyncSourceZoneParameter])
+		if sync.sourceZone == "" || len(sync.zones) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "a %s sync requires %s and %s", syncDirectionDirectional, bucketSyncSourceZoneParameter, bucketSyncZonesParameter)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %q", bucketSyncDirectionParameter, direction)
+	}
+	return sync, nil
+}
+
+// rules returns the sync policy rules of an enabled sync
+func (s bucketSync) rules() []adminops.SyncRule {
+	rule := adminops.SyncRule{ID: syncRuleID, Enabled: true, SourceZones: s.zones, DestinationZones: s.zones}
+	if s.sourceZone != "" {
+		rule.SourceZones = []string{s.sourceZone}
+	}
+	return []adminops.SyncRule{rule}
+}
+
+// applyBucketSync sets the sync policy of the bucket, it is replaced only if it differs
+func applyBucketSync(ctx context.Context, rgwAdminClient *rgwadmin.API, bucketName string, sync *bucketSync) error {
+	if sync == nil {
+		return nil
+	}
+	if sync.policy == syncPolicyForbidden {
+		err := adminops.DeleteBucketSyncPolicy(ctx, rgwAdminClient, bucketName)
+		if err != nil && !rgwerr.IsNotFound(err) {
+			return fmt.Errorf("failed to remove sync policy of bucket %q: %w", bucketName, err)
+		}
+		if err := adminops.SetBucketSync(ctx, rgwAdminClient, bucketName, false); err != nil {
+			return fmt.Errorf("failed to disable sync of bucket %q: %w", bucketName, err)
+		}
+		return nil
+	}
+
+	if err := adminops.SetBucketSync(ctx, rgwAdminClient, bucketName, true); err != nil {
+		return fmt.Errorf("failed to enable sync of bucket %q: %w", bucketName, err)
+	}
+	current, err := adminops.GetBucketSyncPolicy(ctx, rgwAdminClient, bucketName)
+	if err != nil && !rgwerr.IsNotFound(err) {
+		return fmt.Errorf("failed to get sync policy of bucket %q: %w", bucketName, err)
+	}
+	if reflect.DeepEqual(current, sync.rules()) {
+		return nil
+	}
+	if err := adminops.PutBucketSyncPolicy(ctx, rgwAdminClient, bucketName, sync.rules()); err != nil {
+		return fmt.Errorf("failed to set sync policy of bucket %q: %w", bucketName, err)
+	}
+	klog.InfoS("Set bucket sync policy", "bucketName", bucketName, "zones", sync.zones, "sourceZone", sync.sourceZone)
+	return nil
+}
+
+// reportBucketSync logs the sync status of the bucket and exports it as the bucket_sync_enabled metric
+func reportBucketSync(ctx context.Context, rgwAdminClient *rgwadmin.API, bucketName string, sync *bucketSync) {
+	if sync == nil {
+		return
+	}
+	info, err := adminops.GetBucketIndexLogInfo(ctx, rgwAdminClient, bucketName)
+	if err != nil {
+		klog.ErrorS(err, "failed to get bucket sync status", "bucketName", bucketName)
+		return
+	}
+	enabled := 0.0
+	if !info.SyncStopped {
+		enabled = 1
+	}
+	forgetBucketSync(bucketName)
+	metrics.BucketSyncEnabled.WithLabelValues(bucketName, sync.policy).Set(enabled)
+	if info.SyncStopped == (sync.policy == syncPolicyEnabled) {
+		klog.InfoS("Bucket sync status does not match its policy", "bucketName", bucketName, "policy", sync.policy, "syncStopped", info.SyncStopped)
+		return
+	}
+	klog.V(3).InfoS("Bucket sync status", "bucketName", bucketName, "policy", sync.policy, "syncStopped", info.SyncStopped, "maxMarker", info.MaxMarker)
+}
+
+// forgetBucketSync removes the bucket_sync_enabled metric of a deleted bucket
+func forgetBucketSync(bucketName string) {
+	metrics.BucketSyncEnabled.DeletePartialMatch(prometheus.Labels{"bucket": bucketName})
+}
+
+// syncStatusReporter periodically reports the sync status of the buckets with a sync policy
+type syncStatusReporter struct {
+	server   *provisionerServer
+	interval time.Duration
+}
+
+func newSyncStatusReporter(server *provisionerServer, interval time.Duration) *syncStatusReporter {
+	return &syncStatusReporter{server: server, interval: interval}
+}
+
+// Run reports the sync status every interval until the context is cancelled
+func (r *syncStatusReporter) Run(ctx context.Context) {
+	klog.InfoS("Starting bucket sync status reporting", "interval", r.interval)
+	wait.UntilWithContext(ctx, r.reportAll, r.interval)
+}
+
+func (r *syncStatusReporter) reportAll(ctx context.Context) {
+	buckets, err := r.server.BucketClientset.ObjectstorageV1alpha1().Buckets().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.ErrorS(err, "failed to list buckets")
+		return
+	}
+	for i := range buckets.Items {
+		bucket := &buckets.Items[i]
+		if err := r.report(ctx, bucket); err != nil {
+			logReconcileError(err, "failed to report bucket sync status", "bucket", bucket.Name)
+		}
+	}
+}
+
+func (r *syncStatusReporter) report(ctx context.Context, bucket *v1alpha1.Bucket) error {
+	if !strings.EqualFold(bucket.Spec.DriverName, r.server.Provisioner) ||
+		!bucket.Status.BucketReady || bucket.Status.BucketID == "" || !bucket.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	parameters := bucket.Spec.Parameters
+	bc, err := r.server.BucketClientset.ObjectstorageV1alpha1().BucketClasses().Get(ctx, bucket.Spec.BucketClassName, metav1.GetOptions{})
+	if err == nil {
+		parameters = bc.Parameters
+	} else if !kerrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get bucket class: %w", err)
+	}
+	sync, err := parseBucketSync(parameters)
+	if err != nil || sync == nil {
+		return err
+	}
+
+	backendParameters, bucketName, err := r.server.resolveBucket(ctx, bucket.Status.BucketID)
+	if err != nil {
+		return err
+	}
+	_, rgwAdminClient, err := r.server.Backends.initializeClients(ctx, r.server.Clientset, backendParameters)
+	if err != nil {
+		return fmt.Errorf("failed to initialize clients: %w", err)
+	}
+	reportBucketSync(ctx, rgwAdminClient, bucketName, sync)
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/metrics"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/fakergw"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_parseBucketSync(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       *bucketSync
+		wantErr    bool
+	}{
+		{"No policy", map[string]string{}, nil, false},
+		{"Enabled to all zones", map[string]string{bucketSyncPolicyParameter: "enabled"}, &bucketSync{policy: "enabled"}, false},
+		{"Symmetric", map[string]string{bucketSyncPolicyParameter: "enabled", bucketSyncZonesParameter: "zone-a, zone-b"}, &bucketSync{policy: "enabled", zones: []string{"zone-a", "zone-b"}}, false},
+		{"Directional", map[string]string{bucketSyncPolicyParameter: "enabled", bucketSyncZonesParameter: "dr", bucketSyncDirectionParameter: "directional", bucketSyncSourceZoneParameter: "primary"}, &bucketSync{policy: "enabled", zones: []string{"dr"}, sourceZone: "primary"}, false},
+		{"Forbidden", map[string]string{bucketSyncPolicyParameter: "forbidden"}, &bucketSync{policy: "forbidden"}, false},
+		{"Forbidden with zones", map[string]string{bucketSyncPolicyParameter: "forbidden", bucketSyncZonesParameter: "dr"}, nil, true},
+		{"Directional without source", map[string]string{bucketSyncPolicyParameter: "enabled", bucketSyncZonesParameter: "dr", bucketSyncDirectionParameter: "directional"}, nil, true},
+		{"Source zone of symmetric sync", map[string]string{bucketSyncPolicyParameter: "enabled", bucketSyncSourceZoneParameter: "primary"}, nil, true},
+		{"Unknown direction", map[string]string{bucketSyncPolicyParameter: "enabled", bucketSyncDirectionParameter: "both"}, nil, true},
+		{"Unknown policy", map[string]string{bucketSyncPolicyParameter: "allowed"}, nil, true},
+		{"Zones without policy", map[string]string{bucketSyncZonesParameter: "dr"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBucketSync(tt.parameters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBucketSync() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBucketSync() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_Sync_FakeRGW(t *testing.T) {
+	srv, s := newFakeRGWServer(t)
+	ctx := context.Background()
+
+	replicated := createParameters()
+	replicated[bucketSyncPolicyParameter] = "enabled"
+	replicated[bucketSyncZonesParameter] = "dr"
+	replicated[bucketSyncDirectionParameter] = "directional"
+	replicated[bucketSyncSourceZoneParameter] = "primary"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "replicated-bucket", Parameters: replicated}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "replicated-bucket", Parameters: replicated}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() retry error = %v", err)
+	}
+	b, _ := srv.Bucket("replicated-bucket")
+	want := []fakergw.ReplicationRule{{ID: syncRuleID, Status: "Enabled", SourceZones: []string{"primary"}, DestinationZones: []string{"dr"}}}
+	if !reflect.DeepEqual(b.Replication, want) || b.SyncStopped {
+		t.Errorf("replication = %+v, sync stopped %v, want %+v", b.Replication, b.SyncStopped, want)
+	}
+	if got := testutil.ToFloat64(metrics.BucketSyncEnabled.WithLabelValues("replicated-bucket", "enabled")); got != 1 {
+		t.Errorf("bucket_sync_enabled = %v, want 1", got)
+	}
+
+	local := createParameters()
+	local[bucketSyncPolicyParameter] = "forbidden"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "local-bucket", Parameters: local}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	if b, _ := srv.Bucket("local-bucket"); b.Replication != nil || !b.SyncStopped {
+		t.Errorf("replication = %+v, sync stopped %v, want no replication and sync stopped", b.Replication, b.SyncStopped)
+	}
+	if got := testutil.ToFloat64(metrics.BucketSyncEnabled.WithLabelValues("local-bucket", "forbidden")); got != 0 {
+		t.Errorf("bucket_sync_enabled = %v, want 0", got)
+	}
+
+	// the metric of a deleted bucket is removed
+	bucketID := backendRef{namespace: "test-namespace", secretName: "test-user-secret"}.encode("replicated-bucket")
+	if _, err := s.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: bucketID}); err != nil {
+		t.Fatalf("provisionerServer.DriverDeleteBucket() error = %v", err)
+	}
+	if got := testutil.CollectAndCount(metrics.BucketSyncEnabled); got != 1 {
+		t.Errorf("bucket_sync_enabled series = %v, want only the one of local-bucket", got)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+)
+
+const (
+	// bucketTagSourcesParameter selects the Kubernetes metadata tagged on the bucket, a comma separated list of
+	// namespace, bucketClaim, bucketClass and clusterID. All sources are tagged if it is not set.
+	bucketTagSourcesParameter = "bucketTagSources"
+	// bucketTagsParameter holds static tags of the BucketClass, e.g. "team=storage,cost-center=42"
+	bucketTagsParameter = "bucketTags"
+
+	tagSourceNamespace   = "namespace"
+	tagSourceBucketClaim = "bucketClaim"
+	tagSourceBucketClass = "bucketClass"
+	tagSourceClusterID   = "clusterID"
+
+	// bucketTagPrefix is reserved to the tags derived from Kubernetes metadata
+	bucketTagPrefix = "ceph.objectstorage.k8s.io/"
+	// NamespaceTag holds the namespace of the BucketClaim
+	NamespaceTag = bucketTagPrefix + "namespace"
+	// BucketClaimTag holds the name of the BucketClaim
+	BucketClaimTag = bucketTagPrefix + "bucket-claim"
+	// BucketClassTag holds the name of the BucketClass
+	BucketClassTag = bucketTagPrefix + "bucket-class"
+	// ClusterIDTag holds the cluster ID the driver was started with
+	ClusterIDTag = bucketTagPrefix + "cluster-id"
+	// ManagedByTag holds the ownership marker of the driver and cluster which created the bucket, see ownershipMarker.
+	// It is tagged whenever the driver runs with a cluster ID, regardless of bucketTagSources.
+	ManagedByTag = bucketTagPrefix + "managed-by"
+	// BucketTag holds the name of the COSI Bucket the bucket was created for. It is always tagged, a create request
+	// only reconfigures an existing bucket carrying its own Bucket name, see adoptExistingBucket.
+	BucketTag = bucketTagPrefix + "bucket"
+
+	// maxBucketTags is the S3 limit of tags per bucket
+	maxBucketTags = 50
+	// maxTagKeyLength and maxTagValueLength are the S3 limits of the length of tag keys and values in characters
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// tagSources maps the sources accepted in bucketTagSources to their tag keys
+var tagSources = map[string]string{
+	tagSourceNamespace:   NamespaceTag,
+	tagSourceBucketClaim: BucketClaimTag,
+	tagSourceBucketClass: BucketClassTag,
+	tagSourceClusterID:   ClusterIDTag,
+}
+
+// bucketTagging is the tagging of a bucket requested by the BucketClass parameters
+type bucketTagging struct {
+	sources map[string]bool
+	static  map[string]string
+}
+
+// parseBucketTagging reads the tag sources and static tags from the BucketClass parameters
+func parseBucketTagging(parameters map[string]string) (bucketTagging, error) {
+	tagging := bucketTagging{sources: map[string]bool{}, static: map[string]string{}}
+	if sources, ok := parameters[bucketTagSourcesParameter]; ok {
+		for _, source := range strings.Split(sources, ",") {
+			source = strings.TrimSpace(source)
+			if source == "" {
+				continue
+			}
+			if _, known := tagSources[source]; !known {
+				return bucketTagging{}, status.Errorf(codes.InvalidArgument, "unknown %s %q", bucketTagSourcesParameter, source)
+			}
+			tagging.sources[source] = true
+		}
+	} else {
+		for source := range tagSources {
+			tagging.sources[source] = true
+		}
+	}
+
+	for _, pair := range strings.Split(parameters[bucketTagsParameter], ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return bucketTagging{}, status.Errorf(codes.InvalidArgument, "invalid %s %q, expected key=value", bucketTagsParameter, pair)
+		}
+		if strings.HasPrefix(key, bucketTagPrefix) {
+			return bucketTagging{}, status.Errorf(codes.InvalidArgument, "%s key %q uses the reserved prefix %s", bucketTagsParameter, key, bucketTagPrefix)
+		}
+		value = strings.TrimSpace(value)
+		if utf8.RuneCountInString(key) > maxTagKeyLength {
+			return bucketTagging{}, status.Errorf(codes.InvalidArgument, "%s key %q is longer than %d characters", bucketTagsParameter, key, maxTagKeyLength)
+		}
+		if utf8.RuneCountInString(value) > maxTagValueLength {
+			return bucketTagging{}, status.Errorf(codes.InvalidArgument, "%s value of key %q is longer than %d characters", bucketTagsParameter, key, maxTagValueLength)
+		}
+		tagging.static[key] = value
+	}
+	// two tags are left for the ownership marker and the Bucket name
+	if len(tagging.sources)+len(tagging.static)+2 > maxBucketTags {
+		return bucketTagging{}, status.Errorf(codes.InvalidArgument, "at most %d bucket tags are supported", maxBucketTags)
+	}
+	return tagging, nil
+}
+
+// ownershipMarker returns the marker of the buckets and users created by the driver in the cluster, <driver name>/<cluster ID>.
+// Without a cluster ID nothing tells the clusters sharing an RGW apart and no marker is set.
+func ownershipMarker(driverName, clusterID string) string {
+	if clusterID == "" {
+		return ""
+	}
+	return strings.ToLower(driverName) + "/" + clusterID
+}
+
+// tags returns the tags of the bucket created for the Bucket object name. Without a Bucket object only the static
+// tags, the Bucket name, the cluster ID and the ownership marker are returned.
+func (t bucketTagging) tags(name string, bucket *v1alpha1.Bucket, driverName, clusterID string) map[string]string {
+	tags := make(map[string]string, len(t.static)+len(t.sources)+2)
+	for k, v := range t.static {
+		tags[k] = v
+	}
+	tags[BucketTag] = name
+	if t.sources[tagSourceClusterID] && clusterID != "" {
+		tags[ClusterIDTag] = clusterID
+	}
+	if marker := ownershipMarker(driverName, clusterID); marker != "" {
+		tags[ManagedByTag] = marker
+	}
+	if bucket == nil {
+		return tags
+	}
+	if claim := bucket.Spec.BucketClaim; claim != nil {
+		if t.sources[tagSourceNamespace] && claim.Namespace != "" {
+			tags[NamespaceTag] = claim.Namespace
+		}
+		if t.sources[tagSourceBucketClaim] && claim.Name != "" {
+			tags[BucketClaimTag] = claim.Name
+		}
+	}
+	if t.sources[tagSourceBucketClass] && bucket.Spec.BucketClassName != "" {
+		tags[BucketClassTag] = bucket.Spec.BucketClassName
+	}
+	return tags
+}
+
+// bucketTags returns the tags of the bucket created for the Bucket object name.
+// A missing Bucket object, e.g. when the driver is called directly, only skips the Kubernetes metadata.
+func (s *provisionerServer) bucketTags(ctx context.Context, name string, tagging bucketTagging) (map[string]string, error) {
+	if s.BucketClientset == nil {
+		return tagging.tags(name, nil, s.Provisioner, s.ClusterID), nil
+	}
+	bucket, err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		klog.InfoS("bucket object not found, skipping kubernetes metadata tags", "name", name)
+		return tagging.tags(name, nil, s.Provisioner, s.ClusterID), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bucket %q: %w", name, err)
+	}
+	return tagging.tags(name, bucket, s.Provisioner, s.ClusterID), nil
+}
+
+// mergeBucketTags returns the current tags of the bucket with the given tags applied.
+// The driver only manages the keys with the reserved prefix and the static tags of the class,
+// tags added by other clients are kept.
+func mergeBucketTags(current, tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(current)+len(tags))
+	for k, v := range current {
+		if !strings.HasPrefix(k, bucketTagPrefix) {
+			merged[k] = v
+		}
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged
+}
+
+// reconcileBucketTags merges the given tags into the tags of the bucket if they differ, see mergeBucketTags
+func reconcileBucketTags(s3Client *s3client.S3Agent, bucketName string, tags map[string]string) error {
+	current, err := s3Client.GetBucketTagging(bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to get tags of bucket %q: %w", bucketName, err)
+	}
+	merged := mergeBucketTags(current, tags)
+	if reflect.DeepEqual(current, merged) {
+		return nil
+	}
+	if len(merged) == 0 {
+		err = s3Client.DeleteBucketTagging(bucketName)
+	} else {
+		err = s3Client.PutBucketTagging(bucketName, merged)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set tags of bucket %q: %w", bucketName, err)
+	}
+	klog.InfoS("Updated bucket tags", "bucketName", bucketName, "tags", merged)
+	return nil
+}
+
+// tagReconciler periodically reconciles the tags of the buckets handled by the driver,
+// so that changes of the static tags of a BucketClass reach existing buckets
+type tagReconciler struct {
+	server   *provisionerServer
+	interval time.Duration
+}
+
+func newTagReconciler(server *provisionerServer, interval time.Duration) *tagReconciler {
+	return &tagReconciler{server: server, interval: interval}
+}
+
+// Run reconciles the bucket tags every interval until the context is cancelled
+func (r *tagReconciler) Run(ctx context.Context) {
+	klog.InfoS("Starting bucket tag reconciliation", "interval", r.interval)
+	wait.UntilWithContext(ctx, r.reconcileAll, r.interval)
+}
+
+func (r *tagReconciler) reconcileAll(ctx context.Context) {
+	buckets, err := r.server.BucketClientset.ObjectstorageV1alpha1().Buckets().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.ErrorS(err, "failed to list buckets")
+		return
+	}
+	for i := range buckets.Items {
+		bucket := &buckets.Items[i]
+		if err := r.reconcile(ctx, bucket); err != nil {
+			logReconcileError(err, "failed to reconcile bucket tags", "bucket", bucket.Name)
+		}
+	}
+}
+
+func (r *tagReconciler) reconcile(ctx context.Context, bucket *v1alpha1.Bucket) error {
+	if !strings.EqualFold(bucket.Spec.DriverName, r.server.Provisioner) ||
+		!bucket.Status.BucketReady || bucket.Status.BucketID == "" || !bucket.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	// the class holds the current tag parameters, the bucket keeps a copy of those at creation
+	parameters := bucket.Spec.Parameters
+	bc, err := r.server.BucketClientset.ObjectstorageV1alpha1().BucketClasses().Get(ctx, bucket.Spec.BucketClassName, metav1.GetOptions{})
+	if err == nil {
+		parameters = bc.Parameters
+	} else if !kerrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get bucket class: %w", err)
+	}
+	tagging, err := parseBucketTagging(parameters)
+	if err != nil {
+		return err
+	}
+
+	backendParameters, bucketName, err := r.server.resolveBucket(ctx, bucket.Status.BucketID)
+	if err != nil {
+		return err
+	}
+	s3Client, _, err := r.server.Backends.initializeClients(ctx, r.server.Clientset, backendParameters)
+	if err != nil {
+		return fmt.Errorf("failed to initialize clients: %w", err)
+	}
+	return reconcileBucketTags(s3Client, bucketName, tagging.tags(bucket.Name, bucket, r.server.Provisioner, r.server.ClusterID))
+}
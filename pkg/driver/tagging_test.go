@@ -0,0 +1,152 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_bucketTagging_tags(t *testing.T) {
+	bucket := &v1alpha1.Bucket{
+		Spec: v1alpha1.BucketSpec{
+			BucketClassName: "gold",
+			BucketClaim:     &corev1.ObjectReference{Namespace: "team-a", Name: "my-claim"},
+		},
+	}
+	marker := "ceph.objectstorage.k8s.io/cluster-1"
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		bucket     *v1alpha1.Bucket
+		want       map[string]string
+		wantErr    bool
+	}{
+		{"All sources", map[string]string{}, bucket, map[string]string{
+			NamespaceTag: "team-a", BucketClaimTag: "my-claim", BucketClassTag: "gold", ClusterIDTag: "cluster-1", ManagedByTag: marker,
+			BucketTag: "bucket-1",
+		}, false},
+		{"Selected sources and static tags", map[string]string{bucketTagSourcesParameter: "namespace, clusterID", bucketTagsParameter: "team=storage,cost-center=42"}, bucket, map[string]string{
+			NamespaceTag: "team-a", ClusterIDTag: "cluster-1", ManagedByTag: marker, BucketTag: "bucket-1", "team": "storage", "cost-center": "42",
+		}, false},
+		{"No sources", map[string]string{bucketTagSourcesParameter: ""}, bucket, map[string]string{ManagedByTag: marker, BucketTag: "bucket-1"}, false},
+		{"No bucket object", map[string]string{}, nil, map[string]string{ClusterIDTag: "cluster-1", ManagedByTag: marker, BucketTag: "bucket-1"}, false},
+		{"Unknown source", map[string]string{bucketTagSourcesParameter: "owner"}, bucket, nil, true},
+		{"Malformed static tag", map[string]string{bucketTagsParameter: "team"}, bucket, nil, true},
+		{"Reserved static tag", map[string]string{bucketTagsParameter: NamespaceTag + "=other"}, bucket, nil, true},
+		{"Longest static tag", map[string]string{bucketTagSourcesParameter: "", bucketTagsParameter: strings.Repeat("k", 128) + "=" + strings.Repeat("ü", 256)}, bucket, map[string]string{
+			ManagedByTag: marker, BucketTag: "bucket-1", strings.Repeat("k", 128): strings.Repeat("ü", 256),
+		}, false},
+		{"Static tag key too long", map[string]string{bucketTagsParameter: strings.Repeat("k", 129) + "=v"}, bucket, nil, true},
+		{"Static tag value too long", map[string]string{bucketTagsParameter: "k=" + strings.Repeat("v", 257)}, bucket, nil, true},
+		{"Too many static tags", map[string]string{bucketTagsParameter: staticTags(45)}, bucket, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagging, err := parseBucketTagging(tt.parameters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBucketTagging() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := tagging.tags("bucket-1", tt.bucket, "ceph.objectstorage.k8s.io", "cluster-1"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bucketTagging.tags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// staticTags returns the bucketTags parameter with n tags
+func staticTags(n int) string {
+	pairs := make([]string, n)
+	for i := range pairs {
+		pairs[i] = fmt.Sprintf("tag-%d=%d", i, i)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func Test_tagReconciler_FakeRGW(t *testing.T) {
+	ctx := context.Background()
+	parameters := createParameters()
+	parameters[bucketTagsParameter] = "team=storage"
+	bucketClass := &v1alpha1.BucketClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "gold"},
+		DriverName: "ceph.objectstorage.k8s.io",
+		Parameters: parameters,
+	}
+	bucket := &v1alpha1.Bucket{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-bucket"},
+		Spec: v1alpha1.BucketSpec{
+			DriverName:      "ceph.objectstorage.k8s.io",
+			BucketClassName: "gold",
+			BucketClaim:     &corev1.ObjectReference{Namespace: "team-a", Name: "my-claim"},
+			Parameters:      parameters,
+		},
+	}
+	srv, s := newFakeRGWServer(t, bucketClass, bucket)
+	s.ClusterID = "cluster-1"
+
+	created, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "test-bucket", Parameters: parameters})
+	if err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	want := map[string]string{
+		NamespaceTag: "team-a", BucketClaimTag: "my-claim", BucketClassTag: "gold", ClusterIDTag: "cluster-1", "team": "storage",
+		ManagedByTag: "ceph.objectstorage.k8s.io/cluster-1", BucketTag: "test-bucket",
+	}
+	if b, _ := srv.Bucket("test-bucket"); !reflect.DeepEqual(b.Tags, want) {
+		t.Errorf("tags after create = %v, want %v", b.Tags, want)
+	}
+
+	// tags of other clients are kept
+	s3Client, _, err := s.Backends.initializeClients(ctx, s.Clientset, parameters)
+	if err != nil {
+		t.Fatalf("failed to initialize clients: %v", err)
+	}
+	want["billing"] = "finance-team"
+	if err := s3Client.PutBucketTagging("test-bucket", want); err != nil {
+		t.Fatalf("failed to tag bucket: %v", err)
+	}
+
+	bucket.Status = v1alpha1.BucketStatus{BucketReady: true, BucketID: created.BucketId}
+	if _, err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Update(ctx, bucket, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update bucket: %v", err)
+	}
+	bucketClass.Parameters = createParameters()
+	bucketClass.Parameters[bucketTagsParameter] = "team=finance"
+	bucketClass.Parameters[bucketTagSourcesParameter] = "namespace"
+	if _, err := s.BucketClientset.ObjectstorageV1alpha1().BucketClasses().Update(ctx, bucketClass, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update bucket class: %v", err)
+	}
+
+	newTagReconciler(s, 0).reconcileAll(ctx)
+	want = map[string]string{
+		NamespaceTag: "team-a", ManagedByTag: "ceph.objectstorage.k8s.io/cluster-1", BucketTag: "test-bucket", "team": "finance", "billing": "finance-team",
+	}
+	if b, _ := srv.Bucket("test-bucket"); !reflect.DeepEqual(b.Tags, want) {
+		t.Errorf("tags after reconcile = %v, want %v", b.Tags, want)
+	}
+}
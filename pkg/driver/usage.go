@@ -0,0 +1,200 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/metrics"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+)
+
+const (
+	// SizeBytesAnnotation holds the size in bytes of the data in the bucket
+	SizeBytesAnnotation = "ceph.objectstorage.k8s.io/size-bytes"
+	// ObjectCountAnnotation holds the number of objects in the bucket
+	ObjectCountAnnotation = "ceph.objectstorage.k8s.io/object-count"
+	// QuotaSizeUtilizationAnnotation holds the used percentage of the size quota, if the bucket has one
+	QuotaSizeUtilizationAnnotation = "ceph.objectstorage.k8s.io/quota-size-utilization"
+	// QuotaObjectsUtilizationAnnotation holds the used percentage of the objects quota, if the bucket has one
+	QuotaObjectsUtilizationAnnotation = "ceph.objectstorage.k8s.io/quota-objects-utilization"
+
+	quotaSize    = "size"
+	quotaObjects = "objects"
+)
+
+// bucketUsage is the usage of a bucket taken from the RGW bucket stats
+type bucketUsage struct {
+	size    uint64
+	objects uint64
+	// utilization maps the enabled quotas to their used fraction
+	utilization map[string]float64
+}
+
+// usageFromInfo reads the usage from the bucket stats, buckets without data carry no rgw.main stats
+func usageFromInfo(info rgwadmin.Bucket) bucketUsage {
+	usage := bucketUsage{utilization: map[string]float64{}}
+	if info.Usage.RgwMain.Size != nil {
+		usage.size = *info.Usage.RgwMain.Size
+	}
+	if info.Usage.RgwMain.NumObjects != nil {
+		usage.objects = *info.Usage.RgwMain.NumObjects
+	}
+	quota := info.BucketQuota
+	if quota.Enabled == nil || !*quota.Enabled {
+		return usage
+	}
+	if quota.MaxSize != nil && *quota.MaxSize > 0 {
+		usage.utilization[quotaSize] = float64(usage.size) / float64(*quota.MaxSize)
+	}
+	if quota.MaxObjects != nil && *quota.MaxObjects > 0 {
+		usage.utilization[quotaObjects] = float64(usage.objects) / float64(*quota.MaxObjects)
+	}
+	return usage
+}
+
+// annotations returns the usage annotations of the Bucket
+func (u bucketUsage) annotations() map[string]string {
+	annotations := map[string]string{
+		SizeBytesAnnotation:   strconv.FormatUint(u.size, 10),
+		ObjectCountAnnotation: strconv.FormatUint(u.objects, 10),
+	}
+	for quota, annotation := range map[string]string{quotaSize: QuotaSizeUtilizationAnnotation, quotaObjects: QuotaObjectsUtilizationAnnotation} {
+		if ratio, ok := u.utilization[quota]; ok {
+			annotations[annotation] = strconv.FormatFloat(ratio*100, 'f', 1, 64) + "%"
+		}
+	}
+	return annotations
+}
+
+// usageCollector periodically publishes the usage of the buckets of the driver as annotations on the Buckets
+// and as metrics labeled by the BucketClaim
+type usageCollector struct {
+	server   *provisionerServer
+	interval time.Duration
+	// reported holds the labels of the buckets reported by the last collection, to drop the metrics of deleted buckets
+	reported map[string]prometheus.Labels
+}
+
+func newUsageCollector(server *provisionerServer, interval time.Duration) *usageCollector {
+	return &usageCollector{server: server, interval: interval, reported: map[string]prometheus.Labels{}}
+}
+
+// Run collects the usage every interval until the context is cancelled
+func (c *usageCollector) Run(ctx context.Context) {
+	klog.InfoS("Starting bucket usage collection", "interval", c.interval)
+	wait.UntilWithContext(ctx, c.collectAll, c.interval)
+}
+
+func (c *usageCollector) collectAll(ctx context.Context) {
+	buckets, err := c.server.BucketClientset.ObjectstorageV1alpha1().Buckets().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.ErrorS(err, "failed to list buckets")
+		return
+	}
+	reported := map[string]prometheus.Labels{}
+	for i := range buckets.Items {
+		bucket := &buckets.Items[i]
+		labels, err := c.collect(ctx, bucket)
+		if err != nil {
+			logReconcileError(err, "failed to collect bucket usage", "bucket", bucket.Name)
+			// the metrics of the last collection are kept
+			labels = c.reported[bucket.Name]
+		}
+		if labels != nil {
+			reported[bucket.Name] = labels
+		}
+	}
+	for name, labels := range c.reported {
+		if _, ok := reported[name]; !ok {
+			metrics.BucketSizeBytes.Delete(labels)
+			metrics.BucketObjects.Delete(labels)
+			metrics.BucketQuotaUtilization.DeletePartialMatch(labels)
+		}
+	}
+	c.reported = reported
+}
+
+// collect publishes the usage of a bucket and returns the labels of its metrics, nil if the bucket is skipped
+func (c *usageCollector) collect(ctx context.Context, bucket *v1alpha1.Bucket) (prometheus.Labels, error) {
+	if !strings.EqualFold(bucket.Spec.DriverName, c.server.Provisioner) ||
+		!bucket.Status.BucketReady || bucket.Status.BucketID == "" || !bucket.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+	parameters, bucketName, err := c.server.resolveBucket(ctx, bucket.Status.BucketID)
+	if err != nil {
+		return nil, err
+	}
+	_, rgwAdminClient, err := c.server.Backends.initializeClients(ctx, c.server.Clientset, parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize clients: %w", err)
+	}
+	info, err := rgwAdminClient.GetBucketInfo(ctx, rgwadmin.Bucket{Bucket: bucketName})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats of bucket %q: %w", bucketName, err)
+	}
+	usage := usageFromInfo(info)
+
+	labels := prometheus.Labels{"namespace": "", "bucket_claim": "", "bucket": bucket.Name}
+	if claim := bucket.Spec.BucketClaim; claim != nil {
+		labels["namespace"] = claim.Namespace
+		labels["bucket_claim"] = claim.Name
+	}
+	metrics.BucketSizeBytes.With(labels).Set(float64(usage.size))
+	metrics.BucketObjects.With(labels).Set(float64(usage.objects))
+	metrics.BucketQuotaUtilization.DeletePartialMatch(labels)
+	for quota, ratio := range usage.utilization {
+		quotaLabels := maps.Clone(labels)
+		quotaLabels["quota"] = quota
+		metrics.BucketQuotaUtilization.With(quotaLabels).Set(ratio)
+	}
+
+	annotations := usage.annotations()
+	current := bucket.GetAnnotations()
+	changed := false
+	for _, key := range []string{SizeBytesAnnotation, ObjectCountAnnotation, QuotaSizeUtilizationAnnotation, QuotaObjectsUtilizationAnnotation} {
+		if current[key] != annotations[key] {
+			changed = true
+		}
+	}
+	if !changed {
+		return labels, nil
+	}
+	updated := bucket.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	// annotations of quotas which were removed are dropped
+	delete(updated.Annotations, QuotaSizeUtilizationAnnotation)
+	delete(updated.Annotations, QuotaObjectsUtilizationAnnotation)
+	maps.Copy(updated.Annotations, annotations)
+	if _, err := c.server.BucketClientset.ObjectstorageV1alpha1().Buckets().Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return labels, fmt.Errorf("failed to update bucket annotations: %w", err)
+	}
+	klog.V(4).InfoS("Updated bucket usage", "bucket", bucket.Name, "size", usage.size, "objects", usage.objects)
+	return labels, nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/metrics"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_usageFromInfo(t *testing.T) {
+	size, objects := uint64(512), uint64(4)
+	maxSize, maxObjects := int64(1024), int64(0)
+	enabled, disabled := true, false
+
+	tests := []struct {
+		name          string
+		size, objects *uint64
+		quota         rgwadmin.QuotaSpec
+		want          map[string]string
+	}{
+		{"Empty bucket", nil, nil, rgwadmin.QuotaSpec{}, map[string]string{SizeBytesAnnotation: "0", ObjectCountAnnotation: "0"}},
+		{"Disabled quota", &size, &objects, rgwadmin.QuotaSpec{Enabled: &disabled, MaxSize: &maxSize}, map[string]string{SizeBytesAnnotation: "512", ObjectCountAnnotation: "4"}},
+		{"Size quota", &size, &objects, rgwadmin.QuotaSpec{Enabled: &enabled, MaxSize: &maxSize, MaxObjects: &maxObjects}, map[string]string{SizeBytesAnnotation: "512", ObjectCountAnnotation: "4", QuotaSizeUtilizationAnnotation: "50.0%"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := rgwadmin.Bucket{BucketQuota: tt.quota}
+			info.Usage.RgwMain.Size = tt.size
+			info.Usage.RgwMain.NumObjects = tt.objects
+			if got := usageFromInfo(info).annotations(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("usageFromInfo().annotations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_usageCollector_FakeRGW(t *testing.T) {
+	backend := backendRef{namespace: "test-namespace", secretName: "test-user-secret"}
+	srv, s := newFakeRGWServer(t, &v1alpha1.Bucket{
+		ObjectMeta: metav1.ObjectMeta{Name: "bucket"},
+		Spec: v1alpha1.BucketSpec{
+			DriverName:  "ceph.objectstorage.k8s.io",
+			BucketClaim: &corev1.ObjectReference{Namespace: "apps", Name: "claim"},
+		},
+		Status: v1alpha1.BucketStatus{BucketReady: true, BucketID: backend.encode("usage-bucket")},
+	})
+	ctx := context.Background()
+	parameters := createParameters()
+	parameters[bucketMaxObjectsParameter] = "4"
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "usage-bucket", Parameters: parameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := srv.PutObject("usage-bucket", key, []byte("data")); err != nil {
+			t.Fatalf("failed to put object: %v", err)
+		}
+	}
+
+	c := newUsageCollector(s, 0)
+	c.collectAll(ctx)
+	bucket, err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Get(ctx, "bucket", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get bucket: %v", err)
+	}
+	want := map[string]string{SizeBytesAnnotation: "8", ObjectCountAnnotation: "2", QuotaObjectsUtilizationAnnotation: "50.0%"}
+	if !reflect.DeepEqual(bucket.Annotations, want) {
+		t.Errorf("annotations = %v, want %v", bucket.Annotations, want)
+	}
+	if got := testutil.ToFloat64(metrics.BucketObjects.WithLabelValues("apps", "claim", "bucket")); got != 2 {
+		t.Errorf("bucket_objects = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.BucketQuotaUtilization.WithLabelValues("apps", "claim", "bucket", quotaObjects)); got != 0.5 {
+		t.Errorf("bucket_quota_utilization_ratio = %v, want 0.5", got)
+	}
+
+	if err := s.BucketClientset.ObjectstorageV1alpha1().Buckets().Delete(ctx, "bucket", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete bucket: %v", err)
+	}
+	c.collectAll(ctx)
+	if n := testutil.CollectAndCount(metrics.BucketSizeBytes); n != 0 {
+		t.Errorf("bucket_size_bytes has %d series after the bucket was deleted, want 0", n)
+	}
+}
@@ -0,0 +1,480 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/consts"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+)
+
+const (
+	// accessModeParameter selects how accounts are created on RGW, see accessModeUser and accessModeSubuser
+	accessModeParameter = "accessMode"
+	// accessModeUser creates a dedicated RGW user for every BucketAccess
+	accessModeUser = "user"
+	// accessModeSubuser creates a subuser with its own key for every BucketAccess,
+	// below a single owner user per namespace
+	accessModeSubuser = "subuser"
+
+	// ownerUserPrefix is prepended to the namespace to form the owner user in subuser mode
+	ownerUserPrefix = "cosi-"
+	// subuserSeparator separates the owner user and the subuser in a subuser ID
+	subuserSeparator = ":"
+
+	// maxBucketsParameter is the number of buckets a granted user may create on its own,
+	// 0 means unlimited and a negative value disables bucket creation
+	maxBucketsParameter = "maxBuckets"
+	// userQuotaMaxSizeParameter limits the total size of the user's data, e.g. "10Gi"
+	userQuotaMaxSizeParameter = "userQuotaMaxSize"
+	// userQuotaMaxObjectsParameter limits the total number of objects of the user
+	userQuotaMaxObjectsParameter = "userQuotaMaxObjects"
+	// opMaskParameter restricts the operations of the user, e.g. "read, write"
+	opMaskParameter = "opMask"
+
+	// defaultMaxBuckets prevents granted users from creating buckets outside of COSI
+	defaultMaxBuckets = -1
+)
+
+// userRestrictions are the limits applied to the RGW users created for BucketAccesses
+type userRestrictions struct {
+	maxBuckets int
+	quota      *rgwadmin.QuotaSpec
+	opMask     string
+	rateLimit  *adminops.RateLimit
+}
+
+// parseUserRestrictions reads the user restrictions from the BucketAccessClass parameters
+func parseUserRestrictions(parameters map[string]string) (userRestrictions, error) {
+	restrictions := userRestrictions{
+		maxBuckets: defaultMaxBuckets,
+		opMask:     parameters[opMaskParameter],
+	}
+	if v, ok := parameters[maxBucketsParameter]; ok {
+		maxBuckets, err := strconv.Atoi(v)
+		if err != nil {
+			return userRestrictions{}, status.Errorf(codes.InvalidArgument, "invalid %s %q: %v", maxBucketsParameter, v, err)
+		}
+		restrictions.maxBuckets = maxBuckets
+	}
+
+	maxSize, hasMaxSize := parameters[userQuotaMaxSizeParameter]
+	maxObjects, hasMaxObjects := parameters[userQuotaMaxObjectsParameter]
+	if hasMaxSize || hasMaxObjects {
+		enabled := true
+		unlimited := int64(-1)
+		quota := &rgwadmin.QuotaSpec{Enabled: &enabled, MaxSize: &unlimited, MaxObjects: &unlimited}
+		if hasMaxSize {
+			q, err := resource.ParseQuantity(maxSize)
+			if err != nil || q.Sign() < 0 {
+				return userRestrictions{}, status.Errorf(codes.InvalidArgument, "invalid %s %q", userQuotaMaxSizeParameter, maxSize)
+			}
+			size := q.Value()
+			quota.MaxSize = &size
+		}
+		if hasMaxObjects {
+			objects, err := strconv.ParseInt(maxObjects, 10, 64)
+			if err != nil || objects < 0 {
+				return userRestrictions{}, status.Errorf(codes.InvalidArgument, "invalid %s %q", userQuotaMaxObjectsParameter, maxObjects)
+			}
+			quota.MaxObjects = &objects
+		}
+		restrictions.quota = quota
+	}
+	rateLimit, err := parseRateLimit(parameters, userRateLimitParameters)
+	if err != nil {
+		return userRestrictions{}, err
+	}
+	restrictions.rateLimit = rateLimit
+	return restrictions, nil
+}
+
+// quotaRestriction and rateLimitRestriction name the restrictions set by several parameters in restrictionChanges
+const (
+	quotaRestriction     = "userQuota"
+	rateLimitRestriction = "userRateLimit"
+)
+
+// restrictionChanges returns the restrictions which differ from the settings of the user
+func restrictionChanges(ctx context.Context, rgwAdminClient *rgwadmin.API, user rgwadmin.User, restrictions userRestrictions) ([]string, error) {
+	var changes []string
+	if user.MaxBuckets == nil || *user.MaxBuckets != restrictions.maxBuckets {
+		changes = append(changes, maxBucketsParameter)
+	}
+	if q := restrictions.quota; q != nil && !quotaEqual(user.UserQuota, *q) {
+		changes = append(changes, quotaRestriction)
+	}
+	if restrictions.opMask != "" && normalizeOpMask(user.OpMask) != normalizeOpMask(restrictions.opMask) {
+		changes = append(changes, opMaskParameter)
+	}
+	if restrictions.rateLimit != nil {
+		current, err := adminops.GetUserRateLimit(ctx, rgwAdminClient, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get rate limit of user %q: %w", user.ID, err)
+		}
+		if current != *restrictions.rateLimit {
+			changes = append(changes, rateLimitRestriction)
+		}
+	}
+	return changes, nil
+}
+
+// applyUserRestrictions reconciles the restrictions on the user, only changed settings are written
+func applyUserRestrictions(ctx context.Context, rgwAdminClient *rgwadmin.API, user rgwadmin.User, restrictions userRestrictions) error {
+	changes, err := restrictionChanges(ctx, rgwAdminClient, user, restrictions)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		switch change {
+		case maxBucketsParameter:
+			maxBuckets := restrictions.maxBuckets
+			if _, err := rgwAdminClient.ModifyUser(ctx, rgwadmin.User{ID: user.ID, MaxBuckets: &maxBuckets}); err != nil {
+				return fmt.Errorf("failed to set max buckets of user %q: %w", user.ID, err)
+			}
+		case opMaskParameter:
+			if err := adminops.SetUserOpMask(ctx, rgwAdminClient, user.ID, restrictions.opMask); err != nil {
+				return fmt.Errorf("failed to set op mask of user %q: %w", user.ID, err)
+			}
+		case rateLimitRestriction:
+			if err := adminops.SetUserRateLimit(ctx, rgwAdminClient, user.ID, *restrictions.rateLimit); err != nil {
+				return fmt.Errorf("failed to set rate limit of user %q: %w", user.ID, err)
+			}
+		case quotaRestriction:
+			quota := *restrictions.quota
+			quota.UID = user.ID
+			if err := rgwAdminClient.SetUserQuota(ctx, quota); err != nil {
+				return fmt.Errorf("failed to set quota of user %q: %w", user.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOwnerRestrictions rejects restrictions which differ from those of an owner user shared with other subusers.
+// The restrictions of the owner apply to all of its subusers, so the class of one access must not change them
+// for the other accesses of the namespace.
+func checkOwnerRestrictions(ctx context.Context, rgwAdminClient *rgwadmin.API, owner rgwadmin.User, subuserID string, restrictions userRestrictions) error {
+	shared := false
+	for _, su := range owner.Subusers {
+		shared = shared || su.Name != subuserID
+	}
+	if !shared {
+		return nil
+	}
+	changes, err := restrictionChanges(ctx, rgwAdminClient, owner, restrictions)
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "%s of the bucket access class conflict with the other accesses of owner user %q",
+			strings.Join(changes, ", "), owner.ID)
+	}
+	return nil
+}
+
+func quotaEqual(current, wanted rgwadmin.QuotaSpec) bool {
+	deref := func(v *int64) int64 {
+		if v == nil {
+			return -1
+		}
+		return *v
+	}
+	return current.Enabled != nil && *current.Enabled == *wanted.Enabled &&
+		deref(current.MaxSize) == deref(wanted.MaxSize) &&
+		deref(current.MaxObjects) == deref(wanted.MaxObjects)
+}
+
+// normalizeOpMask makes op masks comparable independent of order and spacing
+func normalizeOpMask(opMask string) string {
+	ops := strings.Split(opMask, ",")
+	for i := range ops {
+		ops[i] = strings.TrimSpace(ops[i])
+	}
+	sort.Strings(ops)
+	return strings.Join(ops, ",")
+}
+
+// splitAccountID returns the RGW user and, for accounts created in subuser mode, the subuser ID
+func splitAccountID(accountID string) (string, string) {
+	if uid, _, ok := strings.Cut(accountID, subuserSeparator); ok {
+		return uid, accountID
+	}
+	return accountID, ""
+}
+
+// accountName returns the name the sidecar gave the account, which is the SID of its policy statement
+func accountName(accountID string) string {
+	if _, subuserID := splitAccountID(accountID); subuserID != "" {
+		_, name, _ := strings.Cut(subuserID, subuserSeparator)
+		return name
+	}
+	return accountID
+}
+
+// userDisplayName returns the display name of a user created by the driver, which carries the ownership marker
+// as RGW users have no tags, e.g. "ba-1234 [ceph.objectstorage.k8s.io/cluster-1]"
+func userDisplayName(userName, marker string) string {
+	if marker == "" {
+		return userName
+	}
+	return userName + " [" + marker + "]"
+}
+
+// hasOwnershipMarker tells if the user was created by the driver and cluster of the marker
+func hasOwnershipMarker(user rgwadmin.User, marker string) bool {
+	return marker != "" && user.DisplayName == userDisplayName(user.ID, marker)
+}
+
+// ensureUser creates the RGW user for the account, or fetches it if it already exists,
+// and applies the restrictions to it. New users are marked with the ownership marker.
+func ensureUser(ctx context.Context, rgwAdminClient *rgwadmin.API, userName, marker string, restrictions userRestrictions) (rgwadmin.User, error) {
+	maxBuckets := restrictions.maxBuckets
+	user, err := rgwAdminClient.CreateUser(ctx, rgwadmin.User{
+		ID:          userName,
+		DisplayName: userDisplayName(userName, marker),
+		MaxBuckets:  &maxBuckets,
+	})
+	if rgwerr.HasCode(err, rgwerr.UserAlreadyExists) {
+		klog.V(3).InfoS("user already exists", "userName", userName)
+		user, err = rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: userName})
+	}
+	if err != nil {
+		return rgwadmin.User{}, err
+	}
+	if err := applyUserRestrictions(ctx, rgwAdminClient, user, restrictions); err != nil {
+		return rgwadmin.User{}, err
+	}
+	return user, nil
+}
+
+// ensureSubuser creates the owner user and a subuser holding a dedicated s3 key for the account.
+// The restrictions apply to the owner user and thereby to all of its subusers.
+// The returned user carries the subuser ID and only the keys of the subuser.
+func ensureSubuser(ctx context.Context, rgwAdminClient *rgwadmin.API, ownerName, accountName, marker string, restrictions userRestrictions) (rgwadmin.User, error) {
+	generateKey := false
+	maxBuckets := restrictions.maxBuckets
+	_, err := rgwAdminClient.CreateUser(ctx, rgwadmin.User{
+		ID:          ownerName,
+		DisplayName: userDisplayName(ownerName, marker),
+		GenerateKey: &generateKey,
+		MaxBuckets:  &maxBuckets,
+	})
+	if err != nil && !rgwerr.HasCode(err, rgwerr.UserAlreadyExists) {
+		return rgwadmin.User{}, fmt.Errorf("failed to create owner user %q: %w", ownerName, err)
+	}
+
+	subuserID := ownerName + subuserSeparator + accountName
+	if rgwerr.HasCode(err, rgwerr.UserAlreadyExists) {
+		owner, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: ownerName})
+		if err != nil {
+			return rgwadmin.User{}, fmt.Errorf("failed to get owner user %q: %w", ownerName, err)
+		}
+		if err := checkOwnerRestrictions(ctx, rgwAdminClient, owner, subuserID, restrictions); err != nil {
+			return rgwadmin.User{}, err
+		}
+	}
+	err = rgwAdminClient.CreateSubuser(ctx, rgwadmin.User{ID: ownerName}, rgwadmin.SubuserSpec{
+		Name:   subuserID,
+		Access: rgwadmin.SubuserAccessFull,
+	})
+	if err != nil && !rgwerr.HasCode(err, rgwerr.SubuserExists) {
+		return rgwadmin.User{}, fmt.Errorf("failed to create subuser %q: %w", subuserID, err)
+	}
+
+	owner, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: ownerName})
+	if err != nil {
+		return rgwadmin.User{}, fmt.Errorf("failed to get owner user %q: %w", ownerName, err)
+	}
+	if err := applyUserRestrictions(ctx, rgwAdminClient, owner, restrictions); err != nil {
+		return rgwadmin.User{}, err
+	}
+	keys := subuserKeys(owner.Keys, subuserID)
+	if len(keys) == 0 {
+		generateKey := true
+		allKeys, err := rgwAdminClient.CreateKey(ctx, rgwadmin.UserKeySpec{
+			UID:         ownerName,
+			SubUser:     subuserID,
+			KeyType:     "s3",
+			GenerateKey: &generateKey,
+		})
+		if err != nil {
+			return rgwadmin.User{}, fmt.Errorf("failed to create key for subuser %q: %w", subuserID, err)
+		}
+		keys = subuserKeys(*allKeys, subuserID)
+	}
+	return rgwadmin.User{ID: subuserID, Keys: keys}, nil
+}
+
+// subuserKeys filters the keys of the owner user down to the keys of the given subuser
+func subuserKeys(keys []rgwadmin.UserKeySpec, subuserID string) []rgwadmin.UserKeySpec {
+	var filtered []rgwadmin.UserKeySpec
+	for _, k := range keys {
+		if k.User == subuserID {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered
+}
+
+// findBucketAccess finds the BucketAccess the sidecar created the account name for, from the UID in the name
+func (s *provisionerServer) findBucketAccess(accountName string) (*v1alpha1.BucketAccess, error) {
+	if s.Objects == nil {
+		return nil, kubernetesRequired("finding the bucket access of an account")
+	}
+	return s.Objects.bucketAccess(strings.TrimPrefix(accountName, consts.AccountNamePrefix))
+}
+
+// hasSubuser reports whether the subuser exists below the owner user
+func hasSubuser(owner rgwadmin.User, subuserID string) bool {
+	for _, su := range owner.Subusers {
+		if su.Name == subuserID {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictionReconciler periodically applies the restrictions of the BucketAccessClasses to the users of
+// granted accesses, so that changed class parameters reach existing users and manual changes are reverted
+type restrictionReconciler struct {
+	server   *provisionerServer
+	interval time.Duration
+}
+
+func newRestrictionReconciler(server *provisionerServer, interval time.Duration) *restrictionReconciler {
+	return &restrictionReconciler{server: server, interval: interval}
+}
+
+// restrictedUser is a user with the restrictions of all the accesses it serves
+type restrictedUser struct {
+	parameters   map[string]string
+	userName     string
+	restrictions userRestrictions
+	accesses     []string
+	conflict     bool
+}
+
+// Run reconciles the user restrictions every interval until the context is cancelled
+func (r *restrictionReconciler) Run(ctx context.Context) {
+	klog.InfoS("Starting user restriction reconciliation", "interval", r.interval)
+	wait.UntilWithContext(ctx, r.reconcileAll, r.interval)
+}
+
+func (r *restrictionReconciler) reconcileAll(ctx context.Context) {
+	bucketAccesses, err := r.server.BucketClientset.ObjectstorageV1alpha1().BucketAccesses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.ErrorS(err, "failed to list bucket accesses")
+		return
+	}
+	users := map[string]*restrictedUser{}
+	for i := range bucketAccesses.Items {
+		ba := &bucketAccesses.Items[i]
+		if err := r.collect(ctx, ba, users); err != nil {
+			klog.ErrorS(err, "failed to read user restrictions", "namespace", ba.Namespace, "bucketAccess", ba.Name)
+		}
+	}
+
+	keys := make([]string, 0, len(users))
+	for key := range users {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		user := users[key]
+		if user.conflict {
+			// the owner keeps its restrictions until the classes of its accesses agree
+			klog.ErrorS(nil, "bucket access classes of the accesses of an owner user conflict", "user", user.userName, "bucketAccesses", user.accesses)
+			continue
+		}
+		if err := r.reconcile(ctx, user); err != nil {
+			logReconcileError(err, "failed to reconcile user restrictions", "user", user.userName)
+		}
+	}
+}
+
+// collect adds the restrictions of a granted access to the user it is served by
+func (r *restrictionReconciler) collect(ctx context.Context, ba *v1alpha1.BucketAccess, users map[string]*restrictedUser) error {
+	if !ba.Status.AccessGranted || ba.Status.AccountID == "" || !ba.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	bac, err := r.server.BucketClientset.ObjectstorageV1alpha1().BucketAccessClasses().Get(ctx, ba.Spec.BucketAccessClassName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get bucket access class: %w", err)
+	}
+	if !strings.EqualFold(bac.DriverName, r.server.Provisioner) {
+		return nil
+	}
+	restrictions, err := parseUserRestrictions(bac.Parameters)
+	if err != nil {
+		return err
+	}
+
+	parameters := bac.Parameters
+	backend, accountID, ok := decodeID(ba.Status.AccountID)
+	if ok {
+		parameters = backend.parameters()
+	} else {
+		backend, err = backendFromParameters(parameters)
+		if err != nil {
+			return err
+		}
+	}
+	userName, _ := splitAccountID(accountID)
+	key := backend.encode(userName)
+	access := ba.Namespace + "/" + ba.Name
+	user, ok := users[key]
+	if !ok {
+		users[key] = &restrictedUser{parameters: parameters, userName: userName, restrictions: restrictions, accesses: []string{access}}
+		return nil
+	}
+	user.accesses = append(user.accesses, access)
+	user.conflict = user.conflict || !reflect.DeepEqual(user.restrictions, restrictions)
+	return nil
+}
+
+func (r *restrictionReconciler) reconcile(ctx context.Context, user *restrictedUser) error {
+	_, rgwAdminClient, err := r.server.Backends.initializeClients(ctx, r.server.Clientset, user.parameters)
+	if err != nil {
+		return fmt.Errorf("failed to initialize clients: %w", err)
+	}
+	u, err := rgwAdminClient.GetUser(ctx, rgwadmin.User{ID: user.userName})
+	if rgwerr.IsNotFound(err) {
+		// the user is recreated with the restrictions by the next grant
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get user %q: %w", user.userName, err)
+	}
+	return applyUserRestrictions(ctx, rgwAdminClient, u, user.restrictions)
+}
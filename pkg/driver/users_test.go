@@ -0,0 +1,109 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/container-object-storage-interface/client/apis/objectstorage/v1alpha1"
+	cosispec "sigs.k8s.io/container-object-storage-interface/proto"
+)
+
+func Test_provisionerServer_SubuserRestrictions_FakeRGW(t *testing.T) {
+	ctx := context.Background()
+	backend := backendRef{namespace: "test-namespace", secretName: "test-user-secret"}
+	readParameters := createParameters()
+	readParameters[accessModeParameter] = accessModeSubuser
+	readParameters[opMaskParameter] = "read"
+	writeParameters := createParameters()
+	writeParameters[accessModeParameter] = accessModeSubuser
+	writeParameters[opMaskParameter] = "read, write"
+	bucketAccess := func(uid, class string) *v1alpha1.BucketAccess {
+		return &v1alpha1.BucketAccess{
+			ObjectMeta: metav1.ObjectMeta{Name: "access-" + uid, Namespace: "apps", UID: types.UID(uid)},
+			Spec:       v1alpha1.BucketAccessSpec{BucketAccessClassName: class},
+			Status:     v1alpha1.BucketAccessStatus{AccessGranted: true, AccountID: backend.encode("cosi-apps:ba-" + uid)},
+		}
+	}
+	srv, s := newFakeRGWServer(t,
+		&v1alpha1.BucketAccessClass{ObjectMeta: metav1.ObjectMeta{Name: "read"}, DriverName: "ceph.objectstorage.k8s.io", Parameters: readParameters},
+		&v1alpha1.BucketAccessClass{ObjectMeta: metav1.ObjectMeta{Name: "write"}, DriverName: "ceph.objectstorage.k8s.io", Parameters: writeParameters},
+		bucketAccess("1111", "read"),
+		bucketAccess("2222", "read"),
+	)
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket-1", Parameters: createParameters()}); err != nil {
+		t.Fatalf("provisionerServer.DriverCreateBucket() error = %v", err)
+	}
+	opMask := func() string {
+		t.Helper()
+		owner, ok := srv.User("cosi-apps")
+		if !ok {
+			t.Fatalf("owner user cosi-apps not created")
+		}
+		return owner.OpMask
+	}
+
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-1111", Parameters: readParameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() error = %v", err)
+	}
+	if got := opMask(); got != "read" {
+		t.Fatalf("owner op mask = %q, want %q", got, "read")
+	}
+
+	// the class of a second access must not change the restrictions of the first one
+	_, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-2222", Parameters: writeParameters})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("provisionerServer.DriverGrantBucketAccess() with conflicting restrictions error = %v, want %v", err, codes.FailedPrecondition)
+	}
+	if got := opMask(); got != "read" {
+		t.Errorf("owner op mask = %q after conflicting grant, want %q", got, "read")
+	}
+	if owner, _ := srv.User("cosi-apps"); len(owner.Subusers) != 1 {
+		t.Errorf("subusers = %+v, want only the subuser of ba-1111", owner.Subusers)
+	}
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: backend.encode("bucket-1"), Name: "ba-2222", Parameters: readParameters}); err != nil {
+		t.Fatalf("provisionerServer.DriverGrantBucketAccess() with matching restrictions error = %v", err)
+	}
+
+	// a changed class reaches the owner once all of its accesses agree
+	r := newRestrictionReconciler(s, 0)
+	classes := s.BucketClientset.ObjectstorageV1alpha1().BucketAccessClasses()
+	bacs := s.BucketClientset.ObjectstorageV1alpha1().BucketAccesses("apps")
+	ba, _ := bacs.Get(ctx, "access-2222", metav1.GetOptions{})
+	ba.Spec.BucketAccessClassName = "write"
+	if _, err := bacs.Update(ctx, ba, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update bucket access: %v", err)
+	}
+	r.reconcileAll(ctx)
+	if got := opMask(); got != "read" {
+		t.Errorf("owner op mask = %q after reconciling conflicting classes, want %q", got, "read")
+	}
+
+	bac, _ := classes.Get(ctx, "read", metav1.GetOptions{})
+	bac.Parameters = writeParameters
+	if _, err := classes.Update(ctx, bac, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update bucket access class: %v", err)
+	}
+	r.reconcileAll(ctx)
+	if got := opMask(); got != "read, write" {
+		t.Errorf("owner op mask = %q after reconciling, want %q", got, "read, write")
+	}
+}
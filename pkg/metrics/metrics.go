@@ -0,0 +1,104 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const namespace = "ceph_cosi"
+
+// Registry holds all the metrics exported by the driver
+var Registry = prometheus.NewRegistry()
+
+var (
+	// AccessKeyAge is the age of the access key currently handed out for a BucketAccess
+	AccessKeyAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "access_key_age_seconds",
+		Help:      "Age in seconds of the access key currently issued for a BucketAccess.",
+	}, []string{"namespace", "bucket_access"})
+
+	// BucketSyncEnabled reports whether the bucket index log of a bucket with a sync policy feeds the multisite sync
+	BucketSyncEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bucket_sync_enabled",
+		Help:      "Whether multisite sync is enabled for a bucket with a sync policy (1) or stopped (0).",
+	}, []string{"bucket", "policy"})
+
+	// BucketSizeBytes is the size of the data in a bucket as reported by the RGW bucket stats
+	BucketSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bucket_size_bytes",
+		Help:      "Size in bytes of the data in a bucket.",
+	}, []string{"namespace", "bucket_claim", "bucket"})
+
+	// BucketObjects is the number of objects in a bucket as reported by the RGW bucket stats
+	BucketObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bucket_objects",
+		Help:      "Number of objects in a bucket.",
+	}, []string{"namespace", "bucket_claim", "bucket"})
+
+	// BucketQuotaUtilization is the used fraction of the size or object quota of a bucket
+	BucketQuotaUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bucket_quota_utilization_ratio",
+		Help:      "Used fraction of the size or objects quota of a bucket, only reported for enabled quotas.",
+	}, []string{"namespace", "bucket_claim", "bucket", "quota"})
+)
+
+func init() {
+	Registry.MustRegister(
+		AccessKeyAge,
+		BucketSyncEnabled,
+		BucketSizeBytes,
+		BucketObjects,
+		BucketQuotaUtilization,
+	)
+}
+
+// Serve exposes the metrics on the given address until the context is cancelled
+func Serve(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			klog.ErrorS(err, "failed to shutdown metrics server")
+		}
+	}()
+
+	klog.InfoS("Serving metrics", "address", address)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
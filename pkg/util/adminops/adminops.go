@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package adminops implements the RGW admin ops endpoints which are not covered by go-ceph,
+// reusing the endpoint, credentials and http client of a go-ceph admin API.
+package adminops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+)
+
+const (
+	// the admin ops API is signed like S3 with a fixed region, same as go-ceph
+	authRegion = "default"
+	service    = "s3"
+	adminPath  = "/admin"
+)
+
+// StatusError is the error returned by RGW for failed admin ops requests.
+// It matches the go-ceph error reasons, e.g. errors.Is(err, rgwadmin.ErrNoSuchUser).
+type StatusError struct {
+	Code       string `json:"Code,omitempty"`
+	RequestID  string `json:"RequestId,omitempty"`
+	HostID     string `json:"HostId,omitempty"`
+	StatusCode int    `json:"-"`
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("%s %s %s", e.Code, e.RequestID, e.HostID)
+}
+
+// Is reports whether the target is the go-ceph error reason of this error
+func (e StatusError) Is(target error) bool {
+	return target != nil && target.Error() == e.Code
+}
+
+// call sends a signed request to the admin ops API and returns the response body
+func call(ctx context.Context, api *rgwadmin.API, method, path string, args url.Values) ([]byte, error) {
+	if args == nil {
+		args = url.Values{}
+	}
+	args.Set("format", "json")
+	// sub-resources are passed in the path like go-ceph does, e.g. /bucket?quota
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	endpoint := fmt.Sprintf("%s%s%s%s%s", api.Endpoint, adminPath, path, separator, args.Encode())
+	return Do(ctx, api, method, endpoint, nil)
+}
+
+// Do sends a request signed with the credentials of the admin API to the given URL.
+// It is used for RGW specific S3 extensions as well as the admin ops API.
+func Do(ctx context.Context, api *rgwadmin.API, method, endpoint string, body io.ReadSeeker) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := v4.NewSigner(credentials.NewStaticCredentials(api.AccessKey, api.SecretKey, ""))
+	if _, err := signer.Sign(request, body, service, authRegion, time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := api.HTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		statusErr := StatusError{StatusCode: resp.StatusCode}
+		if err := json.Unmarshal(data, &statusErr); err != nil || statusErr.Code == "" {
+			statusErr.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, statusErr
+	}
+	return data, nil
+}
+
+// SetUserOpMask sets the operations a user is allowed to perform, e.g. "read, write, delete"
+func SetUserOpMask(ctx context.Context, api *rgwadmin.API, uid, opMask string) error {
+	if uid == "" {
+		return fmt.Errorf("missing user ID")
+	}
+	_, err := call(ctx, api, http.MethodPost, "/user", url.Values{
+		"uid":     []string{uid},
+		"op-mask": []string{opMask},
+	})
+	return err
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package adminops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+)
+
+const (
+	rateLimitScopeUser   = "user"
+	rateLimitScopeBucket = "bucket"
+)
+
+// RateLimit limits the operations and bytes per minute of a user or bucket, enforced by every RGW instance
+// on its own. Zero values are unlimited.
+type RateLimit struct {
+	MaxReadOps    int64 `json:"max_read_ops"`
+	MaxWriteOps   int64 `json:"max_write_ops"`
+	MaxReadBytes  int64 `json:"max_read_bytes"`
+	MaxWriteBytes int64 `json:"max_write_bytes"`
+	Enabled       bool  `json:"enabled"`
+}
+
+// GetUserRateLimit returns the rate limit of a user
+func GetUserRateLimit(ctx context.Context, api *rgwadmin.API, uid string) (RateLimit, error) {
+	if uid == "" {
+		return RateLimit{}, fmt.Errorf("missing user ID")
+	}
+	return getRateLimit(ctx, api, rateLimitScopeUser, url.Values{"uid": []string{uid}})
+}
+
+// SetUserRateLimit sets the rate limit of a user
+func SetUserRateLimit(ctx context.Context, api *rgwadmin.API, uid string, limit RateLimit) error {
+	if uid == "" {
+		return fmt.Errorf("missing user ID")
+	}
+	return setRateLimit(ctx, api, rateLimitScopeUser, url.Values{"uid": []string{uid}}, limit)
+}
+
+// GetBucketRateLimit returns the rate limit of a bucket
+func GetBucketRateLimit(ctx context.Context, api *rgwadmin.API, bucket string) (RateLimit, error) {
+	if bucket == "" {
+		return RateLimit{}, fmt.Errorf("missing bucket name")
+	}
+	return getRateLimit(ctx, api, rateLimitScopeBucket, url.Values{"bucket": []string{bucket}})
+}
+
+// SetBucketRateLimit sets the rate limit of a bucket
+func SetBucketRateLimit(ctx context.Context, api *rgwadmin.API, bucket string, limit RateLimit) error {
+	if bucket == "" {
+		return fmt.Errorf("missing bucket name")
+	}
+	return setRateLimit(ctx, api, rateLimitScopeBucket, url.Values{"bucket": []string{bucket}}, limit)
+}
+
+func getRateLimit(ctx context.Context, api *rgwadmin.API, scope string, args url.Values) (RateLimit, error) {
+	args.Set("ratelimit-scope", scope)
+	data, err := call(ctx, api, http.MethodGet, "/ratelimit", args)
+	if err != nil {
+		return RateLimit{}, err
+	}
+	// the limit is wrapped in user_ratelimit or bucket_ratelimit
+	wrapped := map[string]RateLimit{}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return RateLimit{}, fmt.Errorf("failed to parse rate limit: %w", err)
+	}
+	return wrapped[scope+"_ratelimit"], nil
+}
+
+func setRateLimit(ctx context.Context, api *rgwadmin.API, scope string, args url.Values, limit RateLimit) error {
+	args.Set("ratelimit-scope", scope)
+	args.Set("max-read-ops", strconv.FormatInt(limit.MaxReadOps, 10))
+	args.Set("max-write-ops", strconv.FormatInt(limit.MaxWriteOps, 10))
+	args.Set("max-read-bytes", strconv.FormatInt(limit.MaxReadBytes, 10))
+	args.Set("max-write-bytes", strconv.FormatInt(limit.MaxWriteBytes, 10))
+	args.Set("enabled", strconv.FormatBool(limit.Enabled))
+	_, err := call(ctx, api, http.MethodPost, "/ratelimit", args)
+	return err
+}
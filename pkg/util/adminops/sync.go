@@ -0,0 +1,162 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package adminops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+)
+
+// SyncRule is a rule of the bucket sync policy. RGW maps the replication configuration of a bucket
+// onto a bucket sync policy group with a pipe from the source zones to the destination zones.
+type SyncRule struct {
+	// ID names the rule
+	ID string
+	// Enabled is false for rules which only allow sync, without enabling it
+	Enabled bool
+	// SourceZones are the zones the objects are synced from, all zones if empty
+	SourceZones []string
+	// DestinationZones are the zones the objects are synced to, all zones if empty
+	DestinationZones []string
+}
+
+// replicationConfiguration is the S3 replication configuration with the zone extensions of RGW
+type replicationConfiguration struct {
+	XMLName xml.Name          `xml:"ReplicationConfiguration"`
+	Xmlns   string            `xml:"xmlns,attr,omitempty"`
+	Role    string            `xml:"Role"`
+	Rules   []replicationRule `xml:"Rule"`
+}
+
+type replicationRule struct {
+	ID                string   `xml:"ID"`
+	Status            string   `xml:"Status"`
+	Priority          int      `xml:"Priority"`
+	FilterPrefix      string   `xml:"Filter>Prefix"`
+	SourceZones       []string `xml:"Source>Zone,omitempty"`
+	DestinationBucket string   `xml:"Destination>Bucket"`
+	DestinationZones  []string `xml:"Destination>Zone,omitempty"`
+}
+
+const (
+	s3Namespace       = "http://s3.amazonaws.com/doc/2006-03-01/"
+	replicationStatus = "Enabled"
+	replicationPause  = "Disabled"
+)
+
+// PutBucketSyncPolicy replaces the sync policy of the bucket with the given rules
+func PutBucketSyncPolicy(ctx context.Context, api *rgwadmin.API, bucket string, rules []SyncRule) error {
+	config := replicationConfiguration{Xmlns: s3Namespace}
+	for i, rule := range rules {
+		status := replicationPause
+		if rule.Enabled {
+			status = replicationStatus
+		}
+		config.Rules = append(config.Rules, replicationRule{
+			ID:                rule.ID,
+			Status:            status,
+			Priority:          i + 1,
+			SourceZones:       rule.SourceZones,
+			DestinationBucket: "arn:aws:s3:::" + bucket,
+			DestinationZones:  rule.DestinationZones,
+		})
+	}
+	body, err := xml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = Do(ctx, api, http.MethodPut, bucketURL(api, bucket, "replication"), bytes.NewReader(body))
+	return err
+}
+
+// GetBucketSyncPolicy returns the rules of the sync policy of the bucket
+func GetBucketSyncPolicy(ctx context.Context, api *rgwadmin.API, bucket string) ([]SyncRule, error) {
+	data, err := Do(ctx, api, http.MethodGet, bucketURL(api, bucket, "replication"), nil)
+	if err != nil {
+		return nil, err
+	}
+	config := replicationConfiguration{}
+	if err := xml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse replication configuration: %w", err)
+	}
+	rules := make([]SyncRule, 0, len(config.Rules))
+	for _, rule := range config.Rules {
+		rules = append(rules, SyncRule{
+			ID:               rule.ID,
+			Enabled:          rule.Status == replicationStatus,
+			SourceZones:      rule.SourceZones,
+			DestinationZones: rule.DestinationZones,
+		})
+	}
+	return rules, nil
+}
+
+// DeleteBucketSyncPolicy removes the sync policy of the bucket
+func DeleteBucketSyncPolicy(ctx context.Context, api *rgwadmin.API, bucket string) error {
+	_, err := Do(ctx, api, http.MethodDelete, bucketURL(api, bucket, "replication"), nil)
+	return err
+}
+
+// SetBucketSync enables or disables the sync of the bucket, as radosgw-admin bucket sync enable/disable does.
+// A bucket with disabled sync is not replicated regardless of the sync policies of the zonegroup.
+func SetBucketSync(ctx context.Context, api *rgwadmin.API, bucket string, enabled bool) error {
+	if bucket == "" {
+		return fmt.Errorf("missing bucket name")
+	}
+	_, err := call(ctx, api, http.MethodPost, "/bucket?sync", url.Values{
+		"bucket":      []string{bucket},
+		"sync-bucket": []string{strconv.FormatBool(enabled)},
+	})
+	return err
+}
+
+// BucketIndexLogInfo is the state of the bucket index log, which drives the sync of the bucket to other zones
+type BucketIndexLogInfo struct {
+	BucketVersion string `json:"bucket_ver"`
+	MasterVersion string `json:"master_ver"`
+	MaxMarker     string `json:"max_marker"`
+	SyncStopped   bool   `json:"syncstopped"`
+}
+
+// GetBucketIndexLogInfo returns the state of the bucket index log of the bucket
+func GetBucketIndexLogInfo(ctx context.Context, api *rgwadmin.API, bucket string) (BucketIndexLogInfo, error) {
+	info := BucketIndexLogInfo{}
+	data, err := call(ctx, api, http.MethodGet, "/log?info", url.Values{
+		"type":            []string{"bucket-index"},
+		"bucket-instance": []string{bucket},
+	})
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("failed to parse bucket index log info: %w", err)
+	}
+	return info, nil
+}
+
+// bucketURL returns the path style S3 URL of a bucket sub-resource
+func bucketURL(api *rgwadmin.API, bucket, subResource string) string {
+	return fmt.Sprintf("%s/%s?%s", api.Endpoint, url.PathEscape(bucket), subResource)
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package breaker protects the driver from unhealthy RGW backends. Requests to a backend failing repeatedly
+// fail fast instead of each waiting for the timeout, and the number of requests in flight to a backend is limited.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrOpen is returned without sending the request while the circuit of the backend is open
+var ErrOpen error = openError{}
+
+type openError struct{}
+
+func (openError) Error() string { return "circuit breaker open, backend unavailable" }
+
+// Timeout and Temporary make the error a net.Error, which is classified as a network failure
+// and not retried by the S3 SDK
+func (openError) Timeout() bool   { return false }
+func (openError) Temporary() bool { return false }
+
+// requestKey is the context key of the logical request an attempt belongs to
+type requestKey struct{}
+
+// logicalRequest tracks whether a failure of one of the attempts of a request was already counted
+type logicalRequest struct {
+	failed atomic.Bool
+}
+
+// WithRequest marks the attempts sent with the returned context as a single logical request, e.g. the retries of
+// an SDK request, whose failures count once towards the failure threshold. Requests sent without it count every attempt.
+func WithRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestKey{}, &logicalRequest{})
+}
+
+// Options configures the breakers of the backends
+type Options struct {
+	// FailureThreshold is the number of consecutive failed requests opening the circuit, zero disables the breaker.
+	// The retries of a request marked by WithRequest count as a single failure.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before a single probe request is let through
+	OpenTimeout time.Duration
+	// MaxInFlight limits the concurrent requests to a backend, zero is unlimited
+	MaxInFlight int
+}
+
+type state int
+
+const (
+	closed state = iota
+	open
+	halfOpen
+)
+
+// Breaker guards the requests to a backend
+type Breaker struct {
+	name    string
+	options Options
+	// slots holds a token per request in flight, nil if unlimited
+	slots chan struct{}
+	now   func() time.Time
+
+	mu       sync.Mutex
+	state    state
+	failures int
+	openedAt time.Time
+	// probe identifies the probe of the current half open state, only its outcome leaves the state
+	probe uint64
+}
+
+// New returns the breaker of the backend with the given name
+func New(name string, options Options) *Breaker {
+	b := &Breaker{name: name, options: options, now: time.Now}
+	if options.MaxInFlight > 0 {
+		b.slots = make(chan struct{}, options.MaxInFlight)
+	}
+	return b
+}
+
+// allow reports whether a request may be sent. Once the open timeout passed a single probe is allowed,
+// the circuit closes if it succeeds. The probe is identified by the returned ID, zero for other requests.
+func (b *Breaker) allow() (uint64, error) {
+	if b.options.FailureThreshold <= 0 {
+		return 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case open:
+		if b.now().Sub(b.openedAt) < b.options.OpenTimeout {
+			return 0, ErrOpen
+		}
+		b.state = halfOpen
+		b.probe++
+		klog.InfoS("Probing backend", "backend", b.name)
+		return b.probe, nil
+	case halfOpen:
+		// the probe is in flight
+		return 0, ErrOpen
+	}
+	return 0, nil
+}
+
+// probing reports whether the request with the probe ID holds the probe of the half open circuit
+func (b *Breaker) probing(probe uint64) bool {
+	return b.state == halfOpen && probe != 0 && probe == b.probe
+}
+
+// record counts the outcome of an attempt. A failed attempt of a request whose failure was already
+// counted only reopens a half open circuit. Requests admitted before the circuit opened do not fail a probe
+// in flight, only the probe itself reopens the circuit.
+func (b *Breaker) record(probe uint64, success, counted bool) {
+	if b.options.FailureThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		if b.state != closed {
+			klog.InfoS("Backend recovered, closing circuit", "backend", b.name)
+		}
+		b.state, b.failures = closed, 0
+		return
+	}
+	if !counted {
+		b.failures++
+	}
+	if b.state == halfOpen && !b.probing(probe) {
+		return
+	}
+	if b.state == halfOpen || b.failures >= b.options.FailureThreshold {
+		if b.state != open {
+			klog.InfoS("Backend failing, opening circuit", "backend", b.name, "failures", b.failures, "openTimeout", b.options.OpenTimeout)
+		}
+		b.state, b.openedAt = open, b.now()
+	}
+}
+
+// abort returns a probe which was not sent, the next request probes again.
+// Aborting any other request leaves the state alone.
+func (b *Breaker) abort(probe uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.probing(probe) {
+		b.state = open
+	}
+}
+
+// acquire waits for a slot of the in-flight limit, until the context of the request is done
+func (b *Breaker) acquire(ctx context.Context) error {
+	if b.slots == nil {
+		return nil
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *Breaker) release() {
+	if b.slots != nil {
+		<-b.slots
+	}
+}
+
+// Transport wraps the transport of the clients of the backend
+func (b *Breaker) Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{breaker: b, next: next}
+}
+
+type transport struct {
+	breaker *Breaker
+	next    http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	probe, err := t.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.breaker.acquire(req.Context()); err != nil {
+		t.breaker.abort(probe)
+		return nil, err
+	}
+	defer t.breaker.release()
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		// cancelled by the caller, which tells nothing about the backend
+		t.breaker.abort(probe)
+	case err != nil:
+		t.breaker.record(probe, false, counted(req))
+	default:
+		success := resp.StatusCode < http.StatusInternalServerError
+		t.breaker.record(probe, success, !success && counted(req))
+	}
+	return resp, err
+}
+
+// counted marks the logical request of the attempt as failed and reports whether it already was
+func counted(req *http.Request) bool {
+	lr, ok := req.Context().Value(requestKey{}).(*logicalRequest)
+	return ok && lr.failed.Swap(true)
+}
+
+// Set holds the breakers of the backends, keyed by endpoint
+type Set struct {
+	options Options
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewSet returns an empty set creating breakers with the options
+func NewSet(options Options) *Set {
+	return &Set{options: options, breakers: map[string]*Breaker{}}
+}
+
+// Transport wraps the transport with the breaker of the endpoint. A nil set returns the transport unchanged.
+func (s *Set) Transport(endpoint string, next http.RoundTripper) http.RoundTripper {
+	if s == nil {
+		return next
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[endpoint]
+	if !ok {
+		b = New(endpoint, s.options)
+		s.breakers[endpoint] = b
+	}
+	return b.Transport(next)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package breaker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// backend answers with the status code, or fails the connection if it is 0, and counts the requests it received
+type backend struct {
+	statusCode int
+	requests   int
+}
+
+func (b *backend) RoundTrip(*http.Request) (*http.Response, error) {
+	b.requests++
+	if b.statusCode == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: b.statusCode, Body: http.NoBody}, nil
+}
+
+// clock is a manually advanced time source
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time { return c.now }
+
+func newTestBreaker(options Options) (*Breaker, *clock) {
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := New("rgw", options)
+	b.now = c.Now
+	return b, c
+}
+
+func send(t *testing.T, rt http.RoundTripper, ctx context.Context) error {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://rgw/bucket", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	_, err = rt.RoundTrip(req)
+	return err
+}
+
+func TestBreaker_Transport(t *testing.T) {
+	ctx := context.Background()
+	b, c := newTestBreaker(Options{FailureThreshold: 3, OpenTimeout: 30 * time.Second})
+	rgw := &backend{statusCode: http.StatusServiceUnavailable}
+	rt := b.Transport(rgw)
+
+	for i := 0; i < 3; i++ {
+		if err := send(t, rt, ctx); err != nil {
+			t.Fatalf("request %d error = %v, want the response", i, err)
+		}
+	}
+	if err := send(t, rt, ctx); !errors.Is(err, ErrOpen) {
+		t.Fatalf("request after 3 failures error = %v, want %v", err, ErrOpen)
+	}
+	if rgw.requests != 3 {
+		t.Errorf("backend received %d requests, want 3", rgw.requests)
+	}
+
+	// a single probe is let through once the open timeout passed, a failed probe reopens the circuit
+	c.now = c.now.Add(29 * time.Second)
+	if err := send(t, rt, ctx); !errors.Is(err, ErrOpen) {
+		t.Fatalf("request before the open timeout error = %v, want %v", err, ErrOpen)
+	}
+	c.now = c.now.Add(time.Second)
+	if err := send(t, rt, ctx); err != nil {
+		t.Fatalf("probe error = %v, want the response", err)
+	}
+	if err := send(t, rt, ctx); !errors.Is(err, ErrOpen) {
+		t.Fatalf("request after a failed probe error = %v, want %v", err, ErrOpen)
+	}
+
+	// a successful probe closes the circuit, client errors are successes
+	c.now = c.now.Add(30 * time.Second)
+	rgw.statusCode = http.StatusNotFound
+	for i := 0; i < 5; i++ {
+		if err := send(t, rt, ctx); err != nil {
+			t.Fatalf("request %d after recovery error = %v", i, err)
+		}
+	}
+	if rgw.requests != 9 {
+		t.Errorf("backend received %d requests, want 9", rgw.requests)
+	}
+}
+
+func TestBreaker_ConsecutiveFailures(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBreaker(Options{FailureThreshold: 2, OpenTimeout: time.Minute})
+	rgw := &backend{}
+	rt := b.Transport(rgw)
+
+	// a success in between resets the count
+	for _, statusCode := range []int{0, http.StatusOK, 0, http.StatusOK} {
+		rgw.statusCode = statusCode
+		_ = send(t, rt, ctx)
+	}
+	rgw.statusCode = 0
+	if err := send(t, rt, ctx); errors.Is(err, ErrOpen) {
+		t.Fatalf("circuit opened after a single consecutive failure")
+	}
+	if err := send(t, rt, ctx); errors.Is(err, ErrOpen) {
+		t.Fatalf("circuit opened after a single consecutive failure reached the backend")
+	}
+	if err := send(t, rt, ctx); !errors.Is(err, ErrOpen) {
+		t.Fatalf("request after 2 consecutive failures error = %v, want %v", err, ErrOpen)
+	}
+}
+
+func TestBreaker_LogicalRequest(t *testing.T) {
+	b, _ := newTestBreaker(Options{FailureThreshold: 2, OpenTimeout: time.Minute})
+	rgw := &backend{statusCode: http.StatusInternalServerError}
+	rt := b.Transport(rgw)
+
+	// the retries of one request count as a single failure
+	ctx := WithRequest(context.Background())
+	for i := 0; i < 6; i++ {
+		if err := send(t, rt, ctx); err != nil {
+			t.Fatalf("attempt %d error = %v, want the response", i, err)
+		}
+	}
+	if err := send(t, rt, WithRequest(context.Background())); err != nil {
+		t.Fatalf("second request error = %v, want the response", err)
+	}
+	if err := send(t, rt, WithRequest(context.Background())); !errors.Is(err, ErrOpen) {
+		t.Fatalf("request after 2 failed requests error = %v, want %v", err, ErrOpen)
+	}
+}
+
+func TestBreaker_Cancelled(t *testing.T) {
+	b, _ := newTestBreaker(Options{FailureThreshold: 1, OpenTimeout: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	rt := b.Transport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		cancel()
+		return nil, context.Canceled
+	}))
+	if err := send(t, rt, ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled request error = %v, want %v", err, context.Canceled)
+	}
+	if b.state != closed {
+		t.Errorf("circuit opened by a request cancelled by the caller")
+	}
+}
+
+// hookContext runs a hook the first time Done is called once armed, e.g. while a request waits for a slot
+type hookContext struct {
+	context.Context
+	armed bool
+	hook  func()
+}
+
+func (c *hookContext) Done() <-chan struct{} {
+	if c.armed {
+		c.armed = false
+		c.hook()
+	}
+	return c.Context.Done()
+}
+
+func TestBreaker_CancelledBeforeProbe(t *testing.T) {
+	b, c := newTestBreaker(Options{FailureThreshold: 1, OpenTimeout: time.Minute, MaxInFlight: 1})
+	requests := 0
+	probeStarted := make(chan struct{})
+	releaseProbe := make(chan struct{})
+	rt := b.Transport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		requests++
+		if requests == 1 {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+		}
+		close(probeStarted)
+		<-releaseProbe
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+
+	// a request is admitted while the circuit is closed, and waits for the slot while the circuit opens and
+	// the probe takes the slot. It is cancelled while the probe is in flight.
+	probeDone := make(chan error)
+	waitingCtx, cancel := context.WithCancel(context.Background())
+	ctx := &hookContext{Context: waitingCtx, hook: func() {
+		if err := send(t, rt, context.Background()); err != nil {
+			t.Errorf("failing request error = %v, want the response", err)
+		}
+		c.now = c.now.Add(time.Minute)
+		go func() { probeDone <- send(t, rt, context.Background()) }()
+		<-probeStarted
+		cancel()
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://rgw/bucket", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	ctx.armed = true
+	if _, err := rt.RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("waiting request error = %v, want %v", err, context.Canceled)
+	}
+
+	// the probe is still in flight, no second probe is let through
+	if b.state != halfOpen {
+		t.Errorf("circuit state = %v after cancelling a request which is not the probe, want half open", b.state)
+	}
+	// a second probe would wait for the slot of the first one
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), time.Second)
+	defer cancelTimeout()
+	if err := send(t, rt, timeoutCtx); !errors.Is(err, ErrOpen) {
+		t.Errorf("request while the probe is in flight error = %v, want %v", err, ErrOpen)
+	}
+	close(releaseProbe)
+	if err := <-probeDone; err != nil {
+		t.Fatalf("probe error = %v", err)
+	}
+	if b.state != closed {
+		t.Errorf("circuit state = %v after a successful probe, want closed", b.state)
+	}
+}
+
+func TestBreaker_MaxInFlight(t *testing.T) {
+	b, _ := newTestBreaker(Options{MaxInFlight: 1})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	rt := b.Transport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+
+	done := make(chan error)
+	go func() { done <- send(t, rt, context.Background()) }()
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := send(t, rt, ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("request over the in-flight limit error = %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("request in flight error = %v", err)
+	}
+}
+
+func TestSet_Transport(t *testing.T) {
+	var nilSet *Set
+	rgw := &backend{statusCode: http.StatusOK}
+	if rt := nilSet.Transport("http://rgw", rgw); rt != http.RoundTripper(rgw) {
+		t.Errorf("nil Set.Transport() = %v, want the transport unchanged", rt)
+	}
+
+	s := NewSet(Options{FailureThreshold: 1, OpenTimeout: time.Minute})
+	failing := &backend{}
+	_ = send(t, s.Transport("http://rgw-a", failing), context.Background())
+	// the clients of an endpoint share its breaker, other endpoints are not affected
+	if err := send(t, s.Transport("http://rgw-a", failing), context.Background()); !errors.Is(err, ErrOpen) {
+		t.Errorf("request to the failing endpoint error = %v, want %v", err, ErrOpen)
+	}
+	if err := send(t, s.Transport("http://rgw-b", rgw), context.Background()); err != nil {
+		t.Errorf("request to another endpoint error = %v", err)
+	}
+}
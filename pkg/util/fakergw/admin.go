@@ -0,0 +1,533 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakergw
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+)
+
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/admin/user":
+		switch {
+		case q.Has("key"):
+			s.adminUserKey(w, r, q)
+		case q.Has("quota"):
+			s.adminUserQuota(w, r, q)
+		case q.Has("subuser"):
+			s.adminSubuser(w, r, q)
+		default:
+			s.adminUser(w, r, q)
+		}
+	case "/admin/metadata/user":
+		writeJSON(w, sortedKeys(s.users))
+	case "/admin/bucket":
+		switch {
+		case q.Has("quota"):
+			s.adminBucketQuota(w, r, q)
+		case q.Has("sync"):
+			s.adminBucketSync(w, r, q)
+		default:
+			s.adminBucket(w, r, q)
+		}
+	case "/admin/log":
+		s.adminBucketIndexLog(w, r, q)
+	case "/admin/ratelimit":
+		s.adminRateLimit(w, r, q)
+	default:
+		writeAdminError(w, http.StatusNotFound, "NotImplemented")
+	}
+}
+
+func (s *Server) adminUser(w http.ResponseWriter, r *http.Request, q url.Values) {
+	uid := q.Get("uid")
+	switch r.Method {
+	case http.MethodGet:
+		u, ok := s.users[uid]
+		if accessKey := q.Get("access-key"); uid == "" && accessKey != "" {
+			u, _ = s.findKey(accessKey)
+			ok = u != nil
+		}
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "NoSuchUser")
+			return
+		}
+		writeJSON(w, s.userInfo(u, q.Get("stats") == "true"))
+	case http.MethodPut:
+		if _, ok := s.users[uid]; ok {
+			writeAdminError(w, http.StatusConflict, "UserAlreadyExists")
+			return
+		}
+		u := &User{
+			ID:          uid,
+			DisplayName: q.Get("display-name"),
+			MaxBuckets:  defaultMaxBuckets,
+			OpMask:      "read, write, delete",
+		}
+		if err := applyUserParams(u, q); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		if q.Get("generate-key") != "false" {
+			accessKey, secretKey := q.Get("access-key"), q.Get("secret-key")
+			if accessKey == "" {
+				accessKey, secretKey = s.newKey()
+			}
+			u.Keys = append(u.Keys, rgwadmin.UserKeySpec{User: uid, AccessKey: accessKey, SecretKey: secretKey})
+		}
+		s.users[uid] = u
+		writeJSON(w, s.userInfo(u, false))
+	case http.MethodPost:
+		u, ok := s.users[uid]
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "NoSuchUser")
+			return
+		}
+		if err := applyUserParams(u, q); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		writeJSON(w, s.userInfo(u, false))
+	case http.MethodDelete:
+		if _, ok := s.users[uid]; !ok {
+			writeAdminError(w, http.StatusNotFound, "NoSuchUser")
+			return
+		}
+		if q.Get("purge-data") == "1" {
+			for name, b := range s.buckets {
+				if b.Owner == uid {
+					delete(s.buckets, name)
+				}
+			}
+		}
+		delete(s.users, uid)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// applyUserParams applies the modifiable user settings of a create or modify request
+func applyUserParams(u *User, q url.Values) error {
+	if v := q.Get("display-name"); v != "" {
+		u.DisplayName = v
+	}
+	if v := q.Get("op-mask"); v != "" {
+		u.OpMask = v
+	}
+	if v := q.Get("max-buckets"); v != "" {
+		maxBuckets, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		u.MaxBuckets = maxBuckets
+	}
+	if v := q.Get("suspended"); v != "" {
+		suspended, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		u.Suspended = suspended
+	}
+	return nil
+}
+
+func (s *Server) userInfo(u *User, stats bool) rgwadmin.User {
+	maxBuckets, suspended := u.MaxBuckets, u.Suspended
+	info := rgwadmin.User{
+		ID:          u.ID,
+		DisplayName: u.DisplayName,
+		MaxBuckets:  &maxBuckets,
+		Suspended:   &suspended,
+		OpMask:      u.OpMask,
+		Keys:        append([]rgwadmin.UserKeySpec{}, u.Keys...),
+		Subusers:    append([]rgwadmin.SubuserSpec{}, u.Subusers...),
+		Caps:        append([]rgwadmin.UserCapSpec{}, u.Caps...),
+		UserQuota:   u.Quota,
+		Type:        "rgw",
+	}
+	if stats {
+		var size, objects uint64
+		for _, b := range s.buckets {
+			if b.Owner == u.ID {
+				bucketSize, bucketObjects := b.usage()
+				size += bucketSize
+				objects += bucketObjects
+			}
+		}
+		info.Stat = rgwadmin.UserStat{Size: &size, SizeRounded: &size, NumObjects: &objects}
+	}
+	return info
+}
+
+func (s *Server) adminUserKey(w http.ResponseWriter, r *http.Request, q url.Values) {
+	u, ok := s.users[q.Get("uid")]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "NoSuchUser")
+		return
+	}
+	owner := u.ID
+	if subuser := q.Get("subuser"); subuser != "" {
+		owner = qualifySubuser(u.ID, subuser)
+		if !u.hasSubuser(owner) {
+			writeAdminError(w, http.StatusNotFound, "NoSuchSubUser")
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodPut:
+		accessKey, secretKey := q.Get("access-key"), q.Get("secret-key")
+		if accessKey == "" {
+			accessKey, secretKey = s.newKey()
+		} else if existing, _ := s.findKey(accessKey); existing != nil {
+			writeAdminError(w, http.StatusConflict, "KeyExists")
+			return
+		}
+		u.Keys = append(u.Keys, rgwadmin.UserKeySpec{User: owner, AccessKey: accessKey, SecretKey: secretKey})
+		writeJSON(w, u.Keys)
+	case http.MethodDelete:
+		for i, k := range u.Keys {
+			if k.AccessKey == q.Get("access-key") && k.User == owner {
+				u.Keys = append(u.Keys[:i], u.Keys[i+1:]...)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+		writeAdminError(w, http.StatusNotFound, "InvalidAccessKey")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) adminSubuser(w http.ResponseWriter, r *http.Request, q url.Values) {
+	u, ok := s.users[q.Get("uid")]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "NoSuchUser")
+		return
+	}
+	subuser := qualifySubuser(u.ID, q.Get("subuser"))
+	switch r.Method {
+	case http.MethodPut:
+		if u.hasSubuser(subuser) {
+			writeAdminError(w, http.StatusConflict, "SubuserExists")
+			return
+		}
+		u.Subusers = append(u.Subusers, rgwadmin.SubuserSpec{Name: subuser, Access: rgwadmin.SubuserAccess(q.Get("access"))})
+		writeJSON(w, u.Subusers)
+	case http.MethodPost:
+		for i := range u.Subusers {
+			if u.Subusers[i].Name == subuser {
+				u.Subusers[i].Access = rgwadmin.SubuserAccess(q.Get("access"))
+				writeJSON(w, u.Subusers)
+				return
+			}
+		}
+		writeAdminError(w, http.StatusNotFound, "NoSuchSubUser")
+	case http.MethodDelete:
+		if !u.hasSubuser(subuser) {
+			writeAdminError(w, http.StatusNotFound, "NoSuchSubUser")
+			return
+		}
+		subusers := u.Subusers[:0]
+		for _, su := range u.Subusers {
+			if su.Name != subuser {
+				subusers = append(subusers, su)
+			}
+		}
+		u.Subusers = subusers
+		if q.Get("purge-keys") != "false" {
+			keys := u.Keys[:0]
+			for _, k := range u.Keys {
+				if k.User != subuser {
+					keys = append(keys, k)
+				}
+			}
+			u.Keys = keys
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (u *User) hasSubuser(subuser string) bool {
+	for _, su := range u.Subusers {
+		if su.Name == subuser {
+			return true
+		}
+	}
+	return false
+}
+
+// qualifySubuser returns the subuser ID in the uid:subuser form RGW reports it in
+func qualifySubuser(uid, subuser string) string {
+	if strings.Contains(subuser, ":") {
+		return subuser
+	}
+	return uid + ":" + subuser
+}
+
+func (s *Server) adminUserQuota(w http.ResponseWriter, r *http.Request, q url.Values) {
+	u, ok := s.users[q.Get("uid")]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "NoSuchUser")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, u.Quota)
+	case http.MethodPut:
+		quota, err := parseQuota(q)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		u.Quota = quota
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func parseQuota(q url.Values) (rgwadmin.QuotaSpec, error) {
+	enabled := q.Get("enabled") == "true"
+	maxSize, maxObjects := int64(-1), int64(-1)
+	var err error
+	if v := q.Get("max-size"); v != "" {
+		if maxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return rgwadmin.QuotaSpec{}, err
+		}
+	}
+	if v := q.Get("max-size-kb"); v != "" {
+		kb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return rgwadmin.QuotaSpec{}, err
+		}
+		maxSize = kb * 1024
+	}
+	if v := q.Get("max-objects"); v != "" {
+		if maxObjects, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return rgwadmin.QuotaSpec{}, err
+		}
+	}
+	maxSizeKb := int(maxSize / 1024)
+	return rgwadmin.QuotaSpec{
+		Enabled:    &enabled,
+		MaxSize:    &maxSize,
+		MaxSizeKb:  &maxSizeKb,
+		MaxObjects: &maxObjects,
+	}, nil
+}
+
+func (s *Server) adminBucket(w http.ResponseWriter, r *http.Request, q url.Values) {
+	name := q.Get("bucket")
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" {
+			names := []string{}
+			for _, n := range sortedKeys(s.buckets) {
+				if uid := q.Get("uid"); uid == "" || s.buckets[n].Owner == uid {
+					names = append(names, n)
+				}
+			}
+			writeJSON(w, names)
+			return
+		}
+		b, ok := s.buckets[name]
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "NoSuchBucket")
+			return
+		}
+		writeJSON(w, b.info())
+	case http.MethodDelete:
+		b, ok := s.buckets[name]
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "NoSuchBucket")
+			return
+		}
+		if len(b.Objects) > 0 && q.Get("purge-objects") != "true" {
+			writeAdminError(w, http.StatusConflict, "BucketNotEmpty")
+			return
+		}
+		delete(s.buckets, name)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) adminBucketQuota(w http.ResponseWriter, r *http.Request, q url.Values) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, ok := s.buckets[q.Get("bucket")]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	quota, err := parseQuota(q)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	b.Quota = quota
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) adminBucketSync(w http.ResponseWriter, r *http.Request, q url.Values) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, ok := s.buckets[q.Get("bucket")]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	enabled, err := strconv.ParseBool(q.Get("sync-bucket"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	b.SyncStopped = !enabled
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) adminBucketIndexLog(w http.ResponseWriter, r *http.Request, q url.Values) {
+	if r.Method != http.MethodGet || q.Get("type") != "bucket-index" || !q.Has("info") {
+		writeAdminError(w, http.StatusNotFound, "NotImplemented")
+		return
+	}
+	b, ok := s.buckets[q.Get("bucket-instance")]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"bucket_ver":  "0#1",
+		"master_ver":  "0#0",
+		"max_marker":  fmt.Sprintf("00000000001.%d.5", len(b.Objects)),
+		"syncstopped": b.SyncStopped,
+	})
+}
+
+func (s *Server) adminRateLimit(w http.ResponseWriter, r *http.Request, q url.Values) {
+	var limit *RateLimit
+	scope := q.Get("ratelimit-scope")
+	switch scope {
+	case "user":
+		u, ok := s.users[q.Get("uid")]
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "NoSuchUser")
+			return
+		}
+		limit = &u.RateLimit
+	case "bucket":
+		b, ok := s.buckets[q.Get("bucket")]
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "NoSuchBucket")
+			return
+		}
+		limit = &b.RateLimit
+	default:
+		writeAdminError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]RateLimit{scope + "_ratelimit": *limit})
+	case http.MethodPost:
+		updated := *limit
+		for name, value := range map[string]*int64{
+			"max-read-ops":    &updated.MaxReadOps,
+			"max-write-ops":   &updated.MaxWriteOps,
+			"max-read-bytes":  &updated.MaxReadBytes,
+			"max-write-bytes": &updated.MaxWriteBytes,
+		} {
+			if !q.Has(name) {
+				continue
+			}
+			v, err := strconv.ParseInt(q.Get(name), 10, 64)
+			if err != nil || v < 0 {
+				writeAdminError(w, http.StatusBadRequest, "InvalidArgument")
+				return
+			}
+			*value = v
+		}
+		if q.Has("enabled") {
+			enabled, err := strconv.ParseBool(q.Get("enabled"))
+			if err != nil {
+				writeAdminError(w, http.StatusBadRequest, "InvalidArgument")
+				return
+			}
+			updated.Enabled = enabled
+		}
+		*limit = updated
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *Bucket) usage() (uint64, uint64) {
+	var size uint64
+	for _, data := range b.Objects {
+		size += uint64(len(data))
+	}
+	return size, uint64(len(b.Objects))
+}
+
+func (b *Bucket) info() rgwadmin.Bucket {
+	size, objects := b.usage()
+	sizeKb := (size + 1023) / 1024
+	numShards := b.NumShards
+	info := rgwadmin.Bucket{
+		Bucket:        b.Name,
+		NumShards:     &numShards,
+		Zonegroup:     "default",
+		PlacementRule: "default-placement",
+		ID:            b.ID,
+		Marker:        b.ID,
+		IndexType:     "Normal",
+		Owner:         b.Owner,
+		Mtime:         b.Created.UTC().Format(time.RFC3339),
+		BucketQuota:   b.Quota,
+	}
+	info.Usage.RgwMain.Size = &size
+	info.Usage.RgwMain.SizeActual = &size
+	info.Usage.RgwMain.SizeUtilized = &size
+	info.Usage.RgwMain.SizeKb = &sizeKb
+	info.Usage.RgwMain.SizeKbActual = &sizeKb
+	info.Usage.RgwMain.SizeKbUtilized = &sizeKb
+	info.Usage.RgwMain.NumObjects = &objects
+	return info
+}
+
+// newBucketID returns a bucket instance ID in the form RGW uses
+func (s *Server) newBucketID(name string) string {
+	return fmt.Sprintf("fake.%s.%d", name, len(s.buckets)+1)
+}
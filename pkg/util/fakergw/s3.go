@@ -0,0 +1,560 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakergw
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   owner    `xml:"Owner"`
+	Buckets []struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	} `xml:"Buckets>Bucket"`
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Name        string   `xml:"Name"`
+	Prefix      string   `xml:"Prefix"`
+	KeyCount    int      `xml:"KeyCount"`
+	MaxKeys     int      `xml:"MaxKeys"`
+	IsTruncated bool     `xml:"IsTruncated"`
+	Contents    []struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+type tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	TagSet  []struct {
+		Key   string `xml:"Key"`
+		Value string `xml:"Value"`
+	} `xml:"TagSet>Tag"`
+}
+
+type notificationConfiguration struct {
+	XMLName xml.Name             `xml:"NotificationConfiguration"`
+	Xmlns   string               `xml:"xmlns,attr,omitempty"`
+	Topics  []topicConfiguration `xml:"TopicConfiguration"`
+}
+
+type topicConfiguration struct {
+	ID             string       `xml:"Id"`
+	Topic          string       `xml:"Topic"`
+	Events         []string     `xml:"Event"`
+	FilterRules    []filterRule `xml:"Filter>S3Key>FilterRule"`
+	MetadataFilter []filterRule `xml:"Filter>S3Metadata>FilterRule"`
+	TagFilter      []filterRule `xml:"Filter>S3Tags>FilterRule"`
+}
+
+type filterRule struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+type replicationConfiguration struct {
+	XMLName xml.Name          `xml:"ReplicationConfiguration"`
+	Xmlns   string            `xml:"xmlns,attr,omitempty"`
+	Rules   []ReplicationRule `xml:"Rule"`
+}
+
+// policy is the subset of a bucket policy evaluated by the fake
+type policy struct {
+	Statement []struct {
+		Effect    string          `json:"Effect"`
+		Principal json.RawMessage `json:"Principal"`
+		Action    json.RawMessage `json:"Action"`
+	} `json:"Statement"`
+}
+
+func (s *Server) serveS3(w http.ResponseWriter, r *http.Request, caller *User, subuser string) {
+	if !opAllowed(caller.OpMask, r.Method) {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "")
+		return
+	}
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucketName == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.listBuckets(w, caller)
+		return
+	}
+
+	if r.Method == http.MethodPut && key == "" && len(r.URL.Query()) == 0 {
+		s.createBucket(w, caller, bucketName)
+		return
+	}
+
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucketName)
+		return
+	}
+
+	if key != "" {
+		s.serveObject(w, r, caller, subuser, b, key)
+		return
+	}
+
+	// bucket configuration is reserved to the owner, as in RGW without policies granting it
+	if b.Owner != caller.ID {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", bucketName)
+		return
+	}
+	if r.URL.Query().Has("policy") {
+		s.servePolicy(w, r, b)
+		return
+	}
+	if r.URL.Query().Has("tagging") {
+		s.serveTagging(w, r, b)
+		return
+	}
+	if r.URL.Query().Has("notification") {
+		s.serveNotification(w, r, b)
+		return
+	}
+	if r.URL.Query().Has("replication") {
+		s.serveReplication(w, r, b)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		s.listObjects(w, r, b)
+	case http.MethodDelete:
+		if len(b.Objects) > 0 {
+			writeS3Error(w, http.StatusConflict, "BucketNotEmpty", bucketName)
+			return
+		}
+		delete(s.buckets, bucketName)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter, caller *User) {
+	result := listAllMyBucketsResult{Xmlns: s3Namespace, Owner: owner{ID: caller.ID, DisplayName: caller.DisplayName}}
+	for _, name := range sortedKeys(s.buckets) {
+		b := s.buckets[name]
+		if b.Owner != caller.ID {
+			continue
+		}
+		result.Buckets = append(result.Buckets, struct {
+			Name         string `xml:"Name"`
+			CreationDate string `xml:"CreationDate"`
+		}{Name: b.Name, CreationDate: b.Created.UTC().Format(time.RFC3339)})
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) createBucket(w http.ResponseWriter, caller *User, name string) {
+	if b, ok := s.buckets[name]; ok {
+		if b.Owner == caller.ID {
+			writeS3Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou", name)
+		} else {
+			writeS3Error(w, http.StatusConflict, "BucketAlreadyExists", name)
+		}
+		return
+	}
+	if caller.MaxBuckets < 0 || (caller.MaxBuckets > 0 && s.bucketCount(caller.ID) >= caller.MaxBuckets) {
+		writeS3Error(w, http.StatusForbidden, "TooManyBuckets", name)
+		return
+	}
+	s.buckets[name] = &Bucket{
+		Name:      name,
+		ID:        s.newBucketID(name),
+		Owner:     caller.ID,
+		Created:   time.Now(),
+		NumShards: 11,
+		Objects:   map[string][]byte{},
+	}
+	w.Header().Set("Location", "/"+name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) bucketCount(uid string) int {
+	count := 0
+	for _, b := range s.buckets {
+		if b.Owner == uid {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Server) servePolicy(w http.ResponseWriter, r *http.Request, b *Bucket) {
+	switch r.Method {
+	case http.MethodGet:
+		if b.Policy == "" {
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucketPolicy", b.Name)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(b.Policy))
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", b.Name)
+			return
+		}
+		if err := json.Unmarshal(data, &policy{}); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedPolicy", b.Name)
+			return
+		}
+		b.Policy = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		b.Policy = ""
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveTagging(w http.ResponseWriter, r *http.Request, b *Bucket) {
+	switch r.Method {
+	case http.MethodGet:
+		if len(b.Tags) == 0 {
+			writeS3Error(w, http.StatusNotFound, "NoSuchTagSet", b.Name)
+			return
+		}
+		result := tagging{Xmlns: s3Namespace}
+		for _, k := range sortedKeys(b.Tags) {
+			result.TagSet = append(result.TagSet, struct {
+				Key   string `xml:"Key"`
+				Value string `xml:"Value"`
+			}{Key: k, Value: b.Tags[k]})
+		}
+		writeXML(w, result)
+	case http.MethodPut:
+		t := tagging{}
+		if err := xml.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML", b.Name)
+			return
+		}
+		b.Tags = map[string]string{}
+		for _, tag := range t.TagSet {
+			b.Tags[tag.Key] = tag.Value
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		b.Tags = nil
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveNotification(w http.ResponseWriter, r *http.Request, b *Bucket) {
+	switch r.Method {
+	case http.MethodGet:
+		result := notificationConfiguration{Xmlns: s3Namespace}
+		for _, n := range b.Notifications {
+			t := topicConfiguration{ID: n.ID, Topic: n.TopicARN, Events: n.Events}
+			for _, rule := range []filterRule{{"prefix", n.Prefix}, {"suffix", n.Suffix}, {"regex", n.Regex}} {
+				if rule.Value != "" {
+					t.FilterRules = append(t.FilterRules, rule)
+				}
+			}
+			t.MetadataFilter = filterRules(n.MetadataFilter)
+			t.TagFilter = filterRules(n.TagFilter)
+			result.Topics = append(result.Topics, t)
+		}
+		writeXML(w, result)
+	case http.MethodPut:
+		config := notificationConfiguration{}
+		if err := xml.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML", b.Name)
+			return
+		}
+		notifications := make([]Notification, 0, len(config.Topics))
+		for _, t := range config.Topics {
+			if _, ok := s.topics[strings.TrimPrefix(t.Topic, topicARNPrefix)]; !ok {
+				writeS3Error(w, http.StatusBadRequest, "InvalidArgument", b.Name)
+				return
+			}
+			n := Notification{ID: t.ID, TopicARN: t.Topic, Events: t.Events}
+			for _, rule := range t.FilterRules {
+				switch strings.ToLower(rule.Name) {
+				case "prefix":
+					n.Prefix = rule.Value
+				case "suffix":
+					n.Suffix = rule.Value
+				case "regex":
+					n.Regex = rule.Value
+				}
+			}
+			n.MetadataFilter = filterMap(t.MetadataFilter)
+			n.TagFilter = filterMap(t.TagFilter)
+			notifications = append(notifications, n)
+		}
+		b.Notifications = notifications
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// filterRules returns the filter rules of a metadata or tag filter, sorted by name
+func filterRules(filter map[string]string) []filterRule {
+	rules := make([]filterRule, 0, len(filter))
+	for _, name := range sortedKeys(filter) {
+		rules = append(rules, filterRule{Name: name, Value: filter[name]})
+	}
+	return rules
+}
+
+// filterMap returns the metadata or tag filter of the filter rules, nil without rules
+func filterMap(rules []filterRule) map[string]string {
+	if len(rules) == 0 {
+		return nil
+	}
+	filter := make(map[string]string, len(rules))
+	for _, rule := range rules {
+		filter[rule.Name] = rule.Value
+	}
+	return filter
+}
+
+func (s *Server) serveReplication(w http.ResponseWriter, r *http.Request, b *Bucket) {
+	switch r.Method {
+	case http.MethodGet:
+		if len(b.Replication) == 0 {
+			writeS3Error(w, http.StatusNotFound, "ReplicationConfigurationNotFoundError", b.Name)
+			return
+		}
+		writeXML(w, replicationConfiguration{Xmlns: s3Namespace, Rules: b.Replication})
+	case http.MethodPut:
+		config := replicationConfiguration{}
+		if err := xml.NewDecoder(r.Body).Decode(&config); err != nil || len(config.Rules) == 0 {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML", b.Name)
+			return
+		}
+		b.Replication = config.Rules
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		b.Replication = nil
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, b *Bucket) {
+	prefix := r.URL.Query().Get("prefix")
+	result := listBucketResult{Xmlns: s3Namespace, Name: b.Name, Prefix: prefix, MaxKeys: 1000}
+	for _, key := range sortedKeys(b.Objects) {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key  string `xml:"Key"`
+			Size int    `xml:"Size"`
+		}{Key: key, Size: len(b.Objects[key])})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, caller *User, subuser string, b *Bucket, key string) {
+	var action string
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		action = "s3:GetObject"
+	case http.MethodPut:
+		action = "s3:PutObject"
+	case http.MethodDelete:
+		action = "s3:DeleteObject"
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	principal := caller.ID
+	if subuser != "" {
+		principal = subuser
+	}
+	if b.Owner != caller.ID && !policyAllows(b.Policy, principal, action) {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", b.Name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		data, ok := b.Objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", b.Name)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", b.Name)
+			return
+		}
+		if s.quotaExceeded(b, key, int64(len(data))) {
+			writeS3Error(w, http.StatusForbidden, "QuotaExceeded", b.Name)
+			return
+		}
+		b.Objects[key] = data
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		delete(b.Objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// quotaExceeded checks the bucket quota and the quota of the bucket owner for writing an object
+func (s *Server) quotaExceeded(b *Bucket, key string, size int64) bool {
+	newObjects := int64(1)
+	if old, ok := b.Objects[key]; ok {
+		newObjects = 0
+		size -= int64(len(old))
+	}
+	bucketSize, bucketObjects := b.usage()
+	if exceeds(b.Quota.Enabled, b.Quota.MaxSize, int64(bucketSize)+size) ||
+		exceeds(b.Quota.Enabled, b.Quota.MaxObjects, int64(bucketObjects)+newObjects) {
+		return true
+	}
+	owner, ok := s.users[b.Owner]
+	if !ok {
+		return false
+	}
+	var userSize, userObjects int64
+	for _, ob := range s.buckets {
+		if ob.Owner == owner.ID {
+			obSize, obObjects := ob.usage()
+			userSize += int64(obSize)
+			userObjects += int64(obObjects)
+		}
+	}
+	return exceeds(owner.Quota.Enabled, owner.Quota.MaxSize, userSize+size) ||
+		exceeds(owner.Quota.Enabled, owner.Quota.MaxObjects, userObjects+newObjects)
+}
+
+func exceeds(enabled *bool, limit *int64, value int64) bool {
+	return enabled != nil && *enabled && limit != nil && *limit >= 0 && value > *limit
+}
+
+// opAllowed checks the HTTP method against the op mask of the user
+func opAllowed(opMask, method string) bool {
+	var op string
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		op = "read"
+	case http.MethodPut, http.MethodPost:
+		op = "write"
+	case http.MethodDelete:
+		op = "delete"
+	default:
+		return false
+	}
+	for _, o := range strings.Split(opMask, ",") {
+		if strings.TrimSpace(o) == op || strings.TrimSpace(o) == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// policyAllows evaluates the Allow statements of a bucket policy for the user and action.
+// Deny statements, conditions and resources are not evaluated.
+func policyAllows(bucketPolicy, uid, action string) bool {
+	if bucketPolicy == "" {
+		return false
+	}
+	p := policy{}
+	if err := json.Unmarshal([]byte(bucketPolicy), &p); err != nil {
+		return false
+	}
+	principal := "arn:aws:iam:::user/" + uid
+	for _, st := range p.Statement {
+		if st.Effect != "Allow" {
+			continue
+		}
+		if !contains(principals(st.Principal), principal) {
+			continue
+		}
+		actions := stringList(st.Action)
+		if contains(actions, action) || contains(actions, "s3:*") {
+			return true
+		}
+	}
+	return false
+}
+
+// principals returns the AWS principals of a statement, "*" matches any principal
+func principals(raw json.RawMessage) []string {
+	var wildcard string
+	if json.Unmarshal(raw, &wildcard) == nil && wildcard == "*" {
+		return []string{"*"}
+	}
+	aws := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &aws); err != nil {
+		return nil
+	}
+	return stringList(aws["AWS"])
+}
+
+// stringList decodes a policy element which may either be a string or a list of strings
+func stringList(raw json.RawMessage) []string {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []string{single}
+	}
+	var list []string
+	_ = json.Unmarshal(raw, &list)
+	return list
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value || v == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,451 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakergw provides an in-process fake of the RADOS Gateway for tests.
+// It implements the subset of the admin ops and S3 APIs used by the driver on top of
+// in-memory state, so that tests can observe the effects of driver operations.
+package fakergw
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+)
+
+const (
+	// AdminUser is the user holding the admin caps, its keys are used to sign admin ops requests
+	AdminUser = "cosi-admin"
+	// AdminAccessKey is the access key of the AdminUser
+	AdminAccessKey = "FAKEADMINACCESSKEY"
+	// AdminSecretKey is the secret key of the AdminUser
+	AdminSecretKey = "fakeadminsecretkey"
+
+	// defaultMaxBuckets is the max_buckets RGW gives to new users
+	defaultMaxBuckets = 1000
+)
+
+// User is the state of a RGW user
+type User struct {
+	ID          string
+	DisplayName string
+	MaxBuckets  int
+	Suspended   int
+	OpMask      string
+	Keys        []rgwadmin.UserKeySpec
+	Subusers    []rgwadmin.SubuserSpec
+	Caps        []rgwadmin.UserCapSpec
+	Quota       rgwadmin.QuotaSpec
+	RateLimit   RateLimit
+}
+
+// Bucket is the state of a RGW bucket
+type Bucket struct {
+	Name      string
+	ID        string
+	Owner     string
+	Created   time.Time
+	NumShards uint64
+	Policy    string
+	Tags      map[string]string
+	Quota     rgwadmin.QuotaSpec
+	Objects   map[string][]byte
+	// Notifications publish the events of the bucket to topics
+	Notifications []Notification
+	// Replication is the sync policy of the bucket set through the replication API
+	Replication []ReplicationRule
+	// SyncStopped is set when the sync of the bucket was disabled
+	SyncStopped bool
+	RateLimit   RateLimit
+}
+
+// RateLimit is the rate limit of a user or bucket, in the JSON form of the admin ops API
+type RateLimit struct {
+	MaxReadOps    int64 `json:"max_read_ops"`
+	MaxWriteOps   int64 `json:"max_write_ops"`
+	MaxReadBytes  int64 `json:"max_read_bytes"`
+	MaxWriteBytes int64 `json:"max_write_bytes"`
+	Enabled       bool  `json:"enabled"`
+}
+
+// ReplicationRule is a rule of the replication configuration of a bucket, with the zone extensions of RGW
+type ReplicationRule struct {
+	ID               string   `xml:"ID"`
+	Status           string   `xml:"Status"`
+	SourceZones      []string `xml:"Source>Zone"`
+	DestinationZones []string `xml:"Destination>Zone"`
+}
+
+// Notification is a topic notification configured on a bucket
+type Notification struct {
+	ID       string
+	TopicARN string
+	Events   []string
+	Prefix   string
+	Suffix   string
+	Regex    string
+	// MetadataFilter and TagFilter match the metadata and tags of the objects
+	MetadataFilter map[string]string
+	TagFilter      map[string]string
+}
+
+// Topic is a bucket notification topic
+type Topic struct {
+	Name       string
+	ARN        string
+	Owner      string
+	Attributes map[string]string
+}
+
+// Server is a fake RGW serving the admin ops and S3 APIs over HTTP
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	users    map[string]*User
+	buckets  map[string]*Bucket
+	topics   map[string]*Topic
+	keyCount int
+	failures []*failure
+}
+
+// failure is an error injected into the responses of matching requests
+type failure struct {
+	match      func(*http.Request) bool
+	remaining  int
+	statusCode int
+	code       string
+}
+
+// New starts a fake RGW with an admin user, it must be closed by the caller
+func New() *Server {
+	s := &Server{
+		users:   map[string]*User{},
+		buckets: map[string]*Bucket{},
+		topics:  map[string]*Topic{},
+	}
+	s.users[AdminUser] = &User{
+		ID:          AdminUser,
+		DisplayName: AdminUser,
+		MaxBuckets:  defaultMaxBuckets,
+		OpMask:      "read, write, delete",
+		Keys:        []rgwadmin.UserKeySpec{{User: AdminUser, AccessKey: AdminAccessKey, SecretKey: AdminSecretKey}},
+		Caps:        []rgwadmin.UserCapSpec{{Type: "users", Perm: "*"}, {Type: "buckets", Perm: "*"}},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SecretData returns the data of an object store user secret pointing to the fake with admin credentials
+func (s *Server) SecretData() map[string][]byte {
+	return map[string][]byte{
+		"Endpoint":  []byte(s.URL),
+		"AccessKey": []byte(AdminAccessKey),
+		"SecretKey": []byte(AdminSecretKey),
+	}
+}
+
+// FailRequests makes the next times requests accepted by match fail with the HTTP status code and error code,
+// e.g. to test how a caller recovers from a request failing halfway
+func (s *Server) FailRequests(match func(*http.Request) bool, times, statusCode int, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{match: match, remaining: times, statusCode: statusCode, code: code})
+}
+
+// User returns a copy of the user with the given ID
+func (s *Server) User(uid string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[uid]
+	if !ok {
+		return User{}, false
+	}
+	return u.clone(), true
+}
+
+// Users returns the IDs of all users
+func (s *Server) Users() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.users)
+}
+
+// Bucket returns a copy of the bucket with the given name
+func (s *Server) Bucket(name string) (Bucket, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[name]
+	if !ok {
+		return Bucket{}, false
+	}
+	return b.clone(), true
+}
+
+// Buckets returns the names of all buckets
+func (s *Server) Buckets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.buckets)
+}
+
+// Topic returns a copy of the topic with the given name
+func (s *Server) Topic(name string) (Topic, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[name]
+	if !ok {
+		return Topic{}, false
+	}
+	return t.clone(), true
+}
+
+// Topics returns the names of all topics
+func (s *Server) Topics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.topics)
+}
+
+// CreateTopic creates a topic owned by the admin user, bypassing authorization
+func (s *Server) CreateTopic(name string) Topic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &Topic{Name: name, ARN: topicARNPrefix + name, Owner: AdminUser, Attributes: map[string]string{}}
+	s.topics[name] = t
+	return t.clone()
+}
+
+// PutNotification adds a notification to a bucket, bypassing authorization
+func (s *Server) PutNotification(bucket string, n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return fmt.Errorf("bucket %q not found", bucket)
+	}
+	b.Notifications = append(b.Notifications, n)
+	return nil
+}
+
+// PutObject stores an object in a bucket, bypassing authorization
+func (s *Server) PutObject(bucket, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return fmt.Errorf("bucket %q not found", bucket)
+	}
+	b.Objects[key] = data
+	return nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	caller, subuser, ok := s.authenticate(r)
+	if !ok {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			writeAdminError(w, http.StatusForbidden, "InvalidAccessKeyId")
+		} else {
+			writeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId", "")
+		}
+		return
+	}
+
+	for _, f := range s.failures {
+		if f.remaining == 0 || !f.match(r) {
+			continue
+		}
+		f.remaining--
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/admin/"):
+			writeAdminError(w, f.statusCode, f.code)
+		case r.Method == http.MethodPost && r.URL.Path == "/":
+			writeSNSError(w, f.statusCode, f.code, "")
+		default:
+			writeS3Error(w, f.statusCode, f.code, "")
+		}
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		if len(caller.Caps) == 0 {
+			writeAdminError(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		s.serveAdmin(w, r)
+		return
+	}
+	// the SNS API is served on the root path with the action in the form
+	if r.Method == http.MethodPost && r.URL.Path == "/" {
+		s.serveSNS(w, r, caller)
+		return
+	}
+	s.serveS3(w, r, caller, subuser)
+}
+
+// authenticate finds the user, and subuser if any, owning the access key the request was signed with.
+// Signatures are not verified.
+func (s *Server) authenticate(r *http.Request) (*User, string, bool) {
+	auth := r.Header.Get("Authorization")
+	_, credential, found := strings.Cut(auth, "Credential=")
+	if !found {
+		return nil, "", false
+	}
+	accessKey, _, _ := strings.Cut(credential, "/")
+	for _, u := range s.users {
+		for _, k := range u.Keys {
+			if k.AccessKey == accessKey {
+				if k.User != u.ID {
+					return u, k.User, true
+				}
+				return u, "", true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// newKey generates a unique key pair
+func (s *Server) newKey() (string, string) {
+	s.keyCount++
+	return fmt.Sprintf("FAKEACCESSKEY%07d", s.keyCount), fmt.Sprintf("fakesecretkey%027d", s.keyCount)
+}
+
+func (s *Server) findKey(accessKey string) (*User, int) {
+	for _, u := range s.users {
+		for i, k := range u.Keys {
+			if k.AccessKey == accessKey {
+				return u, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]string{"Code": code, "RequestId": "fake", "HostId": "fake"})
+}
+
+type s3Error struct {
+	XMLName    xml.Name `xml:"Error"`
+	Code       string   `xml:"Code"`
+	Message    string   `xml:"Message"`
+	BucketName string   `xml:"BucketName,omitempty"`
+	RequestID  string   `xml:"RequestId"`
+}
+
+func writeS3Error(w http.ResponseWriter, statusCode int, code, bucket string) {
+	writeXMLStatus(w, statusCode, s3Error{Code: code, Message: code, BucketName: bucket, RequestID: "fake"})
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	writeXMLStatus(w, http.StatusOK, v)
+}
+
+func writeXMLStatus(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+// clone returns a copy of the user sharing no state with it, so that callers cannot change the fake behind its lock
+func (u *User) clone() User {
+	c := *u
+	c.Keys = slices.Clone(u.Keys)
+	c.Subusers = slices.Clone(u.Subusers)
+	c.Caps = slices.Clone(u.Caps)
+	c.Quota = cloneQuota(u.Quota)
+	return c
+}
+
+// clone returns a copy of the bucket sharing no state with it
+func (b *Bucket) clone() Bucket {
+	c := *b
+	c.Tags = maps.Clone(b.Tags)
+	c.Quota = cloneQuota(b.Quota)
+	if b.Objects != nil {
+		c.Objects = make(map[string][]byte, len(b.Objects))
+		for key, data := range b.Objects {
+			c.Objects[key] = slices.Clone(data)
+		}
+	}
+	c.Notifications = slices.Clone(b.Notifications)
+	for i, n := range c.Notifications {
+		c.Notifications[i].Events = slices.Clone(n.Events)
+		c.Notifications[i].MetadataFilter = maps.Clone(n.MetadataFilter)
+		c.Notifications[i].TagFilter = maps.Clone(n.TagFilter)
+	}
+	c.Replication = slices.Clone(b.Replication)
+	for i, rule := range c.Replication {
+		c.Replication[i].SourceZones = slices.Clone(rule.SourceZones)
+		c.Replication[i].DestinationZones = slices.Clone(rule.DestinationZones)
+	}
+	return c
+}
+
+// clone returns a copy of the topic sharing no state with it
+func (t *Topic) clone() Topic {
+	c := *t
+	c.Attributes = maps.Clone(t.Attributes)
+	return c
+}
+
+func cloneQuota(q rgwadmin.QuotaSpec) rgwadmin.QuotaSpec {
+	q.Enabled = clonePointer(q.Enabled)
+	q.MaxSize = clonePointer(q.MaxSize)
+	q.MaxSizeKb = clonePointer(q.MaxSizeKb)
+	q.MaxObjects = clonePointer(q.MaxObjects)
+	return q
+}
+
+func clonePointer[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
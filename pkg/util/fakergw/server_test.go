@@ -0,0 +1,276 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakergw
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/rgwerr"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/s3client"
+)
+
+// newTestServer starts a fake with an admin ops client of the admin user
+func newTestServer(t *testing.T) (*Server, *rgwadmin.API) {
+	t.Helper()
+	srv := New()
+	t.Cleanup(srv.Close)
+	admin, err := rgwadmin.New(srv.URL, AdminAccessKey, AdminSecretKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, admin
+}
+
+// newUserClient creates a user and returns an S3 client with its key
+func newUserClient(t *testing.T, srv *Server, admin *rgwadmin.API, uid string) *s3client.S3Agent {
+	t.Helper()
+	user, err := admin.CreateUser(context.Background(), rgwadmin.User{ID: uid, DisplayName: uid})
+	if err != nil {
+		t.Fatalf("CreateUser(%s) error = %v", uid, err)
+	}
+	client, err := s3client.NewS3Agent(user.Keys[0].AccessKey, user.Keys[0].SecretKey, srv.URL, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestServer_Admin_NotFound(t *testing.T) {
+	srv, admin := newTestServer(t)
+	ctx := context.Background()
+	newUserClient(t, srv, admin, "user-1")
+
+	tests := []struct {
+		name string
+		call func() error
+		want string
+	}{
+		{"Get missing user", func() error {
+			_, err := admin.GetUser(ctx, rgwadmin.User{ID: "missing"})
+			return err
+		}, "NoSuchUser"},
+		{"Get user of missing access key", func() error {
+			_, err := admin.GetUser(ctx, rgwadmin.User{Keys: []rgwadmin.UserKeySpec{{AccessKey: "missing"}}})
+			return err
+		}, "NoSuchUser"},
+		{"Remove missing user", func() error {
+			return admin.RemoveUser(ctx, rgwadmin.User{ID: "missing"})
+		}, "NoSuchUser"},
+		{"Remove missing key", func() error {
+			return admin.RemoveKey(ctx, rgwadmin.UserKeySpec{UID: "user-1", AccessKey: "missing"})
+		}, "InvalidAccessKey"},
+		{"Get rate limit of missing user", func() error {
+			_, err := adminops.GetUserRateLimit(ctx, admin, "missing")
+			return err
+		}, "NoSuchUser"},
+		{"Get missing bucket", func() error {
+			_, err := admin.GetBucketInfo(ctx, rgwadmin.Bucket{Bucket: "missing"})
+			return err
+		}, "NoSuchBucket"},
+		{"Remove missing bucket", func() error {
+			return admin.RemoveBucket(ctx, rgwadmin.Bucket{Bucket: "missing"})
+		}, "NoSuchBucket"},
+		{"Get rate limit of missing bucket", func() error {
+			_, err := adminops.GetBucketRateLimit(ctx, admin, "missing")
+			return err
+		}, "NoSuchBucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !rgwerr.HasCode(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_Admin_Keys(t *testing.T) {
+	srv, admin := newTestServer(t)
+	ctx := context.Background()
+	newUserClient(t, srv, admin, "user-1")
+
+	keys, err := admin.CreateKey(ctx, rgwadmin.UserKeySpec{UID: "user-1", AccessKey: "SECONDKEY", SecretKey: "secret"})
+	if err != nil {
+		t.Fatalf("CreateKey() error = %v", err)
+	}
+	if len(*keys) != 2 || (*keys)[1].AccessKey != "SECONDKEY" {
+		t.Errorf("CreateKey() = %+v, want the generated and the created key", *keys)
+	}
+	if _, err := admin.CreateKey(ctx, rgwadmin.UserKeySpec{UID: AdminUser, AccessKey: "SECONDKEY"}); !errors.Is(err, rgwadmin.ErrKeyExists) {
+		t.Errorf("CreateKey() of an existing access key error = %v, want %v", err, rgwadmin.ErrKeyExists)
+	}
+
+	// the user of an access key is found without its ID
+	user, err := admin.GetUser(ctx, rgwadmin.User{Keys: []rgwadmin.UserKeySpec{{AccessKey: "SECONDKEY"}}})
+	if err != nil || user.ID != "user-1" {
+		t.Fatalf("GetUser() by access key = %q, %v, want user-1", user.ID, err)
+	}
+	if len(user.Keys) != 2 {
+		t.Errorf("GetUser() keys = %+v, want 2 keys", user.Keys)
+	}
+
+	// a key is only removed for its own user
+	if err := admin.RemoveKey(ctx, rgwadmin.UserKeySpec{UID: AdminUser, AccessKey: "SECONDKEY"}); !errors.Is(err, rgwadmin.ErrInvalidAccessKey) {
+		t.Errorf("RemoveKey() of another user's key error = %v, want %v", err, rgwadmin.ErrInvalidAccessKey)
+	}
+	before, _ := srv.User("user-1")
+	if err := admin.RemoveKey(ctx, rgwadmin.UserKeySpec{UID: "user-1", AccessKey: user.Keys[0].AccessKey}); err != nil {
+		t.Fatalf("RemoveKey() error = %v", err)
+	}
+	after, _ := srv.User("user-1")
+	if len(after.Keys) != 1 || after.Keys[0].AccessKey != "SECONDKEY" {
+		t.Errorf("keys after RemoveKey() = %+v, want [SECONDKEY]", after.Keys)
+	}
+	// copies returned before are not changed by later requests
+	if !reflect.DeepEqual(before.Keys, user.Keys) {
+		t.Errorf("copied keys = %+v, changed by RemoveKey() from %+v", before.Keys, user.Keys)
+	}
+}
+
+func TestServer_S3_Ownership(t *testing.T) {
+	srv, admin := newTestServer(t)
+	owner := newUserClient(t, srv, admin, "owner")
+	other := newUserClient(t, srv, admin, "other")
+
+	if err := owner.CreateBucket("bucket-1"); err != nil {
+		t.Fatalf("CreateBucket() error = %v", err)
+	}
+	if err := owner.CreateBucket("bucket-1"); !rgwerr.HasCode(err, "BucketAlreadyOwnedByYou") {
+		t.Errorf("CreateBucket() by the owner error = %v, want BucketAlreadyOwnedByYou", err)
+	}
+	if err := other.CreateBucket("bucket-1"); !rgwerr.HasCode(err, "BucketAlreadyExists") {
+		t.Errorf("CreateBucket() by another user error = %v, want BucketAlreadyExists", err)
+	}
+	if b, _ := srv.Bucket("bucket-1"); b.Owner != "owner" {
+		t.Errorf("bucket owner = %q, want owner", b.Owner)
+	}
+
+	// bucket configuration is reserved to the owner
+	if _, err := other.GetBucketTagging("bucket-1"); !rgwerr.HasCode(err, rgwerr.AccessDenied) {
+		t.Errorf("GetBucketTagging() by another user error = %v, want AccessDenied", err)
+	}
+	if _, err := owner.GetBucketTagging("bucket-1"); err != nil {
+		t.Errorf("GetBucketTagging() by the owner error = %v", err)
+	}
+	if _, err := owner.GetBucketTagging("missing"); !rgwerr.HasCode(err, "NoSuchBucket") {
+		t.Errorf("GetBucketTagging() of a missing bucket error = %v, want NoSuchBucket", err)
+	}
+
+	// users only list their own buckets
+	buckets, err := other.ListBuckets()
+	if err != nil || len(buckets) != 0 {
+		t.Errorf("ListBuckets() by another user = %v, %v, want none", buckets, err)
+	}
+	buckets, err = owner.ListBuckets()
+	if err != nil || len(buckets) != 1 || aws.StringValue(buckets[0].Name) != "bucket-1" {
+		t.Errorf("ListBuckets() by the owner = %v, %v, want [bucket-1]", buckets, err)
+	}
+}
+
+func TestServer_S3_ListObjects(t *testing.T) {
+	srv, admin := newTestServer(t)
+	client := newUserClient(t, srv, admin, "owner")
+	if err := client.CreateBucket("bucket-1"); err != nil {
+		t.Fatalf("CreateBucket() error = %v", err)
+	}
+	for _, key := range []string{"logs/b", "data/a", "logs/a"} {
+		if err := srv.PutObject("bucket-1", key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{"All keys sorted", "", []string{"data/a", "logs/a", "logs/b"}},
+		{"Prefix", "logs/", []string{"logs/a", "logs/b"}},
+		{"No match", "tmp/", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := client.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("bucket-1"), Prefix: aws.String(tt.prefix)})
+			if err != nil {
+				t.Fatalf("ListObjectsV2() error = %v", err)
+			}
+			var got []string
+			for _, object := range out.Contents {
+				got = append(got, aws.StringValue(object.Key))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListObjectsV2() keys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := client.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("missing")}); !rgwerr.HasCode(err, "NoSuchBucket") {
+		t.Errorf("ListObjectsV2() of a missing bucket error = %v, want NoSuchBucket", err)
+	}
+}
+
+func TestServer_Copies(t *testing.T) {
+	srv, admin := newTestServer(t)
+	client := newUserClient(t, srv, admin, "owner")
+	if err := client.CreateBucket("bucket-1"); err != nil {
+		t.Fatalf("CreateBucket() error = %v", err)
+	}
+	if err := client.PutBucketTagging("bucket-1", map[string]string{"team": "storage"}); err != nil {
+		t.Fatalf("PutBucketTagging() error = %v", err)
+	}
+	if err := srv.PutObject("bucket-1", "key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	topic := srv.CreateTopic("topic-1")
+	if err := srv.PutNotification("bucket-1", Notification{ID: "n", TopicARN: topic.ARN, Events: []string{"s3:ObjectCreated:*"}, TagFilter: map[string]string{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// changing the copies leaves the state of the fake alone
+	user, _ := srv.User("owner")
+	user.Keys[0].AccessKey = "changed"
+	bucket, _ := srv.Bucket("bucket-1")
+	bucket.Tags["team"] = "changed"
+	bucket.Objects["key"][0] = 'X'
+	bucket.Notifications[0].Events[0] = "changed"
+	bucket.Notifications[0].TagFilter["k"] = "changed"
+	topic.Attributes["changed"] = "true"
+
+	if user, _ := srv.User("owner"); user.Keys[0].AccessKey == "changed" {
+		t.Errorf("user keys changed through a copy")
+	}
+	bucket, _ = srv.Bucket("bucket-1")
+	if bucket.Tags["team"] != "storage" {
+		t.Errorf("bucket tags changed through a copy: %v", bucket.Tags)
+	}
+	if string(bucket.Objects["key"]) != "data" {
+		t.Errorf("bucket objects changed through a copy: %q", bucket.Objects["key"])
+	}
+	if n := bucket.Notifications[0]; n.Events[0] != "s3:ObjectCreated:*" || n.TagFilter["k"] != "v" {
+		t.Errorf("bucket notifications changed through a copy: %+v", n)
+	}
+	if topic, _ := srv.Topic("topic-1"); len(topic.Attributes) != 0 {
+		t.Errorf("topic attributes changed through a copy: %v", topic.Attributes)
+	}
+}
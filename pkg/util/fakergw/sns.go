@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakergw
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	snsNamespace = "https://sns.amazonaws.com/doc/2010-03-31/"
+	// topicARNPrefix is the ARN prefix of topics in the default zonegroup without tenant
+	topicARNPrefix = "arn:aws:sns:default::"
+)
+
+type responseMetadata struct {
+	RequestID string `xml:"RequestId"`
+}
+
+type createTopicResponse struct {
+	XMLName          xml.Name         `xml:"CreateTopicResponse"`
+	Xmlns            string           `xml:"xmlns,attr"`
+	TopicARN         string           `xml:"CreateTopicResult>TopicArn"`
+	ResponseMetadata responseMetadata `xml:"ResponseMetadata"`
+}
+
+type deleteTopicResponse struct {
+	XMLName          xml.Name         `xml:"DeleteTopicResponse"`
+	Xmlns            string           `xml:"xmlns,attr"`
+	ResponseMetadata responseMetadata `xml:"ResponseMetadata"`
+}
+
+type listTopicsResponse struct {
+	XMLName xml.Name `xml:"ListTopicsResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Topics  []struct {
+		TopicARN string `xml:"TopicArn"`
+	} `xml:"ListTopicsResult>Topics>member"`
+	ResponseMetadata responseMetadata `xml:"ResponseMetadata"`
+}
+
+type snsError struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Type      string   `xml:"Error>Type"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// serveSNS serves the subset of the SNS API RGW implements for bucket notification topics
+func (s *Server) serveSNS(w http.ResponseWriter, r *http.Request, caller *User) {
+	if err := r.ParseForm(); err != nil {
+		writeSNSError(w, http.StatusBadRequest, "InvalidParameter", err.Error())
+		return
+	}
+	switch action := r.PostForm.Get("Action"); action {
+	case "CreateTopic":
+		name := r.PostForm.Get("Name")
+		if name == "" {
+			writeSNSError(w, http.StatusBadRequest, "InvalidParameter", "missing topic name")
+			return
+		}
+		t, ok := s.topics[name]
+		if !ok {
+			t = &Topic{Name: name, ARN: topicARNPrefix + name, Owner: caller.ID}
+			s.topics[name] = t
+		}
+		t.Attributes = formAttributes(r)
+		writeXML(w, createTopicResponse{Xmlns: snsNamespace, TopicARN: t.ARN, ResponseMetadata: responseMetadata{RequestID: "fake"}})
+	case "DeleteTopic":
+		arn := r.PostForm.Get("TopicArn")
+		name := strings.TrimPrefix(arn, topicARNPrefix)
+		if _, ok := s.topics[name]; !ok || name == arn {
+			writeSNSError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("topic %q not found", arn))
+			return
+		}
+		delete(s.topics, name)
+		writeXML(w, deleteTopicResponse{Xmlns: snsNamespace, ResponseMetadata: responseMetadata{RequestID: "fake"}})
+	case "ListTopics":
+		result := listTopicsResponse{Xmlns: snsNamespace, ResponseMetadata: responseMetadata{RequestID: "fake"}}
+		for _, name := range sortedKeys(s.topics) {
+			result.Topics = append(result.Topics, struct {
+				TopicARN string `xml:"TopicArn"`
+			}{TopicARN: s.topics[name].ARN})
+		}
+		writeXML(w, result)
+	default:
+		writeSNSError(w, http.StatusBadRequest, "InvalidAction", fmt.Sprintf("unsupported action %q", action))
+	}
+}
+
+// formAttributes reads the Attributes.entry.N.key and Attributes.entry.N.value form fields
+func formAttributes(r *http.Request) map[string]string {
+	attributes := map[string]string{}
+	for i := 1; ; i++ {
+		key := r.PostForm.Get(fmt.Sprintf("Attributes.entry.%d.key", i))
+		if key == "" {
+			return attributes
+		}
+		attributes[key] = r.PostForm.Get(fmt.Sprintf("Attributes.entry.%d.value", i))
+	}
+}
+
+func writeSNSError(w http.ResponseWriter, statusCode int, code, message string) {
+	writeXMLStatus(w, statusCode, snsError{Type: "Sender", Code: code, Message: message, RequestID: "fake"})
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package redact masks access keys, secret keys and request signatures before they reach the logs.
+// Every log path printing parameters, credentials or SDK traces goes through it.
+package redact
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Mask replaces the redacted values
+const Mask = "REDACTED"
+
+// sensitiveSuffixes are the endings of the normalized keys holding secrets. Names of secrets,
+// e.g. objectStoreUserSecretName, are not sensitive.
+var sensitiveSuffixes = []string{"accesskey", "accesskeyid", "secretkey", "password", "token", "authorization"}
+
+var (
+	// headers matches the lines of HTTP traces carrying credentials, keeping the CR of CRLF line endings
+	headers = regexp.MustCompile(`(?im)^([ \t]*(?:authorization|x-amz-security-token)[ \t]*:[ \t]*)[^\r\n]*`)
+	// queryCredentials matches the credentials of presigned URLs and of admin ops requests creating keys,
+	// e.g. ?access-key=...&secret-key=...
+	queryCredentials = regexp.MustCompile(`(?i)((?:x-amz-(?:signature|credential|security-token)|access-key|secret-key)=)[^&\s"]+`)
+	// jsonKeys matches the keys in admin ops responses, e.g. "secret_key": "...", also when the JSON is
+	// escaped in a quoted log value
+	jsonKeys = regexp.MustCompile(`(?i)(\\?"(?:access_key|secret_key|accesskey|secretkey|accesskeyid|accesssecretkey)\\?"\s*:\s*\\?")[^"\\]*`)
+)
+
+// IsSensitive reports whether the values of the key hold secrets. Keys are compared case insensitively
+// and ignoring dashes and underscores, so AccessKey, access_key and accessKeyID are all sensitive.
+func IsSensitive(key string) bool {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(key))
+	for _, suffix := range sensitiveSuffixes {
+		if strings.HasSuffix(normalized, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Map returns a copy of the map with the values of sensitive keys masked
+func Map(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(m))
+	for key, value := range m {
+		if IsSensitive(key) && value != "" {
+			value = Mask
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
+
+// String masks the credentials in free text like SDK traces: Authorization and security token headers,
+// the signatures of presigned URLs and the keys of admin ops responses
+func String(s string) string {
+	s = headers.ReplaceAllString(s, "${1}"+Mask)
+	s = queryCredentials.ReplaceAllString(s, "${1}"+Mask)
+	return jsonKeys.ReplaceAllString(s, "${1}"+Mask)
+}
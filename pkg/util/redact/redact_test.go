@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redact
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsSensitive(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"AccessKey", true},
+		{"access_key", true},
+		{"accessKeyID", true},
+		{"accessSecretKey", true},
+		{"secret-key", true},
+		{"X-Amz-Security-Token", true},
+		{"Authorization", true},
+		{"objectStoreUserSecretName", false},
+		{"objectStoreUserSecretNamespace", false},
+		{"endpoint", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := IsSensitive(tt.key); got != tt.want {
+				t.Errorf("IsSensitive(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMap(t *testing.T) {
+	got := Map(map[string]string{"accessKey": "AKIA", "secretKey": "secret", "token": "", "endpoint": "http://rgw"})
+	want := map[string]string{"accessKey": Mask, "secretKey": Mask, "token": "", "endpoint": "http://rgw"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map() = %v, want %v", got, want)
+	}
+	if Map(nil) != nil {
+		t.Errorf("Map(nil) = %v, want nil", Map(nil))
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "admin ops query string",
+			in:   "PUT /admin/user?access-key=AKIA&format=json&key=&secret-key=s3cr3t&uid=ba-1234 HTTP/1.1",
+			want: "PUT /admin/user?access-key=REDACTED&format=json&key=&secret-key=REDACTED&uid=ba-1234 HTTP/1.1",
+		},
+		{
+			name: "SigV4 authorization header",
+			in: "GET /bucket HTTP/1.1\r\n" +
+				"Host: rgw\r\n" +
+				"Authorization: AWS4-HMAC-SHA256 Credential=AKIA/20240101/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=0123abcd\r\n" +
+				"X-Amz-Date: 20240101T000000Z\r\n",
+			want: "GET /bucket HTTP/1.1\r\n" +
+				"Host: rgw\r\n" +
+				"Authorization: REDACTED\r\n" +
+				"X-Amz-Date: 20240101T000000Z\r\n",
+		},
+		{
+			name: "security token header",
+			in:   "X-Amz-Security-Token: FwoGZXIvYXdzE\nContent-Length: 0",
+			want: "X-Amz-Security-Token: REDACTED\nContent-Length: 0",
+		},
+		{
+			name: "presigned URL",
+			in:   "https://rgw/bucket/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIA%2F20240101&X-Amz-Signature=0123abcd",
+			want: "https://rgw/bucket/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=REDACTED&X-Amz-Signature=REDACTED",
+		},
+		{
+			name: "admin ops JSON secret key fields",
+			in:   `{"user_id":"ba-1234","keys":[{"user":"ba-1234","access_key":"AKIA","secret_key":"s3cr3t"}],"swift_keys":[{"user":"ba-1234:swift","secret_key":"sw1ft"}]}`,
+			want: `{"user_id":"ba-1234","keys":[{"user":"ba-1234","access_key":"REDACTED","secret_key":"REDACTED"}],"swift_keys":[{"user":"ba-1234:swift","secret_key":"REDACTED"}]}`,
+		},
+		{
+			name: "escaped JSON in a quoted log value",
+			in:   `body="{\"access_key\": \"AKIA\", \"secret_key\": \"s3cr3t\"}"`,
+			want: `body="{\"access_key\": \"REDACTED\", \"secret_key\": \"REDACTED\"}"`,
+		},
+		{
+			name: "nothing to redact",
+			in:   "GET /admin/bucket?bucket=test-bucket&format=json HTTP/1.1",
+			want: "GET /admin/bucket?bucket=test-bucket&format=json HTTP/1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := String(tt.in); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rgwerr classifies the errors returned by RGW through the S3 and the admin ops APIs,
+// so that they are handled and reported to the sidecar in a single place.
+package rgwerr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/breaker"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RGW error codes handled by the driver
+const (
+	NoSuchBucket            = "NoSuchBucket"
+	NoSuchBucketPolicy      = "NoSuchBucketPolicy"
+	NoSuchKey               = "NoSuchKey"
+	NoSuchUser              = "NoSuchUser"
+	NoSuchSubUser           = "NoSuchSubUser"
+	InvalidAccessKey        = "InvalidAccessKey"
+	BucketAlreadyExists     = "BucketAlreadyExists"
+	BucketAlreadyOwnedByYou = "BucketAlreadyOwnedByYou"
+	UserAlreadyExists       = "UserAlreadyExists"
+	SubuserExists           = "SubuserExists"
+	KeyExists               = "KeyExists"
+	BucketNotEmpty          = "BucketNotEmpty"
+	AccessDenied            = "AccessDenied"
+	QuotaExceeded           = "QuotaExceeded"
+	TooManyBuckets          = "TooManyBuckets"
+	SlowDown                = "SlowDown"
+)
+
+// Kind is the class of an RGW error
+type Kind int
+
+const (
+	// KindUnknown is any error not classified otherwise
+	KindUnknown Kind = iota
+	// KindNotFound is returned for missing buckets, users, keys and policies
+	KindNotFound
+	// KindConflict is returned when a bucket, user or key already exists
+	KindConflict
+	// KindNotEmpty is returned when deleting a bucket which still holds objects
+	KindNotEmpty
+	// KindInvalid is returned for requests RGW rejects as malformed
+	KindInvalid
+	// KindAuth is returned when the credentials are invalid or lack permissions
+	KindAuth
+	// KindQuotaExceeded is returned when a quota or the bucket limit of a user is reached
+	KindQuotaExceeded
+	// KindThrottled is returned when RGW sheds load
+	KindThrottled
+	// KindNetwork is returned when RGW could not be reached
+	KindNetwork
+	// KindInternal is returned for internal errors of RGW
+	KindInternal
+)
+
+var kindNames = map[Kind]string{
+	KindUnknown:       "Unknown",
+	KindNotFound:      "NotFound",
+	KindConflict:      "Conflict",
+	KindNotEmpty:      "NotEmpty",
+	KindInvalid:       "Invalid",
+	KindAuth:          "Auth",
+	KindQuotaExceeded: "QuotaExceeded",
+	KindThrottled:     "Throttled",
+	KindNetwork:       "Network",
+	KindInternal:      "Internal",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// codeKinds maps the error codes of both APIs to their kind
+var codeKinds = map[string]Kind{
+	NoSuchBucket:                    KindNotFound,
+	NoSuchBucketPolicy:              KindNotFound,
+	NoSuchKey:                       KindNotFound,
+	NoSuchUser:                      KindNotFound,
+	NoSuchSubUser:                   KindNotFound,
+	InvalidAccessKey:                KindNotFound,
+	"NoSuchObject":                  KindNotFound,
+	"NoSuchTagSet":                  KindNotFound,
+	"NoSuchCap":                     KindNotFound,
+	"NotFound":                      KindNotFound,
+	BucketAlreadyExists:             KindConflict,
+	BucketAlreadyOwnedByYou:         KindConflict,
+	UserAlreadyExists:               KindConflict,
+	SubuserExists:                   KindConflict,
+	KeyExists:                       KindConflict,
+	"EmailExists":                   KindConflict,
+	BucketNotEmpty:                  KindNotEmpty,
+	"InvalidArgument":               KindInvalid,
+	"InvalidBucketName":             KindInvalid,
+	"MalformedPolicy":               KindInvalid,
+	request.InvalidParameterErrCode: KindInvalid,
+	"MalformedXML":                  KindInvalid,
+	"InvalidKeyType":                KindInvalid,
+	"InvalidCapability":             KindInvalid,
+	"InvalidAccess":                 KindInvalid,
+	"InvalidSecretKey":              KindInvalid,
+	AccessDenied:                    KindAuth,
+	"InvalidAccessKeyId":            KindAuth,
+	"SignatureDoesNotMatch":         KindAuth,
+	"RequestTimeTooSkewed":          KindAuth,
+	QuotaExceeded:                   KindQuotaExceeded,
+	TooManyBuckets:                  KindQuotaExceeded,
+	SlowDown:                        KindThrottled,
+	"ServiceUnavailable":            KindThrottled,
+	"TooManyRequests":               KindThrottled,
+	"RequestLimitExceeded":          KindThrottled,
+	request.ErrCodeRequestError:     KindNetwork,
+	request.ErrCodeResponseTimeout:  KindNetwork,
+	"InternalError":                 KindInternal,
+}
+
+// adminReasons are the go-ceph error reasons, which only match through errors.Is
+var adminReasons = []error{
+	rgwadmin.ErrNoSuchUser, rgwadmin.ErrNoSuchBucket, rgwadmin.ErrNoSuchKey, rgwadmin.ErrNoSuchObject,
+	rgwadmin.ErrNoSuchCap, rgwadmin.ErrInvalidAccessKey, rgwadmin.ErrUserExists, rgwadmin.ErrSubuserExists,
+	rgwadmin.ErrKeyExists, rgwadmin.ErrEmailExists, rgwadmin.ErrBucketNotEmpty, rgwadmin.ErrInvalidArgument,
+	rgwadmin.ErrInvalidKeyType, rgwadmin.ErrInvalidCapability, rgwadmin.ErrInvalidAccess, rgwadmin.ErrInvalidSecretKey,
+	rgwadmin.ErrAccessDenied, rgwadmin.ErrSignatureDoesNotMatch, rgwadmin.ErrInternalError,
+}
+
+// Error is a classified RGW error
+type Error struct {
+	// Kind is the class of the error
+	Kind Kind
+	// Code is the RGW error code, empty if the error did not come from RGW
+	Code string
+	// Err is the original error
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the request may succeed when sent again unchanged: RGW could not be reached, shed load
+// or failed with a server error
+func (e *Error) Retryable() bool {
+	switch e.Kind {
+	case KindThrottled, KindNetwork, KindInternal:
+		return true
+	}
+	return false
+}
+
+// GRPCCode is the code the error is reported to the sidecar with. Retryable errors are reported as codes.Unavailable,
+// the others with a code telling the sidecar that the request fails the same way until something changes.
+func (e *Error) GRPCCode() codes.Code {
+	if e.Retryable() {
+		return codes.Unavailable
+	}
+	switch e.Kind {
+	case KindNotFound:
+		return codes.NotFound
+	case KindConflict:
+		return codes.AlreadyExists
+	case KindNotEmpty:
+		return codes.FailedPrecondition
+	case KindInvalid:
+		return codes.InvalidArgument
+	case KindAuth:
+		return codes.PermissionDenied
+	case KindQuotaExceeded:
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
+
+// Classify returns the classified error, nil for a nil error
+func Classify(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified
+	}
+
+	if errors.Is(err, breaker.ErrOpen) {
+		return &Error{Kind: KindNetwork, Err: err}
+	}
+	code := errorCode(err)
+	if kind, ok := codeKinds[code]; ok {
+		return &Error{Kind: kind, Code: code, Err: err}
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return &Error{Kind: statusKind(reqErr.StatusCode()), Code: code, Err: err}
+	}
+	var adminErr adminops.StatusError
+	if errors.As(err, &adminErr) {
+		return &Error{Kind: statusKind(adminErr.StatusCode), Code: code, Err: err}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Kind: KindNetwork, Code: code, Err: err}
+	}
+	return &Error{Kind: KindUnknown, Code: code, Err: err}
+}
+
+// errorCode extracts the RGW error code of either API
+func errorCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	var adminErr adminops.StatusError
+	if errors.As(err, &adminErr) {
+		return adminErr.Code
+	}
+	for _, reason := range adminReasons {
+		if errors.Is(err, reason) {
+			return reason.Error()
+		}
+	}
+	return ""
+}
+
+// statusKind classifies errors with unknown codes by their HTTP status
+func statusKind(statusCode int) Kind {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return KindNotFound
+	case statusCode == http.StatusConflict:
+		return KindConflict
+	case statusCode == http.StatusBadRequest:
+		return KindInvalid
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return KindAuth
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable:
+		return KindThrottled
+	case statusCode >= http.StatusInternalServerError:
+		return KindInternal
+	}
+	return KindUnknown
+}
+
+// HasCode reports whether err is an RGW error with one of the given codes
+func HasCode(err error, codes ...string) bool {
+	e := Classify(err)
+	if e == nil {
+		return false
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNotFound reports whether the resource the request refers to does not exist
+func IsNotFound(err error) bool {
+	e := Classify(err)
+	return e != nil && e.Kind == KindNotFound
+}
+
+// IsRetryable reports whether the request may succeed when sent again unchanged, see Error.Retryable
+func IsRetryable(err error) bool {
+	e := Classify(err)
+	return e != nil && e.Retryable()
+}
+
+// Status converts err into a gRPC status error with the code of its kind, codes.Unavailable for retryable errors.
+// The RGW error code is appended to the message, the original error is not exposed.
+// Errors which already are gRPC status errors are returned unchanged.
+func Status(err error, msg string) error {
+	e := Classify(err)
+	if e == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if e.Code != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Code)
+	}
+	return status.Error(e.GRPCCode(), msg)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rgwerr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/ceph/cosi-driver-ceph/pkg/util/adminops"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/breaker"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	rgwadmin "github.com/ceph/go-ceph/rgw/admin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// s3Error returns an error like the ones of the S3 SDK
+func s3Error(code string, statusCode int) error {
+	return awserr.NewRequestFailure(awserr.New(code, "message", nil), statusCode, "request-id")
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantKind Kind
+		wantCode string
+		wantGRPC codes.Code
+	}{
+		{"S3 code", s3Error(NoSuchBucket, http.StatusNotFound), KindNotFound, NoSuchBucket, codes.NotFound},
+		{"S3 conflict", s3Error(BucketAlreadyOwnedByYou, http.StatusConflict), KindConflict, BucketAlreadyOwnedByYou, codes.AlreadyExists},
+		{"S3 not empty", s3Error(BucketNotEmpty, http.StatusConflict), KindNotEmpty, BucketNotEmpty, codes.FailedPrecondition},
+		{"S3 throttled", s3Error(SlowDown, http.StatusServiceUnavailable), KindThrottled, SlowDown, codes.Unavailable},
+		{"S3 unknown code by status", s3Error("Unexpected", http.StatusForbidden), KindAuth, "Unexpected", codes.PermissionDenied},
+		{"S3 server error", s3Error("Unexpected", http.StatusBadGateway), KindInternal, "Unexpected", codes.Unavailable},
+		{"S3 internal error", s3Error("InternalError", http.StatusInternalServerError), KindInternal, "InternalError", codes.Unavailable},
+		{"S3 service unavailable", s3Error("ServiceUnavailable", http.StatusServiceUnavailable), KindThrottled, "ServiceUnavailable", codes.Unavailable},
+		{"S3 SDK request error", awserr.New(request.ErrCodeRequestError, "send request failed", nil), KindNetwork, request.ErrCodeRequestError, codes.Unavailable},
+		{"S3 SDK invalid parameter", awserr.New(request.InvalidParameterErrCode, "invalid", nil), KindInvalid, request.InvalidParameterErrCode, codes.InvalidArgument},
+		{"admin ops code", adminops.StatusError{Code: QuotaExceeded, StatusCode: http.StatusForbidden}, KindQuotaExceeded, QuotaExceeded, codes.ResourceExhausted},
+		{"admin ops unknown code by status", adminops.StatusError{Code: "Unexpected", StatusCode: http.StatusBadRequest}, KindInvalid, "Unexpected", codes.InvalidArgument},
+		{"admin ops wrapped", fmt.Errorf("failed: %w", adminops.StatusError{Code: "Unexpected", StatusCode: http.StatusTooManyRequests}), KindThrottled, "Unexpected", codes.Unavailable},
+		{"go-ceph sentinel", fmt.Errorf("failed to get user: %w", rgwadmin.ErrNoSuchUser), KindNotFound, NoSuchUser, codes.NotFound},
+		{"go-ceph conflict sentinel", rgwadmin.ErrUserExists, KindConflict, UserAlreadyExists, codes.AlreadyExists},
+		{"go-ceph denied sentinel", rgwadmin.ErrAccessDenied, KindAuth, AccessDenied, codes.PermissionDenied},
+		{"open circuit", fmt.Errorf("request failed: %w", breaker.ErrOpen), KindNetwork, "", codes.Unavailable},
+		{"net error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, KindNetwork, "", codes.Unavailable},
+		{"deadline", fmt.Errorf("request failed: %w", context.DeadlineExceeded), KindNetwork, "", codes.Unavailable},
+		{"unknown", errors.New("boom"), KindUnknown, "", codes.Internal},
+		{"classified", fmt.Errorf("wrapped: %w", &Error{Kind: KindNotEmpty, Code: "Custom", Err: errors.New("boom")}), KindNotEmpty, "Custom", codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Classify(tt.err)
+			if got == nil {
+				t.Fatalf("Classify() = nil")
+			}
+			if got.Kind != tt.wantKind || got.Code != tt.wantCode {
+				t.Errorf("Classify() = %v %q, want %v %q", got.Kind, got.Code, tt.wantKind, tt.wantCode)
+			}
+			if code := got.GRPCCode(); code != tt.wantGRPC {
+				t.Errorf("Error.GRPCCode() = %v, want %v", code, tt.wantGRPC)
+			}
+			if !errors.Is(tt.err, got.Err) {
+				t.Errorf("Classify() lost the original error %v", tt.err)
+			}
+		})
+	}
+	if got := Classify(nil); got != nil {
+		t.Errorf("Classify(nil) = %v, want nil", got)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCode    codes.Code
+		wantMessage string
+	}{
+		{"RGW code appended", s3Error(NoSuchBucket, http.StatusNotFound), codes.NotFound, "failed to get bucket: NoSuchBucket"},
+		{"no code", errors.New("secret details"), codes.Internal, "failed to get bucket"},
+		{"status passed through", status.Error(codes.FailedPrecondition, "conflicting restrictions"), codes.FailedPrecondition, "conflicting restrictions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := status.Convert(Status(tt.err, "failed to get bucket"))
+			if got.Code() != tt.wantCode || got.Message() != tt.wantMessage {
+				t.Errorf("Status() = %v %q, want %v %q", got.Code(), got.Message(), tt.wantCode, tt.wantMessage)
+			}
+		})
+	}
+	if err := Status(nil, "failed"); err != nil {
+		t.Errorf("Status(nil) = %v, want nil", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		kind Kind
+		err  error
+		want bool
+	}{
+		{KindUnknown, errors.New("boom"), false},
+		{KindNotFound, s3Error(NoSuchBucket, http.StatusNotFound), false},
+		{KindConflict, rgwadmin.ErrUserExists, false},
+		{KindNotEmpty, s3Error(BucketNotEmpty, http.StatusConflict), false},
+		{KindInvalid, s3Error("MalformedPolicy", http.StatusBadRequest), false},
+		{KindAuth, s3Error(AccessDenied, http.StatusForbidden), false},
+		{KindQuotaExceeded, adminops.StatusError{Code: QuotaExceeded, StatusCode: http.StatusForbidden}, false},
+		{KindThrottled, s3Error(SlowDown, http.StatusServiceUnavailable), true},
+		{KindNetwork, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{KindInternal, adminops.StatusError{Code: "Unexpected", StatusCode: http.StatusBadGateway}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind.String(), func(t *testing.T) {
+			if got := Classify(tt.err); got.Kind != tt.kind {
+				t.Fatalf("Classify() kind = %v, want %v", got.Kind, tt.kind)
+			}
+			if got := IsRetryable(fmt.Errorf("wrapped: %w", tt.err)); got != tt.want {
+				t.Errorf("IsRetryable() = %v, want %v", got, tt.want)
+			}
+			wantCode := Classify(tt.err).GRPCCode()
+			if tt.want {
+				wantCode = codes.Unavailable
+			}
+			if got := status.Code(Status(tt.err, "failed")); got != wantCode || (got == codes.Unavailable) != tt.want {
+				t.Errorf("Status() code = %v, want %v", got, wantCode)
+			}
+		})
+	}
+	if IsRetryable(nil) {
+		t.Errorf("IsRetryable(nil) = true, want false")
+	}
+}
+
+func TestHasCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		codes []string
+		want  bool
+	}{
+		{"S3", s3Error(BucketAlreadyExists, http.StatusConflict), []string{BucketAlreadyExists, BucketAlreadyOwnedByYou}, true},
+		{"go-ceph sentinel", fmt.Errorf("wrapped: %w", rgwadmin.ErrSubuserExists), []string{SubuserExists}, true},
+		{"other code", s3Error(NoSuchKey, http.StatusNotFound), []string{NoSuchBucket}, false},
+		{"no code", errors.New("boom"), []string{""}, true},
+		{"nil", nil, []string{NoSuchBucket}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HasCode(tt.err, tt.codes...); got != tt.want {
+				t.Errorf("HasCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	if !IsNotFound(fmt.Errorf("wrapped: %w", rgwadmin.ErrNoSuchBucket)) {
+		t.Errorf("IsNotFound(NoSuchBucket) = false, want true")
+	}
+	if IsNotFound(s3Error(AccessDenied, http.StatusForbidden)) || IsNotFound(nil) {
+		t.Errorf("IsNotFound() = true for an error other than not found")
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3client
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
+	"github.com/aws/aws-sdk-go/private/protocol/restxml"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// TopicNotification publishes the events of a bucket to a topic
+type TopicNotification struct {
+	ID       string
+	TopicARN string
+	Events   []string
+	Prefix   string
+	Suffix   string
+
+	// filter holds the filters of a notification read from the bucket other than the key prefix and suffix, e.g.
+	// the regex, metadata and tag filters of RGW. The driver does not configure them, they are kept so that the
+	// notifications of other clients are written back unchanged.
+	filter *notificationFilter
+}
+
+// s3Namespace is the XML namespace of the S3 API
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// notificationConfiguration is the notification configuration of a bucket as RGW serializes it.
+// The SDK only models the key filter and drops the metadata and tag filters RGW supports.
+type notificationConfiguration struct {
+	XMLName xml.Name             `xml:"NotificationConfiguration"`
+	Xmlns   string               `xml:"xmlns,attr,omitempty"`
+	Topics  []topicConfiguration `xml:"TopicConfiguration"`
+}
+
+type topicConfiguration struct {
+	ID       string              `xml:"Id"`
+	TopicARN string              `xml:"Topic"`
+	Events   []string            `xml:"Event"`
+	Filter   *notificationFilter `xml:"Filter"`
+}
+
+type notificationFilter struct {
+	KeyRules []filterRule `xml:"S3Key>FilterRule"`
+	// Other are the filter elements besides the key filter, kept verbatim
+	Other []filterElement `xml:",any"`
+}
+
+type filterRule struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+type filterElement struct {
+	XMLName xml.Name
+	Inner   []byte `xml:",innerxml"`
+}
+
+// CreateTopic creates the topic or updates the attributes of an existing one and returns its ARN
+func (s *S3Agent) CreateTopic(name string, attributes map[string]string) (string, error) {
+	attrs := make(map[string]*string, len(attributes))
+	for k, v := range attributes {
+		attrs[k] = aws.String(v)
+	}
+	out, err := s.SNSClient.CreateTopic(&sns.CreateTopicInput{
+		Name:       aws.String(name),
+		Attributes: attrs,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.TopicArn), nil
+}
+
+// DeleteTopic deletes the topic with the given ARN
+func (s *S3Agent) DeleteTopic(arn string) error {
+	_, err := s.SNSClient.DeleteTopic(&sns.DeleteTopicInput{
+		TopicArn: aws.String(arn),
+	})
+	return err
+}
+
+// TopicName returns the name of a topic from its ARN, arn:aws:sns:<zonegroup>:<tenant>:<name>
+func TopicName(arn string) string {
+	return arn[strings.LastIndex(arn, ":")+1:]
+}
+
+// PutBucketNotifications replaces the notification configuration of the bucket.
+// The configuration is serialized by the driver rather than the SDK, so that the filters the SDK does not model are
+// written back.
+func (s *S3Agent) PutBucketNotifications(bucket string, notifications []TopicNotification) error {
+	config := notificationConfiguration{Xmlns: s3Namespace}
+	for _, n := range notifications {
+		topic := topicConfiguration{ID: n.ID, TopicARN: n.TopicARN, Events: n.Events}
+		filter := notificationFilter{}
+		if n.Prefix != "" {
+			filter.KeyRules = append(filter.KeyRules, filterRule{Name: s3.FilterRuleNamePrefix, Value: n.Prefix})
+		}
+		if n.Suffix != "" {
+			filter.KeyRules = append(filter.KeyRules, filterRule{Name: s3.FilterRuleNameSuffix, Value: n.Suffix})
+		}
+		if n.filter != nil {
+			filter.KeyRules = append(filter.KeyRules, n.filter.KeyRules...)
+			filter.Other = n.filter.Other
+		}
+		if len(filter.KeyRules) > 0 || len(filter.Other) > 0 {
+			topic.Filter = &filter
+		}
+		config.Topics = append(config.Topics, topic)
+	}
+	body, err := xml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to serialize notification configuration: %w", err)
+	}
+	req, _ := s.Client.PutBucketNotificationConfigurationRequest(&s3.PutBucketNotificationConfigurationInput{
+		Bucket:                    aws.String(bucket),
+		NotificationConfiguration: &s3.NotificationConfiguration{},
+	})
+	req.Handlers.Build.Swap(restxml.BuildHandler.Name, request.NamedHandler{
+		Name: "s3client.BuildNotificationConfiguration",
+		Fn: func(r *request.Request) {
+			rest.Build(r)
+			r.SetBufferBody(body)
+		},
+	})
+	return req.Send()
+}
+
+// GetBucketNotifications returns the topic notifications of the bucket
+func (s *S3Agent) GetBucketNotifications(bucket string) ([]TopicNotification, error) {
+	config := notificationConfiguration{}
+	req, _ := s.Client.GetBucketNotificationConfigurationRequest(&s3.GetBucketNotificationConfigurationRequest{
+		Bucket: aws.String(bucket),
+	})
+	req.Handlers.Unmarshal.Swap(restxml.UnmarshalHandler.Name, request.NamedHandler{
+		Name: "s3client.UnmarshalNotificationConfiguration",
+		Fn: func(r *request.Request) {
+			defer r.HTTPResponse.Body.Close()
+			config = notificationConfiguration{}
+			if err := xml.NewDecoder(r.HTTPResponse.Body).Decode(&config); err != nil && err != io.EOF {
+				r.Error = awserr.NewRequestFailure(
+					awserr.New(request.ErrCodeSerialization, "failed to decode notification configuration", err),
+					r.HTTPResponse.StatusCode, r.RequestID)
+			}
+		},
+	})
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+
+	notifications := make([]TopicNotification, 0, len(config.Topics))
+	for _, t := range config.Topics {
+		n := TopicNotification{ID: t.ID, TopicARN: t.TopicARN, Events: t.Events}
+		if t.Filter != nil {
+			other := notificationFilter{Other: t.Filter.Other}
+			for _, rule := range t.Filter.KeyRules {
+				switch strings.ToLower(rule.Name) {
+				case s3.FilterRuleNamePrefix:
+					n.Prefix = rule.Value
+				case s3.FilterRuleNameSuffix:
+					n.Suffix = rule.Value
+				default:
+					other.KeyRules = append(other.KeyRules, rule)
+				}
+			}
+			if len(other.KeyRules) > 0 || len(other.Other) > 0 {
+				n.filter = &other
+			}
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
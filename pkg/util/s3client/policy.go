@@ -16,10 +16,12 @@ limitations under the License.
 package s3client
 
 import (
+	"cmp"
+	"encoding/json"
 	"fmt"
+	"slices"
 
 	"github.com/aws/aws-sdk-go/service/s3"
-	"k8s.io/apimachinery/pkg/util/json"
 )
 
 type action string
@@ -136,6 +138,74 @@ type PolicyStatement struct {
 	Resource []string `json:"Resource"`
 }
 
+// UnmarshalJSON reads the statement in all forms the S3 API accepts: the principal may be "*" or name a single
+// principal instead of a list, and the action and resource may be a single string
+func (ps *PolicyStatement) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Sid       string          `json:"Sid"`
+		Effect    effect          `json:"Effect"`
+		Principal json.RawMessage `json:"Principal"`
+		Action    json.RawMessage `json:"Action"`
+		Resource  json.RawMessage `json:"Resource"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*ps = PolicyStatement{Sid: raw.Sid, Effect: raw.Effect}
+
+	var err error
+	if ps.Principal, err = unmarshalPrincipal(raw.Principal); err != nil {
+		return fmt.Errorf("invalid principal: %w", err)
+	}
+	if ps.Action, err = stringOrList[action](raw.Action); err != nil {
+		return fmt.Errorf("invalid action: %w", err)
+	}
+	if ps.Resource, err = stringOrList[string](raw.Resource); err != nil {
+		return fmt.Errorf("invalid resource: %w", err)
+	}
+	return nil
+}
+
+// unmarshalPrincipal reads a principal, "*" matches everyone and is read as the AWS principal "*"
+func unmarshalPrincipal(data json.RawMessage) (map[string][]string, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	var wildcard string
+	if err := json.Unmarshal(data, &wildcard); err == nil {
+		return map[string][]string{awsPrinciple: {wildcard}}, nil
+	}
+	var kinds map[string]json.RawMessage
+	if err := json.Unmarshal(data, &kinds); err != nil {
+		return nil, err
+	}
+	principal := make(map[string][]string, len(kinds))
+	for kind, value := range kinds {
+		principals, err := stringOrList[string](value)
+		if err != nil {
+			return nil, err
+		}
+		principal[kind] = principals
+	}
+	return principal, nil
+}
+
+// stringOrList reads a JSON string or list of strings
+func stringOrList[T ~string](data json.RawMessage) ([]T, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	var single T
+	if err := json.Unmarshal(data, &single); err == nil {
+		return []T{single}, nil
+	}
+	var list []T
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
 // BucketPolicy represents set of policy statements for a single bucket.
 type BucketPolicy struct {
 	// Id (optional) identifies the bucket policy
@@ -203,6 +273,7 @@ func (bp *BucketPolicy) ModifyBucketPolicy(ps ...PolicyStatement) *BucketPolicy
 		for j, oldP := range bp.Statement {
 			if newP.Sid == oldP.Sid {
 				bp.Statement[j] = newP
+				match = true
 			}
 		}
 		if !match {
@@ -318,3 +389,31 @@ func (ps *PolicyStatement) EjectPrincipals(users ...string) {
 	}
 	ps.Principal[awsPrinciple] = principals
 }
+
+// Equal reports whether both statements have the same effect, principals, actions and resources,
+// regardless of their order
+func (ps PolicyStatement) Equal(other PolicyStatement) bool {
+	if ps.Sid != other.Sid || ps.Effect != other.Effect || len(ps.Principal) != len(other.Principal) {
+		return false
+	}
+	for kind, principals := range ps.Principal {
+		if !sameElements(principals, other.Principal[kind]) {
+			return false
+		}
+	}
+	return sameElements(ps.Action, other.Action) && sameElements(ps.Resource, other.Resource)
+}
+
+// FindStatement returns the statement with the given SID
+func (bp *BucketPolicy) FindStatement(sid string) (PolicyStatement, bool) {
+	for _, stmt := range bp.Statement {
+		if stmt.Sid == sid {
+			return stmt, true
+		}
+	}
+	return PolicyStatement{}, false
+}
+
+func sameElements[T cmp.Ordered](a, b []T) bool {
+	return slices.Equal(slices.Sorted(slices.Values(a)), slices.Sorted(slices.Values(b)))
+}
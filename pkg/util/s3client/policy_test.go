@@ -0,0 +1,67 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPolicyStatement_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		statement string
+		want      PolicyStatement
+		wantErr   bool
+	}{
+		{
+			name:      "lists",
+			statement: `{"Sid":"ba-1","Effect":"Allow","Principal":{"AWS":["arn:aws:iam:::user/ba-1"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::bucket"]}`,
+			want: PolicyStatement{Sid: "ba-1", Effect: effectAllow, Principal: map[string][]string{"AWS": {"arn:aws:iam:::user/ba-1"}},
+				Action: []action{GetObject}, Resource: []string{"arn:aws:s3:::bucket"}},
+		},
+		{
+			name:      "wildcard principal",
+			statement: `{"Sid":"AddPerm","Effect":"Allow","Principal":"*","Action":["s3:GetObject"],"Resource":["arn:aws:s3:::bucket/*"]}`,
+			want: PolicyStatement{Sid: "AddPerm", Effect: effectAllow, Principal: map[string][]string{"AWS": {"*"}},
+				Action: []action{GetObject}, Resource: []string{"arn:aws:s3:::bucket/*"}},
+		},
+		{
+			name:      "single strings",
+			statement: `{"Effect":"Deny","Principal":{"AWS":"arn:aws:iam:::user/other"},"Action":"s3:*","Resource":"arn:aws:s3:::bucket"}`,
+			want: PolicyStatement{Effect: effectDeny, Principal: map[string][]string{"AWS": {"arn:aws:iam:::user/other"}},
+				Action: []action{All}, Resource: []string{"arn:aws:s3:::bucket"}},
+		},
+		{
+			name:      "invalid principal",
+			statement: `{"Effect":"Allow","Principal":42}`,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got PolicyStatement
+			err := json.Unmarshal([]byte(tt.statement), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PolicyStatement.UnmarshalJSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PolicyStatement.UnmarshalJSON() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -20,36 +20,89 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/ceph/cosi-driver-ceph/pkg/util/breaker"
+	"github.com/ceph/cosi-driver-ceph/pkg/util/redact"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 	"k8s.io/klog/v2"
 )
 
 const (
 	rgwRegion   = "us-east-1"
 	HttpTimeOut = 15 * time.Second
+	// DefaultMaxRetries is the number of retries of a failed request
+	DefaultMaxRetries = 5
 )
 
 // S3Agent wraps the s3iface structure to allow for wrapper methods
 type S3Agent struct {
 	Client s3iface.S3API
+	// SNSClient manages the topics of bucket notifications on the same endpoint
+	SNSClient snsiface.SNSAPI
+}
+
+// Options configures the behavior of the S3 client, zero values select the defaults
+type Options struct {
+	// Debug logs the requests and responses of the SDK, with credentials and signatures redacted
+	Debug bool
+	// Timeout limits each HTTP request, HttpTimeOut if zero
+	Timeout time.Duration
+	// MaxRetries is the number of retries of a failed request, with exponential backoff and jitter.
+	// DefaultMaxRetries if nil.
+	MaxRetries *int
+	// VirtualHostedStyle addresses buckets as <bucket>.<endpoint host> instead of <endpoint>/<bucket>,
+	// it requires a wildcard DNS record and rgw_dns_name
+	VirtualHostedStyle bool
+	// Region signs the requests, us-east-1 if empty
+	Region string
+	// UserAgent is appended to the User-Agent of the SDK
+	UserAgent string
+	// Breakers guard the requests to each endpoint, nil disables them
+	Breakers *breaker.Set
+}
+
+// RequestTimeout returns the timeout of each HTTP request
+func (o Options) RequestTimeout() time.Duration {
+	if o.Timeout <= 0 {
+		return HttpTimeOut
+	}
+	return o.Timeout
 }
 
 func NewS3Agent(accessKey, secretKey, endpoint string, tlsCert []byte, debug bool) (*S3Agent, error) {
+	return NewS3AgentWithOptions(accessKey, secretKey, endpoint, tlsCert, Options{Debug: debug})
+}
+
+// NewS3AgentWithOptions creates an S3 agent configured by the options
+func NewS3AgentWithOptions(accessKey, secretKey, endpoint string, tlsCert []byte, options Options) (*S3Agent, error) {
 	logLevel := aws.LogOff
-	if debug {
+	if options.Debug {
 		logLevel = aws.LogDebug
 	}
+	maxRetries := DefaultMaxRetries
+	if options.MaxRetries != nil {
+		maxRetries = *options.MaxRetries
+	}
+	region := options.Region
+	if region == "" {
+		region = rgwRegion
+	}
 	client := http.Client{
-		Timeout: HttpTimeOut,
+		Timeout: options.RequestTimeout(),
 	}
 	tlsEnabled := false
 	insecure := false
@@ -60,26 +113,48 @@ func NewS3Agent(accessKey, secretKey, endpoint string, tlsCert []byte, debug boo
 		tlsEnabled = true
 		client.Transport = buildTransportTLS(tlsCert, insecure)
 	}
-	session, err := session.NewSession(
-		aws.NewConfig().
-			WithRegion(rgwRegion).
-			WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")).
-			WithEndpoint(endpoint).
-			WithS3ForcePathStyle(true).
-			WithMaxRetries(5).
-			WithDisableSSL(!tlsEnabled).
-			WithHTTPClient(&client).
-			WithLogLevel(logLevel),
-	)
+	config := aws.NewConfig().
+		WithRegion(region).
+		WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")).
+		WithEndpoint(endpoint).
+		WithS3ForcePathStyle(!options.VirtualHostedStyle).
+		WithDisableSSL(!tlsEnabled).
+		WithHTTPClient(&client).
+		WithLogLevel(logLevel).
+		WithLogger(redactingLogger)
+	// the default retryer backs off exponentially with jitter
+	config = request.WithRetryer(config, awsclient.DefaultRetryer{NumMaxRetries: maxRetries})
+	session, err := session.NewSession(config)
 	if err != nil {
 		return nil, err
 	}
+	if options.Breakers != nil {
+		// wrapped once the session loaded a custom CA bundle, which requires an *http.Transport
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		client.Transport = options.Breakers.Transport(endpoint, transport)
+		// the build handlers run once per request, its retries share the context and count as a single failure
+		session.Handlers.Build.PushBack(func(r *request.Request) {
+			r.SetContext(breaker.WithRequest(r.Context()))
+		})
+	}
+	if options.UserAgent != "" {
+		session.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(options.UserAgent))
+	}
 	svc := s3.New(session)
 	return &S3Agent{
-		Client: svc,
+		Client:    svc,
+		SNSClient: sns.New(session),
 	}, nil
 }
 
+// redactingLogger logs the SDK traces with the credentials masked, they hold the signed Authorization headers
+var redactingLogger = aws.LoggerFunc(func(args ...interface{}) {
+	klog.Info(redact.String(fmt.Sprint(args...)))
+})
+
 // CreateBucket creates a bucket with the given name
 func (s *S3Agent) CreateBucketNoInfoLogging(name string) error {
 	return s.createBucket(name, false)
@@ -112,6 +187,15 @@ func (s *S3Agent) createBucket(name string, infoLogging bool) error {
 	return nil
 }
 
+// ListBuckets returns the buckets owned by the user of the client
+func (s *S3Agent) ListBuckets() ([]*s3.Bucket, error) {
+	out, err := s.Client.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		return nil, err
+	}
+	return out.Buckets, nil
+}
+
 // DeleteBucket function deletes given bucket using s3 client
 func (s *S3Agent) DeleteBucket(name string) (bool, error) {
 	_, err := s.Client.DeleteBucket(&s3.DeleteBucketInput{
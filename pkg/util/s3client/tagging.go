@@ -0,0 +1,72 @@
+/*
+Copyright 2021 The Ceph-COSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3client
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// errCodeNoSuchTagSet is returned for buckets without tags
+const errCodeNoSuchTagSet = "NoSuchTagSet"
+
+// PutBucketTagging replaces the tag set of the bucket
+func (s *S3Agent) PutBucketTagging(bucket string, tags map[string]string) error {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for _, k := range keys {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	_, err := s.Client.PutBucketTagging(&s3.PutBucketTaggingInput{
+		Bucket:  aws.String(bucket),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+// GetBucketTagging returns the tags of the bucket, a bucket without tags returns an empty map
+func (s *S3Agent) GetBucketTagging(bucket string) (map[string]string, error) {
+	out, err := s.Client.GetBucketTagging(&s3.GetBucketTaggingInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errCodeNoSuchTagSet {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, t := range out.TagSet {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
+}
+
+// DeleteBucketTagging removes all tags of the bucket
+func (s *S3Agent) DeleteBucketTagging(bucket string) error {
+	_, err := s.Client.DeleteBucketTagging(&s3.DeleteBucketTaggingInput{
+		Bucket: aws.String(bucket),
+	})
+	return err
+}